@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var strictAddr bool // Validate the syntax of envelope addresses.
+
+var (
+	errSenderSyntax    = errors.New("501 5.1.7 Invalid sender address syntax")
+	errRecipientSyntax = errors.New("501 5.1.3 Invalid recipient address syntax")
+)
+
+// canonicalAddr validates address as a RFC 5321 section 4.1.2 Mailbox and
+// returns it with its domain name lower cased. Quoted local parts are kept
+// quoted only when they need to be.
+func canonicalAddr(address string) (string, bool) {
+	at := strings.LastIndexByte(address, '@')
+	if at <= 0 {
+		return "", false
+	}
+	local, domain := address[:at], address[at+1:]
+
+	if strings.HasPrefix(local, `"`) {
+		unquoted, ok := unquoteLocal(local)
+		if !ok {
+			return "", false
+		}
+		if isDotString(unquoted) {
+			local = unquoted
+		}
+	} else if !isDotString(local) {
+		return "", false
+	}
+	if len(local) > 64 {
+		return "", false
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		if !isAddressLiteral(domain) {
+			return "", false
+		}
+	} else if isDomain(domain) {
+		domain = strings.ToLower(domain)
+	} else {
+		return "", false
+	}
+	return local + "@" + domain, true
+}
+
+// canonicalEnvelope returns the canonical form of the validated envelope
+// addresses.
+func canonicalEnvelope(from string, to []string) (string, []string) {
+	if canonical, ok := canonicalAddr(from); ok {
+		from = canonical
+	}
+	recipients := make([]string, len(to))
+	for i, rcpt := range to {
+		recipients[i] = rcpt
+		if canonical, ok := canonicalAddr(rcpt); ok {
+			recipients[i] = canonical
+		}
+	}
+	return from, recipients
+}
+
+// isDotString reports whether s is an RFC 5321 Dot-string.
+func isDotString(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			c := atom[i]
+			if !isAlnum(c) && !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", rune(c)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// unquoteLocal decodes an RFC 5321 Quoted-string.
+func unquoteLocal(s string) (string, bool) {
+	if len(s) < 2 || s[len(s)-1] != '"' {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		c := s[i]
+		if c == '\\' {
+			i++
+			if i == len(s)-1 || s[i] < 32 || s[i] > 126 {
+				return "", false
+			}
+			c = s[i]
+		} else if c < 32 || c > 126 || c == '"' {
+			return "", false
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
+
+// isDomain reports whether s is a RFC 5321 Domain.
+func isDomain(s string) bool {
+	if s == "" || len(s) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			if !isAlnum(label[i]) && label[i] != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAddressLiteral reports whether s is a IPv4 or IPv6 address literal.
+func isAddressLiteral(s string) bool {
+	if len(s) < 2 || s[len(s)-1] != ']' {
+		return false
+	}
+	literal := s[1 : len(s)-1]
+	if strings.HasPrefix(literal, "IPv6:") {
+		ip := net.ParseIP(literal[len("IPv6:"):])
+		return ip != nil && strings.Contains(literal, ":")
+	}
+	ip := net.ParseIP(literal)
+	return ip != nil && ip.To4() != nil && !strings.Contains(literal, ":")
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
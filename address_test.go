@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestCanonicalAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string // Canonical form, empty when invalid
+	}{
+		{"user@example.com", "user@example.com"},
+		{"First.Last+tag@Mail.Example.COM", "First.Last+tag@mail.example.com"},
+		{"user@[192.0.2.1]", "user@[192.0.2.1]"},
+		{"user@[IPv6:2001:db8::1]", "user@[IPv6:2001:db8::1]"},
+		{`"user"@example.com`, "user@example.com"},
+		{`"first.last"@example.com`, "first.last@example.com"},
+		{`"john doe"@example.com`, `"john doe"@example.com`},
+		{`"a\"b@c"@example.com`, `"a\"b@c"@example.com`},
+		{"", ""},
+		{"user", ""},
+		{"@example.com", ""},
+		{"user@", ""},
+		{"user..name@example.com", ""},
+		{".user@example.com", ""},
+		{"user name@example.com", ""},
+		{`"unterminated@example.com`, ""},
+		{`"bad"quote"@example.com`, ""},
+		{`"tab` + "\t" + `"@example.com`, ""},
+		{"user@-example.com", ""},
+		{"user@example..com", ""},
+		{"user@exa_mple.com", ""},
+		{"user@[192.0.2.256]", ""},
+		{"user@[2001:db8::1]", ""},
+		{"user@[IPv6:192.0.2.1", ""},
+		{"a123456789b123456789c123456789d123456789e123456789f123456789g12345@example.com", ""},
+	}
+	for _, tt := range tests {
+		got, ok := canonicalAddr(tt.address)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("canonicalAddr(%q) = %q, %v, want %q", tt.address, got, ok, tt.want)
+		}
+	}
+}
+
+func TestCanonicalEnvelope(t *testing.T) {
+	from, to := canonicalEnvelope(`"sender"@Example.ORG`, []string{"User@EXAMPLE.com", "not an address", "x@[IPv6:2001:db8::1]"})
+	if from != "sender@example.org" {
+		t.Errorf("from: got %q", from)
+	}
+	want := []string{"User@example.com", "not an address", "x@[IPv6:2001:db8::1]"}
+	for i := range want {
+		if to[i] != want[i] {
+			t.Errorf("to[%d]: got %q, want %q", i, to[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jsonlArchive appends every mail to a daily JSON lines file.
+type jsonlArchive struct {
+	mu   sync.Mutex
+	dir  string
+	day  string
+	file *os.File
+}
+
+// archiveRecord is one line of the archive.
+type archiveRecord struct {
+	TS      time.Time `json:"ts"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Remote  string    `json:"remote"`
+	Size    int       `json:"size"`
+	Hash    string    `json:"hash"`
+	Entropy float64   `json:"entropy,omitempty"`
+	Body    []byte    `json:"body_b64"` // encoded in base64 by encoding/json
+}
+
+// append writes rec to the archive file of its day.
+func (a *jsonlArchive) append(rec *archiveRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	ts := rec.TS
+	if !localTime {
+		ts = ts.UTC()
+	}
+	day := ts.Format("2006-01-02")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil || a.day != day {
+		if a.file != nil {
+			a.file.Close()
+			a.file = nil
+		}
+		a.file, err = os.OpenFile(filepath.Join(a.dir, day+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		a.day = day
+	}
+	_, err = a.file.Write(line)
+	return err
+}
+
+// close closes the current archive file.
+func (a *jsonlArchive) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	authCmd      string        // Command validating credentials.
+	authTimeout  time.Duration // Time given to authCmd to exit.
+	authCacheTTL time.Duration // Time successful credentials are remembered.
+
+	authMechanisms string // Comma separated AUTH mechanisms offered.
+
+	authCacheMu sync.Mutex
+	authCache   = make(map[[sha256.Size]byte]time.Time) // expiry of successful credentials
+)
+
+// configureAuthMechs restricts the AUTH mechanisms to the list, which the
+// configured backend must support: the plaintext password CRAM-MD5 needs is
+// unknown to -auth-external-cmd and -forward-auth-host.
+func configureAuthMechs(list string) error {
+	if srv.AuthHandler == nil {
+		return errors.New("-auth-mechanisms needs -auth-external-cmd or -forward-auth-host")
+	}
+	mechs := map[string]bool{"PLAIN": false, "LOGIN": false, "CRAM-MD5": false}
+	for _, mech := range strings.Split(list, ",") {
+		mech = strings.ToUpper(strings.TrimSpace(mech))
+		if _, ok := mechs[mech]; !ok {
+			return fmt.Errorf("-auth-mechanisms: unknown mechanism %q", mech)
+		}
+		if allowed, found := srv.AuthMechs[mech]; found && !allowed {
+			return fmt.Errorf("-auth-mechanisms: %s is not supported by the AUTH backend", mech)
+		}
+		delete(mechs, mech)
+	}
+	// Listed mechanisms keep their defaults, PLAIN and LOGIN need TLS.
+	srv.AuthMechs = mechs
+	return nil
+}
+
+var errAuthUnavailable = errors.New("454 4.7.0 Temporary authentication failure")
+
+// authExternal checks credentials with -auth-external-cmd. The user name is
+// given in the SMTP_AUTH_USER environment variable and the password on the
+// standard input, followed by a newline. Exit status 0 accepts the credentials.
+func authExternal(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	key := sha256.Sum256(bytes.Join([][]byte{username, password}, []byte{0}))
+	if authCacheTTL > 0 && authCached(key) {
+		return true, nil
+	}
+
+	args := strings.Fields(authCmd)
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "SMTP_AUTH_USER="+string(username), "SMTP_AUTH_REMOTE_IP="+remoteIP(remoteAddr).String())
+	cmd.Stdin = bytes.NewReader(append(append([]byte(nil), password...), '\n'))
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("WARNING: remote: %v, -auth-external-cmd timed out after %v", remoteAddr, authTimeout)
+		return false, errAuthUnavailable
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if !logQuiet || smtpd.Debug {
+			log.Printf("remote: %v, AUTH %s failed for user %q", remoteAddr, mechanism, username)
+		}
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("WARNING: remote: %v, -auth-external-cmd: %v", remoteAddr, err)
+		return false, errAuthUnavailable
+	}
+
+	if authCacheTTL > 0 {
+		authCacheMu.Lock()
+		authCache[key] = time.Now().Add(authCacheTTL)
+		authCacheMu.Unlock()
+	}
+	return true, nil
+}
+
+// authCached reports whether credentials succeeded less than -auth-external-cache-ttl ago.
+// Expired entries are dropped along the way.
+func authCached(key [sha256.Size]byte) bool {
+	authCacheMu.Lock()
+	defer authCacheMu.Unlock()
+	now := time.Now()
+	for k, expiry := range authCache {
+		if now.After(expiry) {
+			delete(authCache, k)
+		}
+	}
+	_, ok := authCache[key]
+	return ok
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// authScript accepts alice with password s3cret, after a while for the user
+// slow, and logs a line to the file of its argument per run.
+const authScript = `#!/bin/sh
+read password
+echo "$SMTP_AUTH_USER" >> "$1"
+[ "$SMTP_AUTH_USER" = slow ] && exec sleep 5
+[ "$SMTP_AUTH_USER" = alice ] && [ "$password" = s3cret ]
+`
+
+func TestAuthExternal(t *testing.T) {
+	defer func(cmd string, timeout, ttl time.Duration) {
+		authCmd, authTimeout, authCacheTTL = cmd, timeout, ttl
+		authCache = make(map[[sha256.Size]byte]time.Time)
+	}(authCmd, authTimeout, authCacheTTL)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	script, runs := filepath.Join(dir, "auth.sh"), filepath.Join(dir, "runs")
+	if err := os.WriteFile(script, []byte(authScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+	authCmd, authTimeout, authCacheTTL = script+" "+runs, 500*time.Millisecond, time.Minute
+	authCache = make(map[[sha256.Size]byte]time.Time)
+
+	front := serveSMTP(t, &smtpd.Server{Hostname: "mx.example.com",
+		AuthMechs:   map[string]bool{"PLAIN": true, "LOGIN": true},
+		AuthHandler: authExternal})
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name string
+		cmds []string
+		code int
+	}{
+		{"plain", []string{authPlain("alice", "s3cret")}, 235},
+		{"plain cached", []string{authPlain("alice", "s3cret")}, 235},
+		{"plain wrong password", []string{authPlain("alice", "wrong")}, 535},
+		{"login", []string{"AUTH LOGIN", b64("alice"), b64("s3cret")}, 235},
+		{"login initial response", []string{"AUTH LOGIN " + b64("bob"), b64("s3cret")}, 535},
+		{"timeout", []string{authPlain("slow", "s3cret")}, 454},
+	}
+	for _, tt := range tests {
+		c, err := textproto.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ReadResponse(220)
+		c.PrintfLine("EHLO client.example.org")
+		c.ReadResponse(250)
+		for i, cmd := range tt.cmds {
+			c.PrintfLine("%s", cmd)
+			code := 334
+			if i == len(tt.cmds)-1 {
+				code = tt.code
+			}
+			if _, msg, err := c.ReadResponse(code); err != nil {
+				t.Errorf("%s: %s: %s: %v", tt.name, cmd, msg, err)
+				break
+			}
+		}
+		c.Close()
+	}
+
+	// Cached credentials do not run the command again, whatever the mechanism.
+	data, _ := os.ReadFile(runs)
+	if got, want := strings.Fields(string(data)), []string{"alice", "alice", "bob", "slow"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("command runs for %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	autoBan          bool          // Ban the IPs getting too many 550 or 554 replies.
+	autoBanThreshold int           // Rejections within -auto-ban-window above which an IP is banned.
+	autoBanWindow    time.Duration // Sliding window over which the rejections are counted.
+	autoBanDuration  time.Duration // Time an IP stays banned.
+	autoBanHTTP      string        // Address of the HTTP listener serving the ban list.
+)
+
+// banList holds the recent rejection times of each IP and the IPs banned
+// until a given time.
+type banList struct {
+	mu         sync.Mutex
+	rejections map[string][]time.Time
+	bans       map[string]ban
+}
+
+// ban is an entry of the ban list, as served by /bans.
+type ban struct {
+	IP    string    `json:"ip"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+var autoBans = banList{rejections: map[string][]time.Time{}, bans: map[string]ban{}}
+
+// reject records a rejection of ip and bans it when it got more than
+// -auto-ban-threshold rejections within -auto-ban-window.
+func (l *banList) reject(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[ip]; ok {
+		return false
+	}
+	times := append(recentRejections(l.rejections[ip], now), now)
+	if len(times) <= autoBanThreshold {
+		l.rejections[ip] = times
+		return false
+	}
+	delete(l.rejections, ip)
+	l.bans[ip] = ban{IP: ip, Since: now, Until: now.Add(autoBanDuration)}
+	return true
+}
+
+// recentRejections drops the times older than -auto-ban-window.
+func recentRejections(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= autoBanWindow {
+		i++
+	}
+	return times[i:]
+}
+
+// banned reports whether ip is banned, forgetting an expired ban.
+func (l *banList) banned(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[ip]
+	if ok && !now.Before(b.Until) {
+		delete(l.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// expire forgets the expired bans and the rejections out of the window.
+func (l *banList) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.bans {
+		if !now.Before(b.Until) {
+			delete(l.bans, ip)
+		}
+	}
+	for ip, times := range l.rejections {
+		if times = recentRejections(times, now); len(times) == 0 {
+			delete(l.rejections, ip)
+		} else {
+			l.rejections[ip] = times
+		}
+	}
+}
+
+// list returns the current bans, oldest first.
+func (l *banList) list(now time.Time) []ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bans := make([]ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		if now.Before(b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Since.Before(bans[j].Since) })
+	return bans
+}
+
+// countRejection is the smtpd reply handler feeding the ban list with the
+// 550 and 554 replies.
+func countRejection(remoteAddr net.Addr, reply string) {
+	if !strings.HasPrefix(reply, "550") && !strings.HasPrefix(reply, "554") {
+		return
+	}
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return
+	}
+	if autoBans.reject(ip.String(), time.Now()) {
+		statsd.count("auto_bans", 1)
+		log.Printf("remote: %v, banned for %v: more than %d rejections within %v",
+			remoteAddr, autoBanDuration, autoBanThreshold, autoBanWindow)
+	}
+}
+
+// refuseBanned tells a banned client to go away and closes conn.
+func refuseBanned(conn net.Conn) {
+	statsd.count("rejections.auto_ban", 1)
+	log.Printf("remote: %v, rejected: banned", conn.RemoteAddr())
+	conn = refusalConn(conn)
+	fmt.Fprintf(conn, "%s\r\n", srv.RejectReply(fmt.Sprintf("554 5.7.1 %s Go away", srv.Hostname)))
+	conn.Close()
+}
+
+// startAutoBan expires the ban list in the background and serves it as
+// JSON at /bans of -auto-ban-http.
+func startAutoBan() {
+	if !autoBan {
+		return
+	}
+	go func() {
+		for now := range time.Tick(autoBanWindow) {
+			autoBans.expire(now)
+		}
+	}()
+	if autoBanHTTP == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(autoBans.list(time.Now()))
+	})
+	httpLn, err := net.Listen("tcp", autoBanHTTP)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Printf("WARNING: -auto-ban-http stopped: %v", http.Serve(httpLn, mux))
+	}()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxBannerDelay keeps the greeting delay well below the 5 minutes
+// RFC 5321 lets clients wait for it.
+const maxBannerDelay = 30 * time.Second
+
+var bannerDelayMin, bannerDelayMax time.Duration // Range of the greeting delay.
+
+// checkBannerDelay validates the -banner-delay-min and -banner-delay-max range.
+func checkBannerDelay() error {
+	if bannerDelayMin < 0 || bannerDelayMax < bannerDelayMin {
+		return errors.New("-banner-delay-min must be positive and not above -banner-delay-max")
+	}
+	if bannerDelayMax > maxBannerDelay {
+		return errors.New("-banner-delay-max must not exceed " + maxBannerDelay.String())
+	}
+	return nil
+}
+
+// bannerDelay returns a random delay, uniformly distributed between
+// -banner-delay-min and -banner-delay-max.
+func bannerDelay() time.Duration {
+	span := int64(bannerDelayMax - bannerDelayMin)
+	if span == 0 {
+		return bannerDelayMin
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(span+1))
+	if err != nil {
+		return bannerDelayMin
+	}
+	return bannerDelayMin + time.Duration(n.Int64())
+}
+
+// delayedConn waits before sending its first bytes, the greeting banner.
+type delayedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(bannerDelay()) })
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBannerDelay(t *testing.T) {
+	defer func(min, max time.Duration) { bannerDelayMin, bannerDelayMax = min, max }(bannerDelayMin, bannerDelayMax)
+	bannerDelayMin, bannerDelayMax = 2*time.Second, 6*time.Second
+	if err := checkBannerDelay(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uniformly distributed, the delays fill the quarters of the range
+	// evenly and average to its middle.
+	const samples = 20000
+	var quarters [4]int
+	var sum time.Duration
+	for i := 0; i < samples; i++ {
+		d := bannerDelay()
+		if d < bannerDelayMin || d > bannerDelayMax {
+			t.Fatalf("delay %v out of range", d)
+		}
+		q := int((d - bannerDelayMin) * 4 / (bannerDelayMax - bannerDelayMin))
+		if q == 4 {
+			q = 3
+		}
+		quarters[q]++
+		sum += d
+	}
+	for i, n := range quarters {
+		if n < samples/4*9/10 || n > samples/4*11/10 {
+			t.Errorf("quarter %d: %d delays, want about %d", i, n, samples/4)
+		}
+	}
+	if mean := sum / samples; mean < 3900*time.Millisecond || mean > 4100*time.Millisecond {
+		t.Errorf("mean delay %v, want about 4s", mean)
+	}
+
+	bannerDelayMin, bannerDelayMax = 3*time.Second, 3*time.Second
+	if d := bannerDelay(); d != 3*time.Second {
+		t.Errorf("fixed delay: got %v", d)
+	}
+	for _, r := range [][2]time.Duration{{-time.Second, time.Second}, {2 * time.Second, time.Second}, {0, time.Minute}} {
+		bannerDelayMin, bannerDelayMax = r[0], r[1]
+		if checkBannerDelay() == nil {
+			t.Errorf("range %v accepted", r)
+		}
+	}
+}
+
+// TestBannerDelayConn checks only the first write of a connection is
+// delayed, and that a zero range leaves connections undelayed.
+func TestBannerDelayConn(t *testing.T) {
+	defer func(min, max time.Duration) { bannerDelayMin, bannerDelayMax = min, max }(bannerDelayMin, bannerDelayMax)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &listener{Listener: ln}
+	defer l.Close()
+
+	for _, delay := range []time.Duration{0, 200 * time.Millisecond} {
+		bannerDelayMin, bannerDelayMax = delay, delay
+		if err := checkBannerDelay(); err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(io.Discard, client)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, delayed := conn.(*delayedConn); delayed != (delay > 0) {
+			t.Errorf("delay %v: connection delayed %v", delay, delayed)
+		}
+		for i, want := range []time.Duration{delay, 0} {
+			start := time.Now()
+			conn.Write([]byte("220 mx.example.com\r\n"))
+			if elapsed := time.Since(start); elapsed < want || elapsed > want+150*time.Millisecond {
+				t.Errorf("delay %v: write %d took %v", delay, i, elapsed)
+			}
+		}
+		conn.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var batvKey string // Secret of the BATV prvs tags of the bounce recipients.
+
+// batvValidity is the time a prvs tag stays valid after it was made.
+const batvValidity = 7
+
+var errInvalidBATV = errors.New("550 5.7.0 Invalid BATV signature")
+
+// batvDay returns the day number of t in the prvs tags, the last three
+// digits of the days since the epoch.
+func batvDay(t time.Time) int {
+	return int(t.Unix()/86400) % 1000
+}
+
+// batvTag returns the prvs tagged form of addr, expiring on day:
+// prvs=KDDDSSSSSS=addr, with key number K 0, the expiry day DDD and the
+// first 3 bytes of the HMAC-SHA1 of "KDDD" and addr in hexadecimal.
+func batvTag(addr string, day int) string {
+	kddd := fmt.Sprintf("0%03d", day)
+	mac := hmac.New(sha1.New, []byte(batvKey))
+	mac.Write([]byte(kddd + addr))
+	return "prvs=" + kddd + hex.EncodeToString(mac.Sum(nil)[:3]) + "=" + addr
+}
+
+// batvVerify checks the prvs tag of addr, returning the untagged address.
+// Tags expired or made more than batvValidity days ahead are invalid.
+func batvVerify(addr string, now time.Time) (string, bool) {
+	parts := strings.SplitN(addr, "=", 3)
+	if len(parts) != 3 || len(parts[1]) != 10 {
+		return addr, false
+	}
+	orig := parts[2]
+	day, err := strconv.Atoi(parts[1][1:4])
+	if err != nil {
+		return orig, false
+	}
+	if left := (day - batvDay(now) + 1000) % 1000; left > batvValidity {
+		return orig, false
+	}
+	return orig, hmac.Equal([]byte(strings.ToLower(addr)), []byte(strings.ToLower(batvTag(orig, day))))
+}
+
+// checkBATV refuses the bounces, mails from the null sender, to a prvs
+// tagged recipient whose tag -batv-key does not validate. Untagged
+// recipients are accepted.
+func checkBATV(remoteAddr net.Addr, from, to string) error {
+	if batvKey == "" || from != "" || !strings.HasPrefix(strings.ToLower(to), "prvs=") {
+		return nil
+	}
+	orig, ok := batvVerify(to, time.Now())
+	if !ok {
+		logRejection(remoteAddr, from, []string{to}, "batv", "invalid BATV tag for <"+orig+">")
+		return errInvalidBATV
+	}
+	if !logQuiet || smtpd.Debug {
+		log.Printf(logFormatHead+", BATV tag valid, original recipient: <%s>", remoteAddr, from, []string{to}, orig)
+	}
+	return nil
+}
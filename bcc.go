@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+var (
+	bccDetectLog    bool // Log envelope recipients absent from To and Cc.
+	bccInjectHeader bool // Add X-BCC-Detected to mails with such recipients.
+)
+
+// headerRecipients returns the addresses of the To and Cc headers of message.
+// Unparsable headers are ignored.
+func headerRecipients(message []byte) []string {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil
+	}
+	var rcpts []string
+	for _, name := range []string{"To", "Cc"} {
+		list, _ := msg.Header.AddressList(name)
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return rcpts
+}
+
+// bccRecipients reports whether some envelope recipients are not among the
+// header recipients, i.e. were blind carbon copied.
+func bccRecipients(to, header []string) bool {
+	known := make(map[string]bool, len(header))
+	for _, rcpt := range header {
+		known[strings.ToLower(rcpt)] = true
+	}
+	for _, rcpt := range to {
+		if !known[strings.ToLower(rcpt)] {
+			return true
+		}
+	}
+	return false
+}
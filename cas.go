@@ -0,0 +1,19 @@
+package main
+
+import "path/filepath"
+
+var (
+	casRoot  string // Root directory of the content addressable store.
+	casDepth int    // Number of fan-out directory levels.
+)
+
+// casPath returns the path of the mail whose hex encoded hash is sum:
+// casDepth levels of directories named after 2 characters of the hash,
+// then the full hash, e.g. ab/cd/abcdef... for a depth of 2.
+func casPath(sum string) string {
+	parts := []string{casRoot}
+	for i := 0; i < casDepth && 2*i+2 < len(sum); i++ {
+		parts = append(parts, sum[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, sum)...)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCASPath(t *testing.T) {
+	defer func(root string, depth int) { casRoot, casDepth = root, depth }(casRoot, casDepth)
+	casRoot = "/cas"
+	sum := "abcdef0123"
+	for depth, want := range []string{"/cas/abcdef0123", "/cas/ab/abcdef0123", "/cas/ab/cd/abcdef0123"} {
+		casDepth = depth
+		if got := casPath(sum); got != filepath.FromSlash(want) {
+			t.Errorf("depth %d: got %s, want %s", depth, got, want)
+		}
+	}
+	// The full hash always remains the last element.
+	casDepth = 10
+	if got := casPath(sum); got != filepath.FromSlash("/cas/ab/cd/ef/01/abcdef0123") {
+		t.Errorf("depth 10: got %s", got)
+	}
+}
+
+// TestCASStore delivers identical content to different recipients, and
+// checks it is stored once at the path of its hash.
+func TestCASStore(t *testing.T) {
+	defer func(root string, depth int, format string, hash bool) {
+		casRoot, casDepth, fileFormat, needDataHash = root, depth, format, hash
+	}(casRoot, casDepth, fileFormat, needDataHash)
+	casRoot, casDepth, fileFormat, needDataHash = t.TempDir(), 2, "%h", true
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	deliver := func(to, body string) {
+		data := "Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <" + to + ">\r\n" +
+			"Subject: test\r\n\r\n" + body
+		if err := mailProcessing(addr, "sender@example.org", []string{to}, []byte(data)); err != nil {
+			t.Fatalf("%s: %v", to, err)
+		}
+	}
+	deliver("alice@example.com", "Same content.\r\n")
+	deliver("bob@example.com", "Same content.\r\n")
+	deliver("carol@example.com", "Other content.\r\n")
+
+	var stored []string
+	filepath.Walk(casRoot, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(casRoot, path)
+			stored = append(stored, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if len(stored) != 2 {
+		t.Fatalf("stored %v, want 2 files", stored)
+	}
+	for _, path := range stored {
+		parts := strings.Split(path, "/")
+		if len(parts) != 3 || len(parts[2]) != 64 || parts[0] != parts[2][:2] || parts[1] != parts[2][2:4] {
+			t.Errorf("path %s does not follow the hash", path)
+		}
+	}
+}
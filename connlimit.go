@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	maxConnPerIP int // Maximum simultaneous connections from one IP, 0 is unlimited.
+
+	connMu     sync.Mutex
+	connsPerIP = make(map[string]int)
+
+	connLimitExempt     netList      // Networks exempted from -maxconn-per-ip.
+	connLimitExemptFile string       // File of more exempted networks, reloaded on SIGHUP.
+	exemptFileNets      atomic.Value // netList read from connLimitExemptFile
+)
+
+// acquireConn accounts a new connection from ip, it returns false when ip
+// already reached -maxconn-per-ip. Connections of exempted IPs are
+// accounted but never refused.
+func acquireConn(ip net.IP) bool {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if connsPerIP[ip.String()] >= maxConnPerIP {
+		if !connLimitExempted(ip) {
+			return false
+		}
+		statsd.count("maxconn_exempted", 1)
+	}
+	connsPerIP[ip.String()]++
+	return true
+}
+
+// connLimitExempted reports whether ip is exempted from -maxconn-per-ip.
+func connLimitExempted(ip net.IP) bool {
+	if connLimitExempt.contains(ip) {
+		return true
+	}
+	nets, _ := exemptFileNets.Load().(netList)
+	return nets.contains(ip)
+}
+
+// loadConnLimitExemptFile reads -connection-limit-whitelist-file, holding
+// networks in CIDR notation, one per line. Empty lines and lines starting
+// with # are ignored.
+func loadConnLimitExemptFile() error {
+	if connLimitExemptFile == "" {
+		return nil
+	}
+	f, err := os.Open(connLimitExemptFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var nets netList
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := nets.Set(text); err != nil {
+			return fmt.Errorf("%s:%d: %w", connLimitExemptFile, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	exemptFileNets.Store(nets)
+	return nil
+}
+
+// reloadOnHangup reloads -connection-limit-whitelist-file on SIGHUP. The
+// previous networks are kept when the file cannot be read.
+func reloadOnHangup() {
+	if connLimitExemptFile == "" {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := loadConnLimitExemptFile(); err != nil {
+				log.Printf("WARNING: reloading -connection-limit-whitelist-file: %v", err)
+				continue
+			}
+			nets, _ := exemptFileNets.Load().(netList)
+			log.Printf("-connection-limit-whitelist-file reloaded, %d networks.", len(nets))
+		}
+	}()
+}
+
+// releaseConn forgets a closed connection from ip.
+func releaseConn(ip string) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if connsPerIP[ip]--; connsPerIP[ip] <= 0 {
+		delete(connsPerIP, ip)
+	}
+}
+
+// limitedConn releases its slot of the per IP limit once closed.
+type limitedConn struct {
+	net.Conn
+	ip   string
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { releaseConn(c.ip) })
+	return c.Conn.Close()
+}
+
+// refuseConn tells the client it has too many connections and closes conn.
+func refuseConn(conn net.Conn) {
+	statsd.count("rejections.maxconn", 1)
+	log.Printf("remote: %v, rejected: more than %d connections", conn.RemoteAddr(), maxConnPerIP)
+	conn = refusalConn(conn)
+	fmt.Fprintf(conn, "%s\r\n", srv.RejectReply(fmt.Sprintf("421 4.7.0 %s Too many connections from your IP, try again later", srv.Hostname)))
+	conn.Close()
+}
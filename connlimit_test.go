@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// serveLimited serves a smtpd server through the listener applying the
+// connection limits, and returns its address.
+func serveLimited(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &smtpd.Server{Hostname: "mx.example.com"}
+	go server.Serve(&listener{Listener: ln})
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// dialBanner connects to addr from the local IP and returns the connection
+// with the code of its banner.
+func dialBanner(t *testing.T, addr, local string) (*textproto.Conn, int) {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("dialing from %s: %v", local, err)
+	}
+	c := textproto.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	code, _, _ := c.ReadResponse(0)
+	return c, code
+}
+
+// TestConnLimitWhitelist opens more connections than -maxconn-per-ip from
+// a whitelisted IP and from another, only the latter being refused.
+func TestConnLimitWhitelist(t *testing.T) {
+	defer func(max int, exempt netList) {
+		maxConnPerIP, connLimitExempt = max, exempt
+	}(maxConnPerIP, connLimitExempt)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	maxConnPerIP, connLimitExempt = 2, nil
+	connLimitExempt.Set("127.0.0.2/32")
+
+	addr := serveLimited(t)
+	for i := 1; i <= 3; i++ {
+		if _, code := dialBanner(t, addr, "127.0.0.2"); code != 220 {
+			t.Errorf("whitelisted connection %d: reply %d, want 220", i, code)
+		}
+	}
+	for i, want := range []int{220, 220, 421} {
+		if _, code := dialBanner(t, addr, "127.0.0.1"); code != want {
+			t.Errorf("connection %d: reply %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+// TestMaxConnPerIP opens -maxconn-per-ip + 1 connections from one IP, and
+// checks the last is refused until another is closed.
+func TestMaxConnPerIP(t *testing.T) {
+	defer func(max int) { maxConnPerIP = max }(maxConnPerIP)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	maxConnPerIP = 3
+
+	addr := serveLimited(t)
+	var conns []*textproto.Conn
+	for i := 1; i <= maxConnPerIP; i++ {
+		c, code := dialBanner(t, addr, "127.0.0.1")
+		if code != 220 {
+			t.Fatalf("connection %d: reply %d, want 220", i, code)
+		}
+		conns = append(conns, c)
+	}
+	if _, code := dialBanner(t, addr, "127.0.0.1"); code != 421 {
+		t.Errorf("connection %d: reply %d, want 421", maxConnPerIP+1, code)
+	}
+
+	// A slot is released once the server sees the connection closed.
+	conns[0].PrintfLine("QUIT")
+	conns[0].ReadResponse(221)
+	conns[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); connCount("127.0.0.1") != maxConnPerIP-1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections accounted after a close", connCount("127.0.0.1"))
+		}
+	}
+	c, code := dialBanner(t, addr, "127.0.0.1")
+	if code != 220 {
+		t.Errorf("connection after a close: reply %d, want 220", code)
+	}
+
+	// The entry of an IP is removed with its last connection.
+	for _, c := range append(conns[1:], c) {
+		c.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		connMu.Lock()
+		_, ok := connsPerIP["127.0.0.1"]
+		connMu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry kept with %d connections accounted", connCount("127.0.0.1"))
+		}
+	}
+}
+
+// connCount returns the connections accounted for ip.
+func connCount(ip string) int {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return connsPerIP[ip]
+}
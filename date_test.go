@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceivedDate(t *testing.T) {
+	defer func(format string, local bool) { dateFormat, localTime = format, local }(dateFormat, localTime)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := time.Date(2024, 3, 5, 16, 7, 9, 0, paris)
+
+	tests := []struct {
+		format string
+		local  bool
+		want   string
+	}{
+		{"", false, "1709651229"},
+		{"2006-01-02_150405", false, "2024-03-05_150709"},
+		{"2006-01-02_150405", true, "2024-03-05_160709"},
+		{"2006-01-02T15:04:05Z07:00", false, "2024-03-05T15_07_09Z"},
+		{"2006-01-02T15:04:05Z07:00", true, "2024-03-05T16_07_09+01_00"},
+		{"2006/01/02 15:04 MST", false, "2024_03_05 15_07 UTC"},
+		{`Jan 2 "06" <3:04PM> | $1 * ? \`, false, `Mar 5 _24_ _3_07PM_ _ _3 _ _ _`},
+	}
+	for _, tt := range tests {
+		dateFormat, localTime = tt.format, tt.local
+		if got := receivedDate(date); got != tt.want {
+			t.Errorf("%q, local %v: got %q, want %q", tt.format, tt.local, got, tt.want)
+		}
+	}
+
+	dateFormat = strings.Repeat("2006", 16)
+	if err := checkDateFormat(); err != nil {
+		t.Errorf("64 characters: %v", err)
+	}
+	dateFormat = strings.Repeat("2006", 16) + "-"
+	if err := checkDateFormat(); err == nil {
+		t.Error("65 characters accepted")
+	}
+}
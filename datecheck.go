@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	maxClockSkew  time.Duration // Reject mails dated further in the future.
+	maxMessageAge time.Duration // Reject mails dated further in the past.
+	dateMissing   string        // accept or reject mails without valid Date.
+)
+
+// checkDate refuses mails whose Date header is off the reception time by
+// more than -max-clock-skew or -max-message-age, and per -date-missing the
+// mails without parsable Date header. Accepted dates are logged with -debug,
+// with their delta to the reception time, negative in the future.
+func checkDate(remoteAddr net.Addr, from string, to []string, data []byte, received time.Time) error {
+	if maxClockSkew == 0 && maxMessageAge == 0 {
+		return nil
+	}
+	var date time.Time
+	msg, err := mail.ReadMessage(bytes.NewReader(data[payloadStart(data):]))
+	if err == nil {
+		date, err = msg.Header.Date()
+	}
+	if err != nil {
+		if dateMissing != "reject" {
+			if smtpd.Debug {
+				log.Printf(logFormatHead+", accepted without valid Date header: %v", remoteAddr, from, to, err)
+			}
+			return nil
+		}
+		logRejection(remoteAddr, from, to, "date", "no valid Date header: "+err.Error())
+		return errors.New("550 5.6.0 Message rejected: valid Date header required")
+	}
+	delta := received.Sub(date)
+	switch {
+	case maxClockSkew > 0 && -delta > maxClockSkew:
+		logRejection(remoteAddr, from, to, "date",
+			fmt.Sprintf("Date %s is %v in the future", date.Format(time.RFC3339), -delta.Round(time.Second)))
+		return errors.New("550 5.6.0 Message rejected: Date header is in the future")
+	case maxMessageAge > 0 && delta > maxMessageAge:
+		logRejection(remoteAddr, from, to, "date",
+			fmt.Sprintf("Date %s is %v in the past", date.Format(time.RFC3339), delta.Round(time.Second)))
+		return errors.New("550 5.6.0 Message rejected: Date header is too old")
+	}
+	if smtpd.Debug {
+		log.Printf(logFormatHead+", Date: %s, delta: %v", remoteAddr, from, to, date.Format(time.RFC3339), delta.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+func TestCheckDate(t *testing.T) {
+	defer func(skew, age time.Duration, missing string, debug bool) {
+		maxClockSkew, maxMessageAge, dateMissing, smtpd.Debug = skew, age, missing, debug
+	}(maxClockSkew, maxMessageAge, dateMissing, smtpd.Debug)
+	maxClockSkew, maxMessageAge, smtpd.Debug = time.Hour, 24*time.Hour, true
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	received := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		date, missing string
+		ok            bool
+		log           string
+	}{
+		{"Fri, 01 Mar 2024 12:30:00 +0000", "accept", true, "Date: 2024-03-01T12:30:00Z, delta: -30m0s"},
+		{"Fri, 01 Mar 2024 14:00:00 +0100", "accept", true, "Date: 2024-03-01T14:00:00+01:00, delta: -1h0m0s"},
+		{"Fri, 01 Mar 2024 14:00:00 +0000", "accept", false, "is 2h0m0s in the future"},
+		{"Mon, 01 Jan 2024 12:00:00 +0000", "accept", false, "is 1440h0m0s in the past"},
+		{"", "accept", true, "accepted without valid Date header"},
+		{"yesterday", "reject", false, "no valid Date header"},
+	} {
+		logs.Reset()
+		dateMissing = test.missing
+		data := "Subject: test\r\n\r\nbody\r\n"
+		if test.date != "" {
+			data = "Date: " + test.date + "\r\n" + data
+		}
+		// The Received header of smtpd spans three lines.
+		data = "Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <user@example.com>\r\n" + data
+		err := checkDate(addr, "sender@example.org", []string{"user@example.com"}, []byte(data), received)
+		if (err == nil) != test.ok {
+			t.Errorf("Date %q: got %v", test.date, err)
+		}
+		if !strings.Contains(logs.String(), test.log) {
+			t.Errorf("Date %q: log %q does not contain %q", test.date, logs.String(), test.log)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"smtp_receiver/smtpd"
+)
+
+var enforceDeclaredSize bool // Reject mails larger than their MAIL FROM SIZE parameter.
+
+var errSizeMismatch = errors.New("552 5.3.4 Message larger than its declared SIZE")
+
+// checkDeclaredSize refuses mails whose data, without the Received header
+// added by smtpd, exceeds the SIZE parameter given with MAIL FROM.
+func checkDeclaredSize(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	peer, ok := remoteAddr.(*smtpd.Peer)
+	if !enforceDeclaredSize || !ok || peer.MailSize < 0 {
+		return nil
+	}
+	if actual := len(data) - payloadStart(data); actual > peer.MailSize {
+		logRejection(remoteAddr, from, to, "size_mismatch", fmt.Sprintf("declared SIZE %d, received %d bytes", peer.MailSize, actual))
+		return errSizeMismatch
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	denyNets    netList       // Networks whose connections are refused.
+	denyHold    time.Duration // Time a refused connection is held open.
+	denyHoldMax int64         // Maximum number of connections held at once.
+	denyHeld    int64         // atomic count of connections being held
+
+	// shutdown is closed when the server stops, to release held connections.
+	shutdown = make(chan struct{})
+)
+
+// holdDenied refuses a connection from -deny-ips with a 554 greeting, then
+// keeps it open for -deny-hold to slow down scanners before closing it.
+// Connections are closed at once above -deny-hold-max held connections.
+func holdDenied(conn net.Conn) {
+	conn = refusalConn(conn)
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\r\n", srv.RejectReply(fmt.Sprintf("554 5.7.1 %s Access denied", srv.Hostname)))
+	statsd.count("rejections.deny", 1)
+	if denyHold <= 0 {
+		log.Printf("remote: %v, denied", conn.RemoteAddr())
+		return
+	}
+	if held := atomic.AddInt64(&denyHeld, 1); held > denyHoldMax {
+		atomic.AddInt64(&denyHeld, -1)
+		log.Printf("remote: %v, denied, not held: %d connections already held", conn.RemoteAddr(), denyHoldMax)
+		return
+	}
+	defer atomic.AddInt64(&denyHeld, -1)
+	log.Printf("remote: %v, denied, held for %v", conn.RemoteAddr(), denyHold)
+
+	timer := time.NewTimer(denyHold)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-shutdown:
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteSize is a flag of a number of bytes, with an optional KB, MB, GB or
+// TB suffix in powers of 1000.
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	if b == nil || *b == 0 {
+		return "0"
+	}
+	return formatBytes(float64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	units := []string{"TB", "GB", "MB", "KB", "B"}
+	multiplier := uint64(1)
+	number := strings.ToUpper(strings.TrimSpace(value))
+	for i, unit := range units {
+		if strings.HasSuffix(number, unit) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit))
+			for j := i; j < len(units)-1; j++ {
+				multiplier *= 1000
+			}
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * float64(multiplier))
+	return nil
+}
+
+var (
+	diskMinFree       byteSize      // Free space required to save a mail.
+	diskCheckInterval time.Duration // Time the last free space check is trusted.
+
+	diskMu      sync.Mutex
+	diskChecked time.Time
+	diskErr     error
+)
+
+var errDiskFull = errors.New("452 4.3.1 Insufficient system storage")
+
+// checkDiskSpace returns errDiskFull when the filesystem receiving filename
+// has less than -disk-min-free bytes available. The result is reused for
+// -disk-check-interval.
+func checkDiskSpace(filename string) error {
+	if diskMinFree == 0 {
+		return nil
+	}
+	diskMu.Lock()
+	defer diskMu.Unlock()
+	if diskCheckInterval > 0 && time.Since(diskChecked) < diskCheckInterval {
+		return diskErr
+	}
+
+	// The directory of filename may not be created yet.
+	dir := filepath.Dir(filename)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	switch {
+	case err != nil:
+		diskErr = fmt.Errorf("unable to check free space of %s: %w", dir, err)
+	case free < uint64(diskMinFree):
+		diskErr = errDiskFull
+	default:
+		diskErr = nil
+	}
+	diskChecked = time.Now()
+	return diskErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd
+// +build !linux,!darwin,!dragonfly,!freebsd
+
+package main
+
+import "errors"
+
+// freeSpaceSupported reports whether freeSpace works, -disk-min-free being
+// refused at startup otherwise.
+const freeSpaceSupported = false
+
+// freeSpace is only supported on some Unix systems.
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("-disk-min-free is not supported on this platform")
+}
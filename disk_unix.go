@@ -0,0 +1,22 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package main
+
+import "syscall"
+
+// freeSpaceSupported reports whether freeSpace works, -disk-min-free being
+// refused at startup otherwise.
+const freeSpaceSupported = true
+
+var statfs = syscall.Statfs // Replaced by the tests.
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,60 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDiskFull reports little free space through a mocked statfs and checks
+// mails are refused with 452 and not written.
+func TestDiskFull(t *testing.T) {
+	dir := t.TempDir()
+	defer func(format string, min byteSize, interval time.Duration, fn func(string, *syscall.Statfs_t) error) {
+		fileFormat, diskMinFree, diskCheckInterval, statfs = format, min, interval, fn
+		diskChecked = time.Time{}
+	}(fileFormat, diskMinFree, diskCheckInterval, statfs)
+	fileFormat, diskMinFree, diskCheckInterval = filepath.Join(dir, "mail.eml"), 100e6, time.Hour
+	diskChecked = time.Time{}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var calls int
+	full := true
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		calls++
+		st.Bavail, st.Bsize = 1000, 4096
+		if !full {
+			st.Bavail = 1e6
+		}
+		return nil
+	}
+	data := []byte("Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <user@example.com>\r\nSubject: test\r\n\r\nbody\r\n")
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	err := mailProcessing(addr, "sender@example.org", []string{"user@example.com"}, data)
+	if err == nil || !strings.HasPrefix(err.Error(), "452 4.3.1 ") {
+		t.Errorf("low free space: got %v, want a 452", err)
+	}
+	if _, err := os.Stat(fileFormat); !os.IsNotExist(err) {
+		t.Errorf("mail written: %v", err)
+	}
+
+	// The result is reused for -disk-check-interval.
+	full = false
+	if err := checkDiskSpace(fileFormat); err != errDiskFull || calls != 1 {
+		t.Errorf("within -disk-check-interval: got %v after %d statfs calls", err, calls)
+	}
+	diskCheckInterval = 0
+	if err := mailProcessing(addr, "sender@example.org", []string{"user@example.com"}, data); err != nil {
+		t.Errorf("enough free space: %v", err)
+	}
+}
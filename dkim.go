@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	dkimDomain   string // Signing domain (d= tag).
+	dkimSelector string // Key selector (s= tag).
+	dkimKeyFile  string // PEM encoded RSA private key.
+	dkimKey      *rsa.PrivateKey
+)
+
+// dkimHeaders are the headers signed, when present in the message.
+var dkimHeaders = []string{"From", "To", "Subject", "Date", "Message-ID"}
+
+// loadDKIMKey reads the signing key when DKIM signing is configured.
+func loadDKIMKey() error {
+	if dkimDomain == "" && dkimSelector == "" && dkimKeyFile == "" {
+		return nil
+	}
+	if dkimDomain == "" || dkimSelector == "" || dkimKeyFile == "" {
+		return errors.New("-dkim-sign-domain, -dkim-sign-selector and -dkim-sign-key must be used together")
+	}
+	content, err := os.ReadFile(dkimKeyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM data found", dkimKeyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		dkimKey = key
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dkimKeyFile, err)
+	}
+	var ok bool
+	if dkimKey, ok = key.(*rsa.PrivateKey); !ok {
+		return fmt.Errorf("%s: not a RSA private key", dkimKeyFile)
+	}
+	return nil
+}
+
+// dkimSign returns the DKIM-Signature header (RFC 6376) of message, using
+// the rsa-sha256 algorithm and relaxed canonicalization for header and body.
+func dkimSign(message []byte, now time.Time) ([]byte, error) {
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// Sign the last occurrence of each header, as verifiers select them bottom-up.
+	var signed []string
+	var canonical bytes.Buffer
+	for _, name := range dkimHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if headerName(headers[i]) == strings.ToLower(name) {
+				canonical.WriteString(relaxedHeader(headers[i]))
+				canonical.WriteString("\r\n")
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		dkimDomain, dkimSelector, now.Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	canonical.WriteString(relaxedHeader(signature))
+
+	hashed := sha256.Sum256(canonical.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, dkimKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return nil, err
+	}
+	return []byte(signature + base64.StdEncoding.EncodeToString(sig) + "\r\n"), nil
+}
+
+// splitMessage splits a message into its unfolded header fields and its body.
+func splitMessage(message []byte) (headers []string, body []byte) {
+	for len(message) > 0 {
+		i := bytes.IndexByte(message, '\n')
+		var line []byte
+		if i == -1 {
+			line, message = message, nil
+		} else {
+			line, message = message[:i], message[i+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += "\r\n" + string(line)
+		} else {
+			headers = append(headers, string(line))
+		}
+	}
+	return headers, message
+}
+
+// headerName returns the lower cased name of a header field.
+func headerName(header string) string {
+	if i := strings.IndexByte(header, ':'); i != -1 {
+		return strings.ToLower(strings.TrimSpace(header[:i]))
+	}
+	return ""
+}
+
+// relaxedHeader canonicalizes a header field (RFC 6376 section 3.4.2).
+func relaxedHeader(header string) string {
+	i := strings.IndexByte(header, ':')
+	name := strings.ToLower(strings.TrimSpace(header[:i]))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(header[i+1:])
+	return name + ":" + compressWSP(value)
+}
+
+// relaxedBody canonicalizes a message body (RFC 6376 section 3.4.4).
+func relaxedBody(body []byte) []byte {
+	var canonical bytes.Buffer
+	var blankLines int
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blankLines++
+			continue
+		}
+		for ; blankLines > 0; blankLines-- {
+			canonical.WriteString("\r\n")
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			canonical.WriteByte(' ')
+		}
+		canonical.WriteString(compressWSP(line))
+		canonical.WriteString("\r\n")
+	}
+	return canonical.Bytes()
+}
+
+// compressWSP reduces the runs of WSP (space and tab, RFC 5234) to a single
+// space and drops them at both ends. Other white space, such as a
+// no-break space, is content.
+func compressWSP(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+}
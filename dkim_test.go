@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDKIMRelaxed checks the canonicalization example of RFC 6376 section
+// 3.4.5, and that only spaces and tabs are white space.
+func TestDKIMRelaxed(t *testing.T) {
+	headers, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	var got []string
+	for _, h := range headers {
+		got = append(got, relaxedHeader(h))
+	}
+	if strings.Join(got, "\r\n") != "a:X\r\nb:Y Z" {
+		t.Errorf("headers: got %q", got)
+	}
+	if got := string(relaxedBody(body)); got != " C\r\nD E\r\n" {
+		t.Errorf("body: got %q", got)
+	}
+
+	if got := relaxedHeader("Subject: a  b \v c"); got != "subject:a  b \v c" {
+		t.Errorf("non-WSP header spaces: got %q", got)
+	}
+	if got := string(relaxedBody([]byte("a  b \f\r\n"))); got != "a  b \f\r\n" {
+		t.Errorf("non-WSP body spaces: got %q", got)
+	}
+	if got := string(relaxedBody([]byte("\r\n\r\n"))); got != "" {
+		t.Errorf("empty body: got %q", got)
+	}
+}
+
+// TestDKIMSign verifies a signature as a verifier would, with the
+// example domain and selector of RFC 6376 appendix A.
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(domain, selector string, key *rsa.PrivateKey) {
+		dkimDomain, dkimSelector, dkimKey = domain, selector, key
+	}(dkimDomain, dkimSelector, dkimKey)
+	dkimDomain, dkimSelector, dkimKey = "example.com", "brisbane", key
+
+	message := "Received: from client1.football.example.com  [192.0.2.1]\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n\r\nWe lost the game. Are you hungry yet?\r\n\r\nJoe.\r\n"
+	header, err := dkimSign([]byte(message), time.Unix(1057982437, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := string(header)
+	if !strings.Contains(signature, "d=example.com; s=brisbane;") || !strings.Contains(signature, "h=from:to:subject:date:message-id;") {
+		t.Errorf("tags: %q", signature)
+	}
+
+	bh := regexp.MustCompile(`bh=([^;]*);`).FindStringSubmatch(signature)
+	bodyHash := sha256.Sum256([]byte("Hi.\r\n\r\nWe lost the game. Are you hungry yet?\r\n\r\nJoe.\r\n"))
+	if bh == nil || bh[1] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("body hash: got %q", bh)
+	}
+
+	i := strings.LastIndex(signature, "b=") + len("b=")
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature[i:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := "from:Joe SixPack <joe@football.example.com>\r\n" +
+		"to:Suzie Q <suzie@shopping.example.net>\r\n" +
+		"subject:Is dinner ready?\r\n" +
+		"date:Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"message-id:<20030712040037.46341.5F8J@football.example.com>\r\n" +
+		relaxedHeader(strings.TrimSuffix(signature[:i], "\r\n"))
+	hashed := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+var dnsServer string // host:port of the DNS server used instead of the system resolver.
+
+// configureDNSServer makes the DNS lookups of the policies query
+// -dns-server, port 53 by default.
+func configureDNSServer() error {
+	if dnsServer == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		dnsServer = net.JoinHostPort(dnsServer, "53")
+	}
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		return fmt.Errorf("-dns-server: %v", err)
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dnsServer)
+		},
+	}
+	rdnsResolver = resolver
+	spfResolver = resolver
+	nullMXResolver = resolver
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	dsnLog     bool // Advertise DSN and log the NOTIFY and ORCPT parameters.
+	dsnDiscard bool // Advertise DSN and ignore its parameters.
+)
+
+// dsnFields returns the ", dsn_notify: [...], dsn_orcpt: [...]" log fields
+// of the RFC 3461 RCPT parameters, one entry per recipient in the order of
+// the RCPT To list, "-" for a missing parameter. It is empty when no
+// recipient had any.
+func dsnFields(remoteAddr net.Addr) string {
+	peer, ok := remoteAddr.(*smtpd.Peer)
+	if !ok {
+		return ""
+	}
+	var found bool
+	notify := make([]string, len(peer.RcptParams))
+	orcpt := make([]string, len(peer.RcptParams))
+	for i, params := range peer.RcptParams {
+		notify[i], orcpt[i] = "-", "-"
+		for _, param := range strings.Fields(params) {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToUpper(kv[0]) {
+			case "NOTIFY":
+				notify[i], found = strings.ToUpper(kv[1]), true
+			case "ORCPT":
+				orcpt[i], found = decodeXtext(kv[1]), true
+			}
+		}
+	}
+	if !found {
+		return ""
+	}
+	return fmt.Sprintf(", dsn_notify: %v, dsn_orcpt: %v", notify, orcpt)
+}
+
+// decodeXtext decodes the "+XX" hexadecimal escapes of RFC 3461 xtext,
+// keeping invalid escapes as is.
+func decodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stringList is a repeatable flag of strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var advertise stringList // Additional EHLO keywords.
+
+// ehloLineRE matches an ehlo-line of RFC 5321 section 4.1.1.1.
+var ehloLineRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*( [\x21-\x7e]+)*$`)
+
+// checkAdvertise validates the -advertise keywords.
+func checkAdvertise() error {
+	for _, ext := range advertise {
+		if !ehloLineRE.MatchString(ext) {
+			return fmt.Errorf("-advertise %q is not a valid EHLO keyword", ext)
+		}
+	}
+	return nil
+}
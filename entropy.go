@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"math"
+)
+
+var logEntropy bool // Log the entropy of mail bodies.
+
+// byteCounts is an io.Writer counting the occurrences of each byte value.
+type byteCounts [256]int64
+
+func (c *byteCounts) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c[b]++
+	}
+	return len(p), nil
+}
+
+// entropy returns the Shannon entropy of the bytes written, in bits per byte.
+func (c *byteCounts) entropy() float64 {
+	var total int64
+	for _, n := range c {
+		total += n
+	}
+	var h float64
+	for _, n := range c {
+		if n > 0 {
+			p := float64(n) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// bodyOffset returns the offset of the body of message, after the blank
+// line ending its header. A message without header separator is all body.
+func bodyOffset(message []byte) int {
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i != -1 {
+		return i + 4
+	}
+	if i := bytes.Index(message, []byte("\n\n")); i != -1 {
+		return i + 2
+	}
+	return 0
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"smtp_receiver/smtpd"
+)
+
+var envelopeSizeLog bool // Log the envelope and body sizes of the mails.
+
+// envelopeSize estimates the bytes of the commands which carried the
+// envelope of a mail of size bytes: EHLO, MAIL FROM with its SIZE parameter
+// and one RCPT TO per recipient, CRLF included.
+func envelopeSize(remoteAddr net.Addr, from string, to []string, size int) int {
+	var helo string
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok {
+		helo = peer.HeloName
+	}
+	n := len("EHLO "+helo+"\r\n") + len("MAIL FROM:<"+from+"> SIZE="+strconv.Itoa(size)+"\r\n")
+	for _, rcpt := range to {
+		n += len("RCPT TO:<" + rcpt + ">\r\n")
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	fifoPath    string        // Named pipe receiving the mails.
+	fifoTimeout time.Duration // Maximum wait for the FIFO reader.
+	fifoLock    = make(chan struct{}, 1)
+)
+
+var errFIFOUnavailable = errors.New("451 4.3.0 Mail consumer unavailable, try again later")
+
+// checkFIFO verifies -fifo is a named pipe.
+func checkFIFO() error {
+	// The path is relative to the chroot, opened once privileges are dropped.
+	if fifoPath == "" || chrootDir != "" {
+		return nil
+	}
+	fi, err := os.Stat(fifoPath)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("-fifo %s is not a named pipe", fifoPath)
+	}
+	return nil
+}
+
+// writeFIFO writes data to -fifo, preceded by its length in decimal on its
+// own line so that the reader can split the mails. Writes are serialized
+// and must complete within -fifo-timeout, including the wait for a reader.
+func writeFIFO(data []byte) error {
+	deadline := time.Now().Add(fifoTimeout)
+	timer := time.NewTimer(fifoTimeout)
+	defer timer.Stop()
+	select {
+	case fifoLock <- struct{}{}:
+	case <-timer.C:
+		return errFIFOUnavailable
+	}
+	defer func() { <-fifoLock }()
+
+	f, err := openFIFO(fifoPath, deadline)
+	if err != nil {
+		return err
+	}
+	f.SetWriteDeadline(deadline)
+	_, err = fmt.Fprintf(f, "%d\n", len(data))
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
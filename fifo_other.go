@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd
+// +build !linux,!darwin,!dragonfly,!freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// openFIFO is only supported on some Unix systems.
+func openFIFO(path string, deadline time.Time) (*os.File, error) {
+	return nil, errors.New("-fifo is not supported on this platform")
+}
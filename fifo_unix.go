@@ -0,0 +1,27 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// openFIFO opens the named pipe path for writing, waiting until deadline
+// for a reader. Opening in non-blocking mode fails with ENXIO without
+// reader, and gives a file whose writes honor deadlines.
+func openFIFO(path string, deadline time.Time) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if !errors.Is(err, syscall.ENXIO) {
+			return f, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errFIFOUnavailable
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
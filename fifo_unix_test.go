@@ -0,0 +1,77 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFIFO(t *testing.T) {
+	defer func(path string, timeout time.Duration) { fifoPath, fifoTimeout = path, timeout }(fifoPath, fifoTimeout)
+	dir := t.TempDir()
+	fifoPath, fifoTimeout = filepath.Join(dir, "mails"), 2*time.Second
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
+		t.Skip(err)
+	}
+	if err := checkFIFO(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without reader the mail is refused once -fifo-timeout expires.
+	fifoTimeout = 200 * time.Millisecond
+	if err := writeFIFO([]byte("lost\r\n")); err != errFIFOUnavailable {
+		t.Fatalf("without reader: %v, want %v", err, errFIFOUnavailable)
+	}
+
+	// Opened read-write, the reader does not see the end of file when a
+	// writer closes, and drains the mails of successive writers.
+	fifoTimeout = 2 * time.Second
+	r, err := os.OpenFile(fifoPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	mails := []string{"Subject: first\r\n\r\nOne.\r\n", "Subject: second\r\n\r\nTwo\nlines.\r\n"}
+	drained := make(chan []string)
+	go func() {
+		br := bufio.NewReader(r)
+		var got []string
+		for range mails {
+			line, err := br.ReadString('\n')
+			n, _ := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+			if err != nil || n == 0 {
+				break
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(br, data); err != nil {
+				break
+			}
+			got = append(got, string(data))
+		}
+		drained <- got
+	}()
+	for _, mail := range mails {
+		if err := writeFIFO([]byte(mail)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := <-drained
+	if strings.Join(got, "|") != strings.Join(mails, "|") {
+		t.Errorf("drained %q, want %q", got, mails)
+	}
+
+	fifoPath = filepath.Join(dir, "regular")
+	os.WriteFile(fifoPath, nil, 0600)
+	if err := checkFIFO(); err == nil {
+		t.Error("checkFIFO accepted a regular file")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	"smtp_receiver/smtpd"
+)
+
+// regexpList is a repeatable flag of regular expressions.
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	if l == nil {
+		return ""
+	}
+	var patterns []string
+	for _, re := range *l {
+		patterns = append(patterns, re.String())
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (l *regexpList) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+var (
+	rejectBody      regexpList // Patterns rejecting the message body.
+	rejectBodyCode  int        // SMTP code used to reject the message body.
+	rejectBodyLimit int        // Maximum number of body bytes scanned.
+	maxReceived     int        // Maximum number of Received headers.
+)
+
+// checkHops rejects data carrying -max-received-headers Received headers or
+// more, the usual sign of a mail loop. The header added by smtpd is not
+// counted.
+func checkHops(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	if maxReceived <= 0 {
+		return nil
+	}
+	header := data[payloadStart(data):]
+	if end := bytes.Index(header, []byte("\r\n\r\n")); end != -1 {
+		header = header[:end+2]
+	}
+	header = bytes.ToLower(header)
+	hops := bytes.Count(header, []byte("\nreceived:"))
+	if bytes.HasPrefix(header, []byte("received:")) {
+		hops++
+	}
+	if hops >= maxReceived {
+		logRejection(remoteAddr, from, to, "loop", fmt.Sprintf("mail loop detected, %d Received headers", hops))
+		return errors.New("554 5.4.6 Too many hops, mail loop detected")
+	}
+	return nil
+}
+
+// checkBody rejects data whose body matches one of the -reject-body patterns.
+func checkBody(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	if len(rejectBody) == 0 {
+		return nil
+	}
+	body := data[payloadStart(data):]
+	if rejectBodyLimit > 0 && len(body) > rejectBodyLimit {
+		body = body[:rejectBodyLimit]
+	}
+	for _, re := range rejectBody {
+		if re.Match(body) {
+			logRejection(remoteAddr, from, to, "body", fmt.Sprintf("body matches %q", re))
+			return fmt.Errorf("%d %d.7.1 Message content rejected", rejectBodyCode, rejectBodyCode/100)
+		}
+	}
+	return nil
+}
+
+// logRejection logs why a mail was refused, and counts it in the StatsD
+// rejections.<kind> metric.
+func logRejection(remoteAddr net.Addr, from string, to []string, kind, reason string) {
+	statsd.count("rejections."+kind, 1)
+	if !logQuiet || smtpd.Debug {
+		log.Printf(logFormatHead+"%s, rejected: %s, code: %s", remoteAddr, from, to, sessionField(remoteAddr), reason, kind)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckHops(t *testing.T) {
+	defer func(max int) { maxReceived = max }(maxReceived)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	maxReceived = 3
+
+	// mail returns a mail with our Received header, then the client headers,
+	// a Received line in its body not being a header.
+	mail := func(headers ...string) []byte {
+		return []byte("Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <user@example.com>\r\n" +
+			strings.Join(headers, "\r\n") + "\r\nX-Received: by relay.example.org\r\nSubject: loop\r\n\r\nReceived: in the body\r\n")
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	tests := []struct {
+		name    string
+		data    []byte
+		refused bool
+	}{
+		{"no hop", mail("From: sender@example.org"), false},
+		{"limit-1 hops", mail("Received: by a", "Received: by b"), false},
+		{"limit hops", mail("Received: by a", "Received: by b", "Received: by c"), true},
+		{"limit hops lower case", mail("received: by a", "RECEIVED: by b", "Received: by c"), true},
+		{"limit+1 hops folded", mail("Received: from a\r\n\tby a", "received: by b", "Received: by c", "Received: by d"), true},
+		{"limit-1 hops with X-Received", mail("Received: by a", "X-Received: by b", "received: by c"), false},
+	}
+	for _, tt := range tests {
+		err := checkHops(addr, "sender@example.org", []string{"user@example.com"}, tt.data)
+		if tt.refused && (err == nil || !strings.HasPrefix(err.Error(), "554 5.4.6 ")) {
+			t.Errorf("%s: %v, want 554 5.4.6", tt.name, err)
+		} else if !tt.refused && err != nil {
+			t.Errorf("%s: %v, want accepted", tt.name, err)
+		}
+	}
+
+	maxReceived = 0
+	if err := checkHops(addr, "sender@example.org", nil, tests[3].data); err != nil {
+		t.Errorf("-max-received-headers 0: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	flowThreshold int           // Disk utilization percentage delaying replies, 0 disables.
+	flowDelay     time.Duration // Delay of the replies to DATA while the disk is busy.
+	flowPoll      time.Duration // Interval between disk utilization measures.
+
+	diskBusy        int32 // atomic, 1 while the disk utilization is above flowThreshold
+	diskUtilization int64 // atomic, last measured utilization in percent
+)
+
+// startFlowControl measures the utilization of the disk holding -fileformat
+// every -flow-control-poll. Platforms without disk statistics are ignored.
+func startFlowControl() {
+	if flowThreshold == 0 || fileFormat == "" {
+		return
+	}
+	dir := fileFormat
+	if i := strings.Index(dir, "%"); i != -1 {
+		dir = dir[:i]
+	}
+	dir = filepath.Dir(dir + "x")
+	if chrootDir != "" {
+		dir = filepath.Join(chrootDir, dir)
+	}
+	// The directory may not be created yet.
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	ioTicks, err := newIOTicker(dir)
+	if err != nil {
+		log.Printf("WARNING: -flow-control-disk-threshold disabled: %v", err)
+		return
+	}
+	if ioTicks == nil {
+		return
+	}
+	go func() {
+		last, lastErr := ioTicks()
+		lastTime := time.Now()
+		for range time.Tick(flowPoll) {
+			ticks, err := ioTicks()
+			now := time.Now()
+			if err != nil || lastErr != nil {
+				if err != nil {
+					log.Printf("WARNING: disk utilization unavailable: %v", err)
+				}
+				last, lastErr, lastTime = ticks, err, now
+				continue
+			}
+			// io_ticks counts the milliseconds the device was busy. A sample
+			// without elapsed time, e.g. after a clock step, is skipped.
+			elapsed := now.Sub(lastTime).Milliseconds()
+			if elapsed <= 0 {
+				last, lastTime = ticks, now
+				continue
+			}
+			util := int64(ticks-last) * 100 / elapsed
+			atomic.StoreInt64(&diskUtilization, util)
+			busy := int32(0)
+			if util > int64(flowThreshold) {
+				busy = 1
+			}
+			atomic.StoreInt32(&diskBusy, busy)
+			last, lastTime = ticks, now
+		}
+	}()
+}
+
+// flowControlWait delays the reply to DATA while the disk is busy, to slow
+// clients down.
+func flowControlWait(remoteAddr net.Addr, from string, to []string) {
+	if atomic.LoadInt32(&diskBusy) == 0 {
+		return
+	}
+	if smtpd.Debug {
+		log.Printf(logFormatHead+", flow control: disk utilization %d%%, reply delayed by %v",
+			remoteAddr, from, to, atomic.LoadInt64(&diskUtilization), flowDelay)
+	}
+	time.Sleep(flowDelay)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// newIOTicker returns a function reading the io_ticks counter, the
+// milliseconds spent doing I/O, of the block device holding dir.
+func newIOTicker(dir string) (func() (uint64, error), error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return nil, err
+	}
+	dev := uint64(st.Dev)
+	major := strconv.FormatUint((dev>>8)&0xfff|(dev>>32)&^0xfff, 10)
+	minor := strconv.FormatUint(dev&0xff|(dev>>12)&^0xff, 10)
+	// Kept open, /proc is out of reach after -chroot.
+	stats, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	ticks := func() (uint64, error) {
+		content, err := io.ReadAll(io.NewSectionReader(stats, 0, 1<<20))
+		if err != nil {
+			return 0, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 12 && fields[0] == major && fields[1] == minor {
+				return strconv.ParseUint(fields[12], 10, 64)
+			}
+		}
+		return 0, fmt.Errorf("device %s:%s of %s not found in /proc/diskstats", major, minor, dir)
+	}
+	if _, err := ticks(); err != nil {
+		stats.Close()
+		return nil, err
+	}
+	return ticks, nil
+}
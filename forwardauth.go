@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	forwardAuthHost    string        // Upstream SMTP server checking credentials.
+	forwardAuthPort    int           // Port of forwardAuthHost.
+	forwardAuthTLS     bool          // Require STARTTLS to forwardAuthHost.
+	forwardAuthTimeout time.Duration // Time given to an upstream check.
+
+	// Idle upstream connections. A connection is only reused after a failed
+	// AUTH, as a successful one cannot be followed by another (RFC 4954).
+	forwardAuthPool = make(chan *upstreamConn, 4)
+)
+
+// upstreamConn is a connection to -forward-auth-host.
+type upstreamConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// authForward checks credentials with AUTH PLAIN on -forward-auth-host.
+func authForward(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	// AUTH PLAIN is sent by hand as smtp.Client.Auth quits on failures.
+	initial := append(append([]byte{0}, username...), 0)
+	initial = append(initial, password...)
+	command := "AUTH PLAIN " + base64.StdEncoding.EncodeToString(initial)
+	for attempt := 0; ; attempt++ {
+		c, pooled, err := forwardAuthConn()
+		if err != nil {
+			log.Printf("WARNING: remote: %v, -forward-auth-host: %v", remoteAddr, err)
+			return false, errAuthUnavailable
+		}
+		var code int
+		var id uint
+		if id, err = c.Text.Cmd("%s", command); err == nil {
+			c.Text.StartResponse(id)
+			code, _, err = c.Text.ReadResponse(0)
+			c.Text.EndResponse(id)
+		}
+		switch {
+		case code == 235:
+			c.Quit()
+			return true, nil
+		case code == 535:
+			if !logQuiet || smtpd.Debug {
+				log.Printf("remote: %v, AUTH %s refused by -forward-auth-host", remoteAddr, mechanism)
+			}
+			select {
+			case forwardAuthPool <- c:
+			default:
+				c.Quit()
+			}
+			return false, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("unexpected reply %d to AUTH", code)
+		}
+		c.Close()
+		// Pooled connections may have been closed by the upstream meanwhile.
+		if pooled && attempt == 0 {
+			continue
+		}
+		log.Printf("WARNING: remote: %v, -forward-auth-host: %v", remoteAddr, err)
+		return false, errAuthUnavailable
+	}
+}
+
+// forwardAuthConn returns an idle upstream connection, or a new one, with
+// -forward-auth-timeout to complete the check.
+func forwardAuthConn() (c *upstreamConn, pooled bool, err error) {
+	select {
+	case c = <-forwardAuthPool:
+		c.conn.SetDeadline(time.Now().Add(forwardAuthTimeout))
+		return c, true, nil
+	default:
+	}
+	addr := net.JoinHostPort(forwardAuthHost, strconv.Itoa(forwardAuthPort))
+	conn, err := net.DialTimeout("tcp", addr, forwardAuthTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	conn.SetDeadline(time.Now().Add(forwardAuthTimeout))
+	c = &upstreamConn{conn: conn}
+	if c.Client, err = smtp.NewClient(conn, forwardAuthHost); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if err = c.Hello(srv.Hostname); err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: forwardAuthHost})
+	} else if forwardAuthTLS {
+		err = errors.New("STARTTLS not offered")
+	}
+	if err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	return c, false, nil
+}
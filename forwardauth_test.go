@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// serveSMTP serves server on a loopback port.
+func serveSMTP(t *testing.T, server *smtpd.Server) *countingListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: ln}
+	go server.Serve(l)
+	t.Cleanup(func() { ln.Close() })
+	return l
+}
+
+// authPlain returns the AUTH PLAIN command of the credentials.
+func authPlain(username, password string) string {
+	return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+username+"\x00"+password))
+}
+
+func TestForwardAuth(t *testing.T) {
+	defer func(host string, port int, tls bool, timeout time.Duration, pool chan *upstreamConn, hostname string) {
+		forwardAuthHost, forwardAuthPort, forwardAuthTLS, forwardAuthTimeout, forwardAuthPool = host, port, tls, timeout, pool
+		srv.Hostname = hostname
+	}(forwardAuthHost, forwardAuthPort, forwardAuthTLS, forwardAuthTimeout, forwardAuthPool, srv.Hostname)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := serveSMTP(t, &smtpd.Server{Hostname: "upstream.example.com",
+		AuthMechs: map[string]bool{"PLAIN": true},
+		AuthHandler: func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+			return string(username) == "alice" && string(password) == "s3cret", nil
+		},
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error { return nil }})
+	forwardAuthHost, forwardAuthPort = "127.0.0.1", upstream.Addr().(*net.TCPAddr).Port
+	forwardAuthTLS, forwardAuthTimeout = false, 5*time.Second
+	forwardAuthPool = make(chan *upstreamConn, 4)
+	srv.Hostname = "mx.example.com"
+
+	delivered := make(chan string, 1)
+	front := serveSMTP(t, &smtpd.Server{Hostname: "mx.example.com",
+		AuthMechs:    map[string]bool{"PLAIN": true},
+		AuthRequired: true,
+		AuthHandler:  authForward,
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			delivered <- from
+			return nil
+		}})
+
+	c, err := textproto.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.ReadResponse(220)
+	c.PrintfLine("EHLO client.example.org")
+	c.ReadResponse(250)
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{
+		{"MAIL FROM:<alice@example.com>", 530},
+		{authPlain("alice", "wrong"), 535},
+		{authPlain("mallory", "s3cret"), 535},
+		{authPlain("alice", "s3cret"), 235},
+		{"MAIL FROM:<alice@example.com>", 250},
+		{"RCPT TO:<bob@example.org>", 250},
+		{"DATA", 354},
+		{"Subject: test\r\n\r\nHello.\r\n.", 250},
+	} {
+		c.PrintfLine("%s", step.cmd)
+		if _, msg, err := c.ReadResponse(step.code); err != nil {
+			t.Fatalf("%s: %s: %v", step.cmd, msg, err)
+		}
+	}
+	if from := <-delivered; from != "alice@example.com" {
+		t.Errorf("delivered from %q", from)
+	}
+	// The connection kept after the refusals is used for the success.
+	if n := atomic.LoadInt32(&upstream.accepted); n != 1 {
+		t.Errorf("%d upstream connections, want 1", n)
+	}
+
+	// An unreachable upstream is a temporary failure.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	forwardAuthPort = ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	c2, err := textproto.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.ReadResponse(220)
+	c2.PrintfLine("EHLO client.example.org")
+	c2.ReadResponse(250)
+	c2.PrintfLine("%s", authPlain("alice", "s3cret"))
+	if _, msg, err := c2.ReadResponse(454); err != nil {
+		t.Errorf("AUTH with the upstream down: %s: %v", msg, err)
+	}
+}
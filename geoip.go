@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"smtp_receiver/smtpd"
+)
+
+// geoCacheSize bounds the number of IPs whose location is kept.
+const geoCacheSize = 10000
+
+var (
+	geoIPPaths stringList // MaxMind DB files giving the country and ASN of clients.
+	geoIPDBs   []*mmdb
+
+	geoMu    sync.Mutex
+	geoCache = make(map[string]geoInfo)
+)
+
+// geoInfo is the location of an IP, empty fields being unknown.
+type geoInfo struct {
+	country string // ISO 3166-1 country code
+	asn     string // autonomous system number
+}
+
+// loadGeoIP opens the -geoip-db files. Unreadable files are ignored with a
+// warning, so that a missing database does not stop the server.
+func loadGeoIP() {
+	for _, path := range geoIPPaths {
+		db, err := openMMDB(path)
+		if err != nil {
+			log.Printf("WARNING: -geoip-db ignored: %v", err)
+			continue
+		}
+		geoIPDBs = append(geoIPDBs, db)
+	}
+}
+
+// geoLookup returns the country and ASN of ip, merged from the -geoip-db
+// files in their order: the country of a GeoIP2 Country or City database
+// and the ASN of a GeoLite2 ASN one.
+func geoLookup(ip net.IP) geoInfo {
+	if len(geoIPDBs) == 0 || ip == nil {
+		return geoInfo{}
+	}
+	key := ip.String()
+	geoMu.Lock()
+	info, ok := geoCache[key]
+	geoMu.Unlock()
+	if ok {
+		return info
+	}
+	for _, db := range geoIPDBs {
+		value, err := db.lookup(ip)
+		if err != nil {
+			if smtpd.Debug {
+				log.Printf("WARNING: GeoIP lookup of %s: %v", key, err)
+			}
+			continue
+		}
+		fields, _ := value.(map[string]interface{})
+		if info.country == "" {
+			info.country = countryCode(fields)
+		}
+		if n, ok := fields["autonomous_system_number"].(uint64); ok && info.asn == "" {
+			info.asn = strconv.FormatUint(n, 10)
+		}
+	}
+	geoMu.Lock()
+	if len(geoCache) >= geoCacheSize {
+		geoCache = make(map[string]geoInfo)
+	}
+	geoCache[key] = info
+	geoMu.Unlock()
+	return info
+}
+
+// countryCode returns the ISO code of the country, or else of the
+// registered country, of a GeoIP2 record.
+func countryCode(fields map[string]interface{}) string {
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// geoFields returns the ", country: <code>, asn: <number>" log fields of
+// the client, "-" when unknown. It is empty without -geoip-db.
+func geoFields(remoteAddr net.Addr) string {
+	if len(geoIPDBs) == 0 {
+		return ""
+	}
+	info := geoLookup(remoteIP(remoteAddr))
+	if info.country == "" {
+		info.country = "-"
+	}
+	if info.asn == "" {
+		info.asn = "-"
+	}
+	return fmt.Sprintf(", country: %s, asn: %s", info.country, info.asn)
+}
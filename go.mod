@@ -1,7 +1,5 @@
 module smtp_receiver
 
-go 1.14
+go 1.18
 
 retract v0.0.0-0
-
-require github.com/mhale/smtpd v0.8.0
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+var requiredHeaders string // Comma separated headers a mail must have.
+
+// addressHeaders are the headers whose value must be a valid address list
+// when required.
+var addressHeaders = map[string]bool{
+	"From":     true,
+	"Sender":   true,
+	"To":       true,
+	"Cc":       true,
+	"Reply-To": true,
+}
+
+// checkHeaders refuses mails missing one of -require-headers, or whose
+// required address header does not parse.
+func checkHeaders(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	if requiredHeaders == "" {
+		return nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data[payloadStart(data):]))
+	if err != nil {
+		logRejection(remoteAddr, from, to, "headers", "unreadable header block: "+err.Error())
+		return errors.New("550 5.6.0 Message rejected: malformed header block")
+	}
+	for _, name := range strings.Split(requiredHeaders, ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		value := msg.Header.Get(name)
+		if strings.TrimSpace(value) == "" {
+			logRejection(remoteAddr, from, to, "headers", "missing "+name+" header")
+			return fmt.Errorf("550 5.6.0 Message rejected: %s header required", name)
+		}
+		if addressHeaders[name] {
+			if _, err := msg.Header.AddressList(name); err != nil {
+				logRejection(remoteAddr, from, to, "headers", fmt.Sprintf("malformed %s header %q: %v", name, value, err))
+				return fmt.Errorf("550 5.6.0 Message rejected: malformed %s header", name)
+			}
+		}
+	}
+	return nil
+}
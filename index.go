@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	indexPath    string   // Append-only binary index of the stored mails.
+	indexMaxSize byteSize // Size above which the index is rotated to indexPath.1.
+	lookupHash   string   // Hexadecimal hash prefix searched by the -lookup mode.
+)
+
+// mailIndex appends one record per stored mail to the -index file. A record
+// is its big-endian uint32 length followed by the 32 bytes hash, the int64
+// reception time in unix nanoseconds, then the sender, the count of
+// recipients, each recipient and the path, strings being prefixed by their
+// uint16 length.
+type mailIndex struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var msgIndex mailIndex
+
+// indexRecord is an entry of the index.
+type indexRecord struct {
+	Hash []byte
+	TS   time.Time
+	From string
+	To   []string
+	Path string
+}
+
+// marshal encodes rec, length prefix included.
+func (rec *indexRecord) marshal() []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 4))
+	var hash [32]byte
+	copy(hash[:], rec.Hash)
+	b.Write(hash[:])
+	binary.Write(&b, binary.BigEndian, rec.TS.UnixNano())
+	writeString := func(s string) {
+		if len(s) > 0xffff {
+			s = s[:0xffff]
+		}
+		binary.Write(&b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	writeString(rec.From)
+	binary.Write(&b, binary.BigEndian, uint16(len(rec.To)))
+	for _, rcpt := range rec.To {
+		writeString(rcpt)
+	}
+	writeString(rec.Path)
+	data := b.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
+
+// unmarshalIndexRecord decodes a record, without its length prefix.
+func unmarshalIndexRecord(data []byte) (*indexRecord, error) {
+	errTruncated := errors.New("truncated index record")
+	if len(data) < 32+8 {
+		return nil, errTruncated
+	}
+	rec := &indexRecord{Hash: data[:32], TS: time.Unix(0, int64(binary.BigEndian.Uint64(data[32:40])))}
+	data = data[40:]
+	readUint16 := func() (int, bool) {
+		if len(data) < 2 {
+			return 0, false
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		return n, true
+	}
+	readString := func() (string, bool) {
+		n, ok := readUint16()
+		if !ok || len(data) < n {
+			return "", false
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s, true
+	}
+	var ok bool
+	if rec.From, ok = readString(); !ok {
+		return nil, errTruncated
+	}
+	count, ok := readUint16()
+	if !ok {
+		return nil, errTruncated
+	}
+	for i := 0; i < count; i++ {
+		rcpt, ok := readString()
+		if !ok {
+			return nil, errTruncated
+		}
+		rec.To = append(rec.To, rcpt)
+	}
+	if rec.Path, ok = readString(); !ok {
+		return nil, errTruncated
+	}
+	return rec, nil
+}
+
+// append writes rec to the index, rotating it first when the record would
+// take it above -index-max-size.
+func (idx *mailIndex) append(rec *indexRecord) error {
+	data := rec.marshal()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.file != nil && indexMaxSize > 0 && idx.size+int64(len(data)) > int64(indexMaxSize) {
+		idx.file.Close()
+		idx.file = nil
+		if err := os.Rename(indexPath, indexPath+".1"); err != nil {
+			return err
+		}
+	}
+	if idx.file == nil {
+		f, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		idx.file, idx.size = f, info.Size()
+	}
+	// A single write keeps records whole for concurrent readers.
+	n, err := idx.file.Write(data)
+	idx.size += int64(n)
+	return err
+}
+
+// close closes the index file.
+func (idx *mailIndex) close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.file == nil {
+		return nil
+	}
+	err := idx.file.Close()
+	idx.file = nil
+	return err
+}
+
+// lookup prints to w the records of the rotated and current index whose
+// hash starts with the hexadecimal prefix, like git short hashes. An
+// ambiguous prefix lists all its matches.
+func lookup(w io.Writer, prefix string) (matches int, err error) {
+	prefix = strings.ToLower(prefix)
+	if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil || prefix == "" {
+		return 0, fmt.Errorf("-lookup %q is not a hexadecimal hash prefix", prefix)
+	}
+	for _, path := range []string{indexPath + ".1", indexPath} {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return matches, err
+		}
+		err = scanIndex(f, func(rec *indexRecord) {
+			hash := hex.EncodeToString(rec.Hash)
+			if strings.HasPrefix(hash, prefix) {
+				matches++
+				fmt.Fprintf(w, "%s %s <%s> <%s> %s\n", hash, rec.TS.Format(time.RFC3339Nano),
+					rec.From, strings.Join(rec.To, ">,<"), rec.Path)
+			}
+		})
+		f.Close()
+		if err != nil {
+			return matches, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return matches, nil
+}
+
+// scanIndex calls fn for each record of r. A record still being written
+// ends the scan silently.
+func scanIndex(r io.Reader, fn func(*indexRecord)) error {
+	br := bufio.NewReader(r)
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(br, length[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(br, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rec, err := unmarshalIndexRecord(data)
+		if err != nil {
+			return err
+		}
+		fn(rec)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listener wraps the server listener to prepare accepted connections
+// before smtpd takes over.
+type listener struct {
+	net.Listener
+	once     sync.Once
+	accepted chan accepted // Connections whose PROXY header was read, with -trusted-proxies
+	done     chan struct{} // Closed when the listener fails
+}
+
+// accepted is a connection, or the error, of the underlying listener.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// Accept waits for the next connection and applies the connection settings.
+// The client address of -trusted-proxies connections is read from their
+// PROXY header. Connections from -deny-ips, from IPs banned by
+// -smtp-auto-ban or above -maxconn-per-ip are refused without reaching smtpd.
+// The location of the others is looked up in the -geoip-db files.
+func (l *listener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for {
+		if conn, err = l.next(); err != nil {
+			return conn, err
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if len(denyNets) > 0 && denyNets.contains(ip) {
+			go holdDenied(conn)
+			continue
+		}
+		if autoBan && autoBans.banned(ip.String(), time.Now()) {
+			go refuseBanned(conn)
+			continue
+		}
+		if maxConnPerIP > 0 {
+			if !acquireConn(ip) {
+				go refuseConn(conn)
+				continue
+			}
+			conn = &limitedConn{Conn: conn, ip: ip.String()}
+		}
+		if len(geoIPDBs) > 0 {
+			geoLookup(ip)
+		}
+		break
+	}
+
+	if tcp, ok := unwrapConn(conn).(*net.TCPConn); ok {
+		if socketReadBuffer > 0 {
+			if err := tcp.SetReadBuffer(socketReadBuffer); err != nil {
+				log.Printf("WARNING: unable to set read buffer: %v", err)
+			}
+		}
+		if socketWriteBuffer > 0 {
+			if err := tcp.SetWriteBuffer(socketWriteBuffer); err != nil {
+				log.Printf("WARNING: unable to set write buffer: %v", err)
+			}
+		}
+	}
+
+	var id string // Names the files of the connection, and its smtpd session
+	if protocolLogDir != "" || recordDir != "" || rawConnDir != "" {
+		id = connectionID()
+		if protocolLogDir != "" {
+			if conn, err = newProtocolLogConn(conn, id); err != nil {
+				log.Printf("WARNING: unable to create protocol log: %v", err)
+			}
+		}
+		if recordDir != "" {
+			conn = newRecorderConn(conn, id)
+		}
+		if rawConnDir != "" {
+			conn = newRawConn(conn, id)
+		}
+	}
+
+	if replyDelays != nil {
+		conn = newSlowConn(conn)
+	}
+
+	if dataProgress > 0 {
+		conn = newProgressConn(conn)
+	}
+
+	if bannerDelayMax > 0 {
+		conn = &delayedConn{Conn: conn}
+	}
+
+	if len(tarpitNets) > 0 && tarpitNets.contains(remoteIP(conn.RemoteAddr())) {
+		log.Printf("remote: %v, tarpitted", conn.RemoteAddr())
+		conn = &tarpitConn{Conn: conn}
+	}
+	if id != "" {
+		conn = &identifiedConn{Conn: conn, id: id}
+	}
+	return conn, nil
+}
+
+// identifiedConn gives smtpd the identifier of the files of a connection,
+// so that Peer.ID matches their names.
+type identifiedConn struct {
+	net.Conn
+	id string
+}
+
+func (c *identifiedConn) SessionID() string {
+	return c.id
+}
+
+// next returns the next connection of the underlying listener. With
+// -trusted-proxies, the PROXY header of trusted proxies is read by a
+// goroutine per connection, so that a slow proxy does not hold the others.
+func (l *listener) next() (net.Conn, error) {
+	if len(trustedProxies) == 0 {
+		return l.Listener.Accept()
+	}
+	l.once.Do(func() {
+		l.accepted = make(chan accepted)
+		l.done = make(chan struct{})
+		go l.acceptProxies()
+	})
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// acceptProxies accepts the connections of -trusted-proxies listeners,
+// handing them to Accept once their PROXY header is read.
+func (l *listener) acceptProxies() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.hand(accepted{err: err})
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		if !trustedProxies.contains(remoteIP(conn.RemoteAddr())) {
+			l.hand(accepted{conn: untrustedProxy(conn)})
+			continue
+		}
+		go func() {
+			proxied, err := acceptProxy(conn)
+			if err != nil {
+				log.Printf("WARNING: remote: %v, connection from trusted proxy closed: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			l.hand(accepted{conn: proxied})
+		}()
+	}
+}
+
+// hand passes a to Accept, closing its connection if the listener failed.
+func (l *listener) hand(a accepted) {
+	select {
+	case l.accepted <- a:
+	case <-l.done:
+		if a.conn != nil {
+			a.conn.Close()
+		}
+	}
+}
+
+// refusalTimeout bounds the TLS handshake and the write of the reply to a
+// refused connection.
+const refusalTimeout = 10 * time.Second
+
+// refusalConn returns the connection to write the reply of a refused
+// client to: with -tlsonly, the server side of a TLS connection over conn,
+// as the client expects nothing before the handshake.
+func refusalConn(conn net.Conn) net.Conn {
+	if srv.TLSConfig == nil || !srv.TLSListener {
+		return conn
+	}
+	conn.SetDeadline(time.Now().Add(refusalTimeout))
+	return tls.Server(conn, srv.TLSConfig)
+}
+
+// unwrapConn returns the connection accepted from the network under conn.
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*limitedConn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(*proxyConn); ok {
+		conn = c.Conn
+	}
+	return conn
+}
+
+var connectionSeq uint64 // atomic counter of identified connections
+
+// connectionID returns a unique identifier for a new connection, usable
+// as a file name.
+func connectionID() string {
+	return fmt.Sprintf("%s-%06d", time.Now().Format("20060102-150405"), atomic.AddUint64(&connectionSeq, 1))
+}
+
+// checkConnBuffer validates a connection buffer size, 0 keeps the bufio
+// default.
+func checkConnBuffer(name string, size int) error {
+	if size != 0 && (size < 4<<10 || size > 16<<20) {
+		return fmt.Errorf("-%s must be between 4096 and %d", name, 16<<20)
+	}
+	return nil
+}
+
+// checkSocketBuffer validates a socket buffer size, 0 keeps the OS default.
+func checkSocketBuffer(name string, size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < 4<<10 || size > 4<<20 || size&(size-1) != 0 {
+		return fmt.Errorf("-%s must be a power of two between 4096 and %d", name, 4<<20)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	logFile       string // File receiving a copy of the log.
+	logFileFormat string // Format of logFile lines, text or json.
+	logSyslog     bool   // Send a copy of the log to the -syslog-addr daemon.
+	logTag        string // Tag of the instance in log lines.
+)
+
+// logSinks writes each log entry to all its sinks. The log package calls
+// Write once per entry under its own lock, so sinks need no locking.
+// Unlike io.MultiWriter, a failing sink does not stop the others.
+type logSinks []func(time.Time, string) error
+
+func (l logSinks) Write(p []byte) (int, error) {
+	now := time.Now()
+	entry := strings.TrimSuffix(string(p), "\n")
+	for _, sink := range l {
+		if err := sink(now, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: log sink: %v\n", err)
+		}
+	}
+	return len(p), nil
+}
+
+// textSink writes entries prefixed by their date, as the default logger,
+// and by -logtag.
+func textSink(w io.Writer) func(time.Time, string) error {
+	return func(t time.Time, entry string) error {
+		_, err := fmt.Fprintf(w, "%s %s\n", t.Format("2006/01/02 15:04:05"), taggedEntry(entry))
+		return err
+	}
+}
+
+// taggedEntry prepends -logtag to a log entry.
+func taggedEntry(entry string) string {
+	if logTag == "" {
+		return entry
+	}
+	return "[" + logTag + "] " + entry
+}
+
+// jsonSink writes entries as JSON objects, one per line.
+func jsonSink(w io.Writer) func(time.Time, string) error {
+	return func(t time.Time, entry string) error {
+		line, err := json.Marshal(struct {
+			TS  time.Time `json:"ts"`
+			Tag string    `json:"tag,omitempty"`
+			Msg string    `json:"msg"`
+		}{t, logTag, entry})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}
+}
+
+// configureLogSinks copies the log to -log-file and to syslog with
+// -log-syslog, in addition to the standard error, and tags it with -logtag.
+func configureLogSinks() error {
+	if logFile == "" && !logSyslog && logTag == "" {
+		return nil
+	}
+	sinks := logSinks{textSink(os.Stderr)}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		switch logFileFormat {
+		case "text":
+			sinks = append(sinks, textSink(f))
+		case "json":
+			sinks = append(sinks, jsonSink(f))
+		default:
+			return fmt.Errorf("unknown -log-file-format %q, expected text or json", logFileFormat)
+		}
+	}
+	if logSyslog {
+		if syslogger == nil {
+			return errors.New("-log-syslog needs -syslog-addr")
+		}
+		sinks = append(sinks, func(_ time.Time, entry string) error {
+			return syslogger.logLine(taggedEntry(entry))
+		})
+	}
+	log.SetFlags(0)
+	log.SetOutput(sinks)
+	return nil
+}
@@ -3,20 +3,27 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/mhale/smtpd"
+	"smtp_receiver/smtpd"
 )
 
 var (
@@ -26,39 +33,269 @@ var (
 
 	certfile, keyfile string
 
+	runUser, runGroup, chrootDir string // Privileges to drop to after binding.
+
+	disabledCommands string // Comma separated SMTP verbs to refuse.
+
 	dataEnd    string // dataEnd log marker
 	logQuiet   bool   // no log will be displayed
 	logFull    bool   // Dump full data to log
 	fileFormat string // File path to save mail data.
+	dateFormat string // Layout used for %s instead of unix timestamp.
+	localTime  bool   // Format dates in local time instead of UTC.
+	logTLS     bool   // Log the negotiated cipher suite and SNI.
+
+	envelopeHeaders bool // Add Envelope-From and Envelope-To headers to saved data.
+
+	now = time.Now // Clock dating the received mails, replaced by the tests.
+
+	logLatency  bool          // Log the processing time of each mail.
+	latencyWarn time.Duration // Processing time above which a warning is logged.
+
+	archiveDir string       // Directory of the daily JSONL archives.
+	archive    jsonlArchive // Daily JSONL archive of all mails.
+
+	syslogNetwork, syslogAddr string
+	syslogger                 *syslogWriter
+
+	showRate bool   // Display receiving throughput on stderr.
+	pidFile  string // Path where to write the process PID.
+
+	verifyBackend bool // Check storages are usable at startup.
+
+	socketReadBuffer, socketWriteBuffer int // TCP buffer sizes, 0 is the OS default.
+
+	ipv4Only, ipv6Only bool
+	listenNetwork      = "tcp"
+
+	receivedMessages, receivedBytes int64 // atomic counters of processed mails
 )
 
 func main() {
 	var hostname, _ = os.Hostname()
 	// Main parameter
 	flag.StringVar(&srv.Addr, "listen", ":8025", "Address to bind to.")
+	flag.BoolVar(&ipv4Only, "ipv4-only", false, "Only listen on IPv4, even on a dual-stack host.")
+	flag.BoolVar(&ipv6Only, "ipv6-only", false, "Only listen on IPv6, even on a dual-stack host.")
 	flag.StringVar(&srv.Appname, "appname", "smtpd", "Name of the service.")
 	flag.StringVar(&srv.Hostname, "servername", hostname, "hostname for the service to use.")
 	flag.DurationVar(&srv.Timeout, "timeout", 5*time.Minute, "Maximum wait time for all network operation")
+	flag.DurationVar(&srv.CmdTimeout, "command-timeout", 0, "Maximum idle time waiting for a command. (0 means -timeout)")
+	flag.IntVar(&srv.MaxLineLength, "max-command-length", 2000, "Maximum length of a command line, CRLF excluded, longer lines get a 500 and the connection is closed. (0 means no limit)")
+	flag.DurationVar(&srv.RcptPhaseTimeout, "rcpt-phase-timeout", 0, "Maximum time between the first RCPT of a transaction and DATA, the connection is then closed with a 421. (0 means no limit)")
+	flag.DurationVar(&srv.FirstCmdTimeout, "timeout-first-cmd", 0, "Maximum time waiting for the first command after the greeting, the connection is then closed with a 421. (0 means -command-timeout)")
+	flag.DurationVar(&srv.DataTimeout, "data-timeout", 0, "Maximum time to receive the whole mail data. (0 means -timeout for each line)")
+	flag.BoolVar(&srv.LMTP, "lmtp", false, lmtpHelp)
 
 	// TLS config
 	flag.BoolVar(&srv.TLSListener, "tlsonly", false, "Start the server in smtps only work if tls material was provided.")
 	flag.BoolVar(&srv.TLSRequired, "tlsrequired", false, "Enforce STARTTLS.")
+	flag.BoolVar(&tlsRequiredExceptLoopback, "tls-required-except-loopback", false, "Enforce STARTTLS, except for clients connecting from 127.0.0.0/8 or ::1.")
 	flag.StringVar(&certfile, "cert", "", "Certificate to use for TLS server.")
 	flag.StringVar(&keyfile, "key", "", "Private key to use for TLS server.")
+	flag.Var(&sniCerts, "sni-cert", "Additional certificate and private key files, as certfile,keyfile, selected by the SNI of clients. Can be repeated.")
+	flag.StringVar(&clientCAFile, "client-ca", "", "PEM file of the CA certificates, possibly several concatenated, verifying the certificates presented by clients. Clients without certificate are still accepted.")
+	flag.BoolVar(&logClientFP, "tls-fingerprint-log", false, "Log the SHA-256 fingerprint of the certificate presented by TLS clients, which are asked for one.")
+	flag.BoolVar(&sniRequired, "sni-required", false, "Refuse TLS handshakes from clients not sending SNI.")
+	flag.BoolVar(&starttlsDowngrade, "starttls-downgrade-log", false, "Log a SECURITY warning for clients sending MAIL FROM without the STARTTLS advertised to them, with -tlsrequired.")
+
+	flag.Var(&trustedProxies, "trusted-proxies", "Comma separated networks in CIDR notation of proxies which must send a PROXY protocol version 1 or 2 header giving the client address, can be repeated. PROXY headers from other peers are ignored.")
+	flag.BoolVar(&requireRDNS, "require-rdns", false, "Refuse MAIL FROM of unauthenticated clients whose IP has no reverse DNS.")
+	flag.BoolVar(&requireFCRDNS, "require-fcrdns", false, "Refuse MAIL FROM of unauthenticated clients whose IP has no reverse DNS name resolving back to it.")
+	flag.IntVar(&rdnsRejectCode, "rdns-reject-code", 450, "Reply code refusing clients failing -require-rdns or -require-fcrdns, 450 or 550.")
+	flag.DurationVar(&rdnsTimeout, "rdns-timeout", 5*time.Second, "Time given to the reverse DNS lookups of a client, which then gets a 451.")
+	flag.StringVar(&batvKey, "batv-key", "", "Secret key validating the BATV prvs tags of the recipients of bounces, mails from the null sender. Bounces to a recipient with an invalid or expired tag get a 550.")
+	flag.BoolVar(&rejectNullMX, "reject-null-mx", false, "Refuse MAIL FROM addresses whose domain publishes a null MX record (RFC 7505) with a 550. Lookup failures accept the sender.")
+	flag.DurationVar(&mxCheckTimeout, "mx-check-timeout", 5*time.Second, "Time given to the MX lookup of -reject-null-mx, which then accepts the sender.")
+	flag.StringVar(&dnsServer, "dns-server", "", "Address, host or host:port, of the DNS server queried by the DNS checks instead of the system resolver.")
+	flag.Var(&denyNets, "deny-ips", "Comma separated networks in CIDR notation whose connections are refused with a 554 greeting, can be repeated.")
+	flag.DurationVar(&denyHold, "deny-hold", 0, "Time connections from -deny-ips are held open after the 554 greeting before being closed.")
+	flag.Int64Var(&denyHoldMax, "deny-hold-max", 100, "Maximum number of connections held by -deny-hold at once, others are closed at once.")
+	flag.BoolVar(&autoBan, "smtp-auto-ban", false, "Ban the IPs getting more than -auto-ban-threshold 550 or 554 replies within -auto-ban-window, their connections are refused with a 554 greeting.")
+	flag.IntVar(&autoBanThreshold, "auto-ban-threshold", 10, "Number of rejections within -auto-ban-window above which -smtp-auto-ban bans an IP.")
+	flag.DurationVar(&autoBanWindow, "auto-ban-window", 5*time.Minute, "Sliding window over which -smtp-auto-ban counts the rejections of an IP.")
+	flag.DurationVar(&autoBanDuration, "auto-ban-duration", time.Hour, "Time an IP stays banned by -smtp-auto-ban.")
+	flag.StringVar(&autoBanHTTP, "auto-ban-http", "", "Address of an HTTP listener serving the -smtp-auto-ban list as JSON at /bans.")
+	flag.Var(&tarpitNets, "tarpit-ips", "Comma separated networks in CIDR notation whose connections are slowed down, can be repeated.")
+	flag.DurationVar(&tarpitDelay, "tarpit-delay-per-kb", time.Second, "Delay applied for every KB sent to tarpitted connections.")
+	flag.DurationVar(&tarpitMax, "tarpit-max-duration", 10*time.Minute, "Maximum total delay applied to a tarpitted connection.")
+	flag.IntVar(&maxConnPerIP, "maxconn-per-ip", 0, "Maximum simultaneous connections from a single IP, others get a 421 reply. (0 means no limit)")
+	flag.Var(&connLimitExempt, "connection-limit-whitelist", "Comma separated networks in CIDR notation exempted from -maxconn-per-ip, can be repeated.")
+	flag.StringVar(&connLimitExemptFile, "connection-limit-whitelist-file", "", "File of networks in CIDR notation exempted from -maxconn-per-ip, one per line, reloaded on SIGHUP.")
+	flag.DurationVar(&bannerDelayMin, "banner-delay-min", 0, "Minimum random delay before sending the greeting banner.")
+	flag.DurationVar(&bannerDelayMax, "banner-delay-max", 0, "Maximum random delay before sending the greeting banner, at most 30s. (0 means no delay)")
+	flag.BoolVar(&srv.GreetingID, "connection-id-in-greeting", false, "Append the session identifier to the greeting banner as [connid=<id>], and log it with the mails and rejections of the session.")
+	flag.StringVar(&slowDelays, "simulate-slow-server", "", "Comma separated COMMAND=delay list, e.g. EHLO=2s,MAIL=1s, delaying the replies to test clients against a slow server. GREETING delays the banner, . the reply to mail data and * the replies to the commands not listed.")
+	flag.StringVar(&slowProfile, "slow-profile", "", "Predefined -simulate-slow-server delays: rfc5321 uses the RFC 5321 minimum client timeouts, saturation delays every reply by 4m59s. Raise -timeout accordingly.")
+	flag.IntVar(&keepAliveWarn, "warn-noop-rset", 20, "Log sessions sending more NOOP or RSET commands than this. (0 means never)")
+	flag.Var(&advertise, "advertise", "Additional keyword, with its parameters, to advertise in the EHLO response. Can be repeated.")
+	flag.StringVar(&srv.QuitReply, "quit-message", "", "Text of the 221 reply to QUIT, e.g. \"Bye\". (default \"2.0.0 <hostname> smtpd ESMTP Service closing transmission channel\")")
+	flag.StringVar(&srv.NoopReply, "noop-response", "", "Reply to NOOP commands, e.g. \"250 still here\", 250 is prepended if missing. (default \"250 2.0.0 Ok\")")
+	flag.IntVar(&srv.MaxUnknownCmds, "max-unknown-commands", 0, "Close sessions with a 421 reply after this many unrecognized commands. (0 means no limit)")
+	flag.StringVar(&disabledCommands, "disable-commands", "", "Comma separated list of SMTP commands to answer as unrecognized, e.g. VRFY,EXPN,NOOP.")
+
+	// Authentication
+	flag.StringVar(&authMechanisms, "auth-mechanisms", "", "Comma separated AUTH mechanisms offered, among PLAIN, LOGIN and CRAM-MD5, others get a 504. PLAIN and LOGIN still need TLS. (default all those usable by the AUTH backend)")
+	flag.BoolVar(&srv.PreauthHideExt, "preauth-hide-extensions", false, "Only advertise STARTTLS and AUTH in EHLO replies until the client is authenticated, the full list is shown by an EHLO after AUTH.")
+	flag.StringVar(&authCmd, "auth-external-cmd", "", "Command, with its arguments, checking AUTH credentials: it gets the user name in $SMTP_AUTH_USER and the password on stdin, exit status 0 accepts them.")
+	flag.DurationVar(&authTimeout, "auth-external-timeout", 10*time.Second, "Time given to -auth-external-cmd to exit before the attempt fails temporarily.")
+	flag.StringVar(&forwardAuthHost, "forward-auth-host", "", "Upstream SMTP server checking AUTH credentials with AUTH PLAIN, its 235 reply accepts them and 535 refuses them.")
+	flag.IntVar(&forwardAuthPort, "forward-auth-port", 587, "Port of -forward-auth-host.")
+	flag.BoolVar(&forwardAuthTLS, "forward-auth-tls", false, "Require STARTTLS to -forward-auth-host, which is otherwise used only when offered.")
+	flag.DurationVar(&forwardAuthTimeout, "forward-auth-timeout", 10*time.Second, "Time given to -forward-auth-host to check credentials before the attempt fails temporarily.")
+	flag.DurationVar(&authCacheTTL, "auth-external-cache-ttl", 0, "Time successful credentials are remembered without running -auth-external-cmd again. (0 means no cache)")
+
+	// Privileges
+	flag.StringVar(&runUser, "user", "", "User to run as once the listening socket is bound.")
+	flag.StringVar(&runGroup, "group", "", "Group to run as once the listening socket is bound, defaults to the -user primary group.")
+	flag.StringVar(&chrootDir, "chroot", "", "Directory to chroot into once the listening socket is bound. -fileformat is then relative to it.")
 
 	// Util parameter
 	flag.BoolVar(&smtpd.Debug, "debug", false, "Enable debug log from smtpd.")
+	flag.BoolVar(&verifyBackend, "verify-backend", false, "Check at startup that the configured storages are writable, the -fifo a named pipe and the -webhook-url server reachable, and exit on failure.")
+	flag.StringVar(&pidFile, "pidfile", "", "File to write the process PID to, removed on clean shutdown. Not available with -chroot, -user or -group.")
 	flag.IntVar(&srv.MaxSize, "maxsize", 0, "Maximum bytes to accept for mail data. (0 means no limit)")
+	flag.IntVar(&srv.AnnouncedSize, "smtp-announce-size", 0, "Size advertised by the EHLO SIZE extension, while -maxsize stays enforced. (0 means -maxsize)")
+	flag.BoolVar(&enforceDeclaredSize, "enforce-declared-size", false, "Reject with a 552 the mails larger than the SIZE parameter their client gave with MAIL FROM.")
+	flag.BoolVar(&fileSync, "file-sync", false, "Sync saved mail data to disk before acknowledging the mail. Each mail then waits for a disk flush, which can cut throughput a lot on slow disks.")
+	flag.BoolVar(&fileSyncDir, "file-sync-dir", false, "Also sync the directory of saved mail data, needed on some filesystems for the new file name to survive a crash. Costs one more disk flush per mail.")
+	flag.IntVar(&writeConcurrency, "write-concurrency", 0, "Maximum number of mails written to storage at once, others wait up to -timeout before a 451 reply. (0 means no limit)")
+	flag.IntVar(&fileLimit, "concurrent-file-limit", 0, "Maximum number of mails whose files are being written at once, others wait up to -timeout before a 451 reply. Unlike -write-concurrency, the preparation of the saved data (added headers, DKIM signature) is not limited. (0 means no limit)")
+	flag.DurationVar(&fileWaitWarn, "file-wait-warn", 100*time.Millisecond, "Log in -debug mode the -concurrent-file-limit waits longer than this.")
+	flag.StringVar(&indexPath, "index", "", "File where a binary record of the hash, reception time, envelope and path of each mail saved to -fileformat is appended.")
+	flag.Var(&dataProgress, "data-progress-interval", "Mail data size, e.g. 10MB, after which the progress of the DATA transfer is logged, then again every time as much is received. (0 disables the progress log)")
+	flag.Var(&indexMaxSize, "index-max-size", "Size, e.g. 64MB, above which the -index file is rotated to <file>.1, replacing the previous one. (0 means no limit)")
+	flag.StringVar(&lookupHash, "lookup", "", "Print the -index records, current and rotated, whose hash starts with this hexadecimal prefix, then exit without serving.")
+	flag.StringVar(&rehashDir, "rehash", "", "Rename the mail files found in this directory to the name -fileformat gives to their content, dated by their modification time, then exit without serving. Existing files are not overwritten.")
+	flag.BoolVar(&dsnLog, "dsn-log", false, "Advertise DSN (RFC 3461) and log the NOTIFY and ORCPT parameters of the recipients as dsn_notify and dsn_orcpt.")
+	flag.BoolVar(&dsnDiscard, "dsn-discard", false, "Advertise DSN (RFC 3461) and silently ignore its parameters, no notification is ever sent.")
+	flag.BoolVar(&transcript, "transcript", false, "Save the timestamped SMTP dialog of the session up to its first MAIL and of the transaction, up to the end of the message data, next to each mail file as <name>.transcript. AUTH credentials are masked.")
+	flag.IntVar(&flowThreshold, "flow-control-disk-threshold", 0, "Disk I/O utilization percentage of the -fileformat device, read from /proc/diskstats on Linux, above which replies to DATA are delayed by -flow-control-delay. Ignored on other platforms. (0 means no flow control)")
+	flag.DurationVar(&flowDelay, "flow-control-delay", time.Second, "Delay of the replies to DATA while the disk utilization is above -flow-control-disk-threshold.")
+	flag.DurationVar(&flowPoll, "flow-control-poll", 5*time.Second, "Interval between disk utilization measures of -flow-control-disk-threshold, at least 1s.")
+	flag.Var(&diskMinFree, "disk-min-free", "Free disk space, e.g. 100MB, below which mails are refused with a 452 reply instead of being saved. (0 means no check)")
+	flag.DurationVar(&diskCheckInterval, "disk-check-interval", 0, "Time during which a -disk-min-free check result is reused. (0 means check every mail)")
+	flag.IntVar(&srv.ReadBufferSize, "read-buffer", 0, "Size of the buffer smtpd reads each session through, between 4KB and 16MB, larger buffers need fewer reads for big mails. Unlike -smtp-read-buffer, it is not a socket option. (0 means 4KB)")
+	flag.IntVar(&srv.WriteBufferSize, "write-buffer", 0, "Size of the buffer smtpd writes the replies of each session through, between 4KB and 16MB. Unlike -smtp-write-buffer, it is not a socket option. (0 means 4KB)")
+	flag.IntVar(&socketReadBuffer, "smtp-read-buffer", 64<<10, "TCP receive buffer size of connections, a power of two between 4KB and 4MB. (0 means OS default)")
+	flag.IntVar(&socketWriteBuffer, "smtp-write-buffer", 0, "TCP send buffer size of connections, a power of two between 4KB and 4MB. (0 means OS default)")
 
 	// Program customization
 	flag.StringVar(&dataEnd, "dataend", "", "String to write at the end of the log after mail data.")
 	flag.BoolVar(&logQuiet, "quiet", false, "No log will be printed.")
 	flag.BoolVar(&logFull, "full", false, "Mail Data will also be printed in log.")
+	flag.BoolVar(&logLatency, "log-latency", false, "Log the time spent processing each mail.")
+	flag.DurationVar(&latencyWarn, "latency-warn-threshold", time.Second, "Processing time above which -log-latency logs a warning.")
+	flag.StringVar(&protocolLogDir, "protocol-log-dir", "", "Directory where the raw bytes of each connection are dumped in hexadecimal and ASCII, to a <session-id>.pcap.txt file. TLS traffic is dumped encrypted.")
+	flag.StringVar(&postmasterPath, "postmaster-path", "", "Directory receiving the mails to postmaster@ of any domain (RFC 2142) instead of -fileformat, which still gets them when they have other recipients. Files keep their -fileformat path under it.")
+	flag.StringVar(&abusePath, "abuse-path", "", "Directory receiving the mails to abuse@ of any domain (RFC 2142) instead of -fileformat, which still gets them when they have other recipients. Files keep their -fileformat path under it.")
+	flag.StringVar(&webhookURL, "webhook-url", "", "URL where mails are posted as message/rfc822, with the envelope in X-Envelope-From and X-Envelope-To. Mails are refused with a 451 when the post fails.")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", 10*time.Second, "Timeout of each -webhook-url post.")
+	flag.BoolVar(&webhookAsync, "webhook-async", false, "Accept mails once queued for -webhook-url instead of once posted. Queued mails are lost if the process stops before they are posted.")
+	flag.IntVar(&webhookQueueSize, "webhook-queue-size", 100, "Maximum number of mails queued by -webhook-async, mails are refused with a 451 when it is full and retries dropped.")
+	flag.IntVar(&webhookMaxAttempts, "webhook-max-attempts", 5, "Maximum number of posts of a mail to -webhook-url, retried on network errors, 5xx and 429 replies.")
+	flag.DurationVar(&webhookBackoff, "webhook-retry-backoff", time.Second, "Wait before the first retry of a -webhook-url post, doubled for each next one.")
+	flag.StringVar(&fifoPath, "fifo", "", "Named pipe where mails are written, each preceded by its size in bytes in decimal on its own line. The FIFO is opened for each mail, so readers see an end of file after each one unless they keep it open for writing too. Mails are refused with a 451 when no reader drains it within -fifo-timeout.")
+	flag.DurationVar(&fifoTimeout, "fifo-timeout", 30*time.Second, "Maximum time to wait for a reader of -fifo and to write a mail to it.")
+	flag.StringVar(&rawConnDir, "raw-conn-dir", "", "Directory where the bytes exchanged on each connection are saved as is once it is closed, to a <session-id>.raw file, client data following a \"> \" marker and server data a \"< \" one. TLS traffic is saved encrypted.")
+	flag.StringVar(&recordDir, "record-test-cases-dir", "", "Directory where each session is written as a Go test, replaying the client data and expecting the server replies. The test package must provide replay(t, []replayStep) with replayStep{client, server string}.")
+	flag.StringVar(&srv.RejectFooter, "reject-footer", "", "Text appended to the replies rejecting a sender, a recipient, a message or a connection, e.g. a support URL.")
+	flag.BoolVar(&bccDetectLog, "bcc-detect-log", false, "Log a bcc_detected field with the envelope and header recipients when envelope recipients are missing from the To and Cc headers.")
+	flag.BoolVar(&bccInjectHeader, "bcc-inject-header", false, "Add an X-BCC-Detected: true header to the stored mails with envelope recipients missing from the To and Cc headers.")
+	flag.BoolVar(&logEntropy, "log-entropy", false, "Log the Shannon entropy of the message body, in bits per byte, also saved in -jsonl-archive.")
+	flag.BoolVar(&logTLS, "log-tls", false, "Log the negotiated TLS cipher suite and SNI server name.")
 	flag.StringVar(&fileFormat, "fileformat", "", fileFormatHelp)
+	flag.StringVar(&preludeTemplate, "prelude", "", "Comma separated fields among from, to, remote and received written as \"Field: value\" lines at the start of the stored files, followed by a blank line then the message. The hashes of -fileformat are those of the message without the prelude.")
+	flag.StringVar(&localDomainList, "local-domains", "", "Comma separated domains to accept recipients for, others are rejected.")
+	flag.StringVar(&localDomainsFile, "local-domains-file", "", "File listing domains to accept recipients for, one per line.")
+	flag.BoolVar(&localSubdomains, "local-domains-subdomain", false, "Also accept subdomains of -local-domains.")
+	flag.BoolVar(&strictAddr, "strict-addr", false, "Refuse MAIL FROM and RCPT TO addresses not following the RFC 5321 syntax with 501, and use them with a lower cased domain.")
+	flag.StringVar(&protectDomainList, "protect-domains", "", "Comma separated sender domains refused as spoofed unless the client authenticated or connects from -protect-domains-allow.")
+	flag.Var(&protectAllowNets, "protect-domains-allow", "Comma separated networks in CIDR notation allowed to send from -protect-domains, can be repeated.")
+	flag.StringVar(&attachmentDir, "extract-attachments", "", "Directory where the attachments of each mail are written, named after the Message-ID and their file name.")
+	flag.IntVar(&maxMIMEParts, "max-mime-parts", 1000, "Maximum number of MIME parts parsed by -extract-attachments and -extract-text, above which extraction is skipped. (0 means no limit)")
+	flag.IntVar(&maxMIMEDepth, "max-mime-depth", 20, "Maximum nesting of multipart parts parsed by -extract-attachments and -extract-text, above which extraction is skipped. (0 means no limit)")
+	flag.BoolVar(&extractText, "extract-text", false, "Also save the first text/plain part of mails, decoded to UTF-8, next to them with a .txt extension.")
+	flag.BoolVar(&plusAddressing, "plus-addressing", false, "Match recipient policies against user@domain for user+tag@domain recipients. Mails are still saved and logged with the original address.")
+	flag.StringVar(&plusSeparator, "plus-separator", "+", "Separator of the -plus-addressing tag.")
+	flag.Var(&storeOnlyRcpt, "store-only-rcpt", "Only save mails with a recipient matching this regular expression, others are accepted but discarded. Can be repeated.")
+	flag.StringVar(&dkimDomain, "dkim-sign-domain", "", "Domain of the DKIM signature added to saved data.")
+	flag.StringVar(&dkimSelector, "dkim-sign-selector", "", "Selector of the DKIM key.")
+	flag.StringVar(&dkimKeyFile, "dkim-sign-key", "", "PEM file of the RSA private key used to sign saved data with DKIM.")
+	flag.Var(&rejectBody, "reject-body", "Reject mails whose body matches this regular expression, can be repeated.")
+	flag.IntVar(&rejectBodyCode, "reject-body-code", 550, "SMTP code used to reject mails matching -reject-body.")
+	flag.IntVar(&rejectBodyLimit, "reject-body-limit", 1<<20, "Maximum number of body bytes matched against -reject-body. (0 means no limit)")
+	flag.StringVar(&rcptQuotaFile, "rcpt-quota-file", "", "File of \"recipient bytes\" lines giving the bytes an address, the addresses of a @domain or any address (*) may receive while the server runs. Mails are refused at DATA when one recipient is over quota, per recipient with -lmtp.")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", 0, "Reject with a 550 the mails whose Date header is further in the future. (0 means no check)")
+	flag.DurationVar(&maxMessageAge, "max-message-age", 0, "Reject with a 550 the mails whose Date header is further in the past. (0 means no check)")
+	flag.StringVar(&dateMissing, "date-missing", "accept", "What to do with mails without valid Date header when -max-clock-skew or -max-message-age is set: accept or reject.")
+	flag.BoolVar(&requireMsgID, "require-msg-id", false, "Reject mails without Message-ID header with a 554.")
+	flag.StringVar(&requiredHeaders, "require-headers", "", "Comma separated headers, e.g. From,To, mails must have with a 550 otherwise. From, Sender, To, Cc and Reply-To must also hold valid addresses.")
+	flag.BoolVar(&addMissingMsgID, "add-missing-msg-id", false, "Add a Message-ID header, made of a UUID and the server hostname, to saved mails without one.")
+	flag.IntVar(&maxReceived, "max-received-headers", 25, "Reject mails with at least this many Received headers, to break mail loops. (0 disables the check)")
+	flag.StringVar(&archiveDir, "jsonl-archive", "", "Directory where all mails are appended to a daily JSON lines file.")
+	flag.BoolVar(&receivedSPF, "received-spf-header", false, "Evaluate the SPF policy of the MAIL FROM domain and add its result as a Received-SPF header after the Received header of saved data.")
+	flag.BoolVar(&envelopeHeaders, "envelope-to-header", false, "Add Envelope-From and Envelope-To headers after the Received header of saved data.")
+	flag.StringVar(&dateFormat, "received-date-format", "", "Go time layout used to render %s instead of a unix timestamp, e.g. 2006-01-02_150405.")
+	flag.StringVar(&casRoot, "cas", "", "Save mail data in this directory as a content addressable store, at a path derived from its %h hash.")
+	flag.IntVar(&casDepth, "cas-depth", 2, "Number of fan-out directory levels of -cas, each named after 2 characters of the hash.")
+	flag.StringVar(&shardBy, "auto-shard-by", "", "Save mail data in date subdirectories of the -fileformat directory, one of hour, day, week or month.")
+	flag.BoolVar(&localTime, "local-time", false, "Render dates in local time instead of UTC.")
+	flag.BoolVar(&showRate, "rate-display", false, "Display the receiving throughput on stderr every second, averaged over 5 seconds.")
+	flag.StringVar(&syslogNetwork, "syslog-network", "udp", "Network used to reach the syslog daemon.")
+	flag.StringVar(&syslogAddr, "syslog-addr", "", "Address of a syslog daemon to send mail events to in RFC 5424 format.")
+	flag.BoolVar(&logSyslog, "log-syslog", false, "Send the log lines to the -syslog-addr daemon too, in addition to the standard error.")
+	flag.StringVar(&logTag, "logtag", "", "Tag of this instance, prepended to the log lines and given as the tag field of -log-file-format json lines.")
+	flag.StringVar(&logFile, "log-file", "", "File the log lines are appended to, in addition to the standard error.")
+	flag.StringVar(&logFileFormat, "log-file-format", "text", "Format of -log-file lines: text, as on the standard error, or json, objects with ts and msg fields.")
+	flag.BoolVar(&envelopeSizeLog, "envelope-size-log", false, "Log the estimated bytes of the envelope commands and the bytes of the message data of every mail. Both are also counted as the envelope_bytes and body_bytes StatsD metrics.")
+	flag.Var(&geoIPPaths, "geoip-db", "MaxMind DB file, e.g. GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, giving the country and ASN of the clients logged with their mails. Can be repeated.")
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "Address of a StatsD daemon to send metrics to over UDP.")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "smtp_receiver", "Prefix of the StatsD metric names.")
 
 	flag.Parse()
 
 	srv.Handler = mailProcessing
+	srv.HandlerMail = mailFromProcessing
+	srv.HandlerRcptReply = rcptProcessing
+	srv.HandlerClose = sessionClose
+	if autoBan {
+		if autoBanThreshold < 1 || autoBanWindow <= 0 || autoBanDuration <= 0 {
+			log.Fatal("-auto-ban-threshold, -auto-ban-window and -auto-ban-duration must be positive")
+		}
+		srv.HandlerReply = countRejection
+	} else if autoBanHTTP != "" {
+		log.Fatal("-auto-ban-http needs -smtp-auto-ban")
+	}
+	if strings.TrimSpace(authCmd) != "" {
+		// The command needs the plaintext password, CRAM-MD5 cannot be offered.
+		srv.AuthHandler = authExternal
+		srv.AuthMechs = map[string]bool{"CRAM-MD5": false}
+	}
+	if forwardAuthHost != "" {
+		if srv.AuthHandler != nil {
+			log.Fatal("-forward-auth-host and -auth-external-cmd cannot be used together")
+		}
+		// The upstream needs the plaintext password, CRAM-MD5 cannot be offered.
+		srv.AuthHandler = authForward
+		srv.AuthMechs = map[string]bool{"CRAM-MD5": false}
+	}
+
+	if authMechanisms != "" {
+		if err := configureAuthMechs(authMechanisms); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if srv.PreauthHideExt && srv.AuthHandler == nil {
+		log.Fatal("-preauth-hide-extensions needs -auth-external-cmd or -forward-auth-host")
+	}
+
+	if disabledCommands != "" {
+		srv.DisabledCmds = make(map[string]bool)
+		for _, verb := range strings.Split(disabledCommands, ",") {
+			srv.DisabledCmds[strings.ToUpper(strings.TrimSpace(verb))] = true
+		}
+	}
 
 	var err error
 	// certfile && keyfile check
@@ -70,6 +307,197 @@ func main() {
 	} else if certfile != "" || keyfile != "" {
 		log.Fatal("There is a missing -cert or -key")
 	}
+	configureSNI()
+	if err = configureClientCA(); err != nil {
+		log.Fatal(err)
+	}
+	if err = configureFingerprintLog(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The PID file could not be removed at shutdown from inside the chroot,
+	// or by a user without write access to its directory.
+	if pidFile != "" && (chrootDir != "" || runUser != "" || runGroup != "") {
+		log.Fatal("-pidfile cannot be used with -chroot, -user or -group")
+	}
+	if dsnLog && dsnDiscard {
+		log.Fatal("-dsn-log and -dsn-discard are mutually exclusive")
+	}
+	if dsnLog || dsnDiscard {
+		advertise = append(advertise, "DSN")
+		srv.MailParams = map[string]bool{"RET": true, "ENVID": true}
+	}
+	if err = checkAdvertise(); err != nil {
+		log.Fatal(err)
+	}
+	if len(advertise) > 0 {
+		srv.Extensions = advertise
+		log.Printf("EHLO extensions: %s", strings.Join(srv.EHLOExtensions(srv.TLSListener, false), ", "))
+		if srv.PreauthHideExt {
+			log.Printf("EHLO extensions after AUTH: %s", strings.Join(srv.EHLOExtensions(srv.TLSConfig != nil, true), ", "))
+		}
+	}
+
+	if err = checkConnBuffer("read-buffer", srv.ReadBufferSize); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkConnBuffer("write-buffer", srv.WriteBufferSize); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkSocketBuffer("smtp-read-buffer", socketReadBuffer); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkSocketBuffer("smtp-write-buffer", socketWriteBuffer); err != nil {
+		log.Fatal(err)
+	}
+
+	if casRoot != "" {
+		if fileFormat != "" || shardBy != "" {
+			log.Fatal("-cas can not be used with -fileformat or -auto-shard-by")
+		}
+		fileFormat = "%h"
+		needDataHash = true
+	}
+
+	if err = loadReplyDelays(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = checkBannerDelay(); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkFIFO(); err != nil {
+		log.Fatal(err)
+	}
+	if err = checkRoleDirs(); err != nil {
+		log.Fatal(err)
+	}
+	if err = startWebhook(); err != nil {
+		log.Fatal(err)
+	}
+	if rdnsRejectCode != 450 && rdnsRejectCode != 550 {
+		log.Fatal("-rdns-reject-code must be 450 or 550")
+	}
+	if err = loadConnLimitExemptFile(); err != nil {
+		log.Fatal(err)
+	}
+	reloadOnHangup()
+	if err = loadRcptQuotas(); err != nil {
+		log.Fatal(err)
+	}
+	// Leave room for the reply code on a continuation line.
+	if strings.ContainsAny(srv.RejectFooter, "\r\n") || len(srv.RejectFooter) > 400 {
+		log.Fatal("-reject-footer must be a single line of at most 400 bytes")
+	}
+	if dateMissing != "accept" && dateMissing != "reject" {
+		log.Fatal("-date-missing must be accept or reject")
+	}
+	if requireMsgID && addMissingMsgID {
+		log.Fatal("-require-msg-id and -add-missing-msg-id are mutually exclusive")
+	}
+
+	switch {
+	case ipv4Only && ipv6Only:
+		log.Fatal("-ipv4-only and -ipv6-only are mutually exclusive")
+	case ipv4Only:
+		listenNetwork = "tcp4"
+	case ipv6Only:
+		listenNetwork = "tcp6"
+	}
+
+	if err = loadDKIMKey(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = checkShardBy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = loadLocalDomains(); err != nil {
+		log.Fatal(err)
+	}
+	loadProtectDomains()
+	if plusAddressing && (plusSeparator == "" || strings.Contains(plusSeparator, "@")) {
+		log.Fatal("-plus-separator must be set and must not contain @")
+	}
+
+	if transcript {
+		srv.TranscriptSize = maxTranscriptBytes
+	}
+	if writeConcurrency > 0 {
+		writeSlots = make(chan struct{}, writeConcurrency)
+	}
+	if fileLimit > 0 {
+		fileSlots = make(chan struct{}, fileLimit)
+	}
+	if diskMinFree > 0 && !freeSpaceSupported {
+		log.Fatal("-disk-min-free is not supported on this platform")
+	}
+	if flowThreshold < 0 || flowThreshold > 100 {
+		log.Fatal("-flow-control-disk-threshold must be between 0 and 100")
+	}
+	if flowPoll < time.Second {
+		log.Fatal("-flow-control-poll must be at least 1s")
+	}
+
+	if srv.NoopReply != "" {
+		if strings.ContainsAny(srv.NoopReply, "\r\n") {
+			log.Fatal("-noop-response must be a single line")
+		}
+		if !strings.HasPrefix(srv.NoopReply, "250 ") {
+			srv.NoopReply = "250 " + srv.NoopReply
+		}
+	}
+	if srv.QuitReply != "" {
+		if strings.ContainsAny(srv.QuitReply, "\r\n") {
+			log.Fatal("-quit-message must be a single line")
+		}
+		srv.QuitReply = "221 " + srv.QuitReply
+	}
+
+	if srv.AnnouncedSize < 0 {
+		log.Fatal("-smtp-announce-size must not be negative")
+	}
+
+	if extractText && fileFormat == "" {
+		log.Fatal("-extract-text requires -fileformat")
+	}
+	if err := configureDNSServer(); err != nil {
+		log.Fatal(err)
+	}
+	loadGeoIP()
+	if tlsRequiredExceptLoopback {
+		srv.TLSRequired = true
+		srv.TLSLoopbackFree = true
+	}
+	if preludeTemplate != "" {
+		if err := checkPrelude(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if rejectBodyCode < 400 || rejectBodyCode > 599 {
+		log.Fatal("-reject-body-code must be a 4xx or 5xx SMTP code")
+	}
+
+	archive.dir = archiveDir
+
+	if syslogAddr != "" {
+		syslogger, err = dialSyslog(syslogNetwork, syslogAddr, srv.Hostname, srv.Appname)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = configureLogSinks(); err != nil {
+		log.Fatal(err)
+	}
+
+	if statsdAddr != "" {
+		statsd, err = dialStatsd(statsdAddr, statsdPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Verbosity
 	var verbosityFlags int
@@ -86,6 +514,12 @@ func main() {
 		log.Print("WARNING: multiple flags present: -debug -quiet -full, unspecified behaviour")
 	}
 
+	if err := checkDateFormat(); err != nil {
+		log.Fatal(err)
+	}
+
+	needEntropy = logEntropy
+
 	// file Format pre processing.
 	if fileFormat != "" {
 		for i := 0; i < len(fileFormat); {
@@ -94,6 +528,16 @@ func main() {
 				break
 			}
 			j += i
+			switch {
+			case strings.HasPrefix(fileFormat[j+1:], "cipher"), strings.HasPrefix(fileFormat[j+1:], "sni"):
+				needTLSInfo = true
+			case strings.HasPrefix(fileFormat[j+1:], "md5"):
+				needMD5 = true
+			case strings.HasPrefix(fileFormat[j+1:], "entropy"):
+				needEntropy = true
+			case strings.HasPrefix(fileFormat[j+1:], "country"), strings.HasPrefix(fileFormat[j+1:], "asn"):
+				needGeoIP = true
+			}
 			switch fileFormat[j+1] {
 			case 'h':
 				needDataHash = true
@@ -108,13 +552,58 @@ func main() {
 		}
 	}
 
+	if lookupHash != "" {
+		if indexPath == "" {
+			log.Fatal("-lookup needs -index")
+		}
+		matches, err := lookup(os.Stdout, lookupHash)
+		switch {
+		case err != nil:
+			log.Fatal(err)
+		case matches == 0:
+			log.Fatalf("no index record matches %s", lookupHash)
+		case matches > 1:
+			log.Printf("%d index records match %s", matches, lookupHash)
+		}
+		return
+	}
+	if rehashDir != "" {
+		if err = rehash(rehashDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if verifyBackend {
+		err = verifyBackends()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if pidFile != "" {
+		err = writePidFile(pidFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if showRate {
+		go rateDisplay(os.Stderr)
+	}
+	startFlowControl()
+	startAutoBan()
+
 	go func() {
 		var c = make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 		// Wait for signal.
-		<-c
-		log.Println("Signal received: shutting down.")
+		sig := <-c
+		sessions, deliveries := srv.Activity()
+		log.Printf("Signal received (%v): shutting down, open sessions: %d, deliveries in progress: %d, writes in progress: %d.",
+			sig, sessions, deliveries, atomic.LoadInt64(&writesInFlight))
+		close(shutdown)
 		err := srv.Close()
 		if err != nil {
 			log.Println(err)
@@ -131,93 +620,493 @@ func main() {
 			log.Println(err)
 		}
 		log.Println("server shut downed.")
+		if sessions, deliveries := srv.Activity(); sessions > 0 {
+			log.Printf("WARNING: shutdown drain timed out, open sessions: %d, deliveries in progress: %d.", sessions, deliveries)
+		} else {
+			log.Println("shutdown drain completed.")
+		}
 	} else if err != nil {
 		log.Println(err)
 	}
+	flushWebhook(30 * time.Second)
+	log.Printf("mails handled: %d, bytes: %d, aborted transactions: %d.",
+		atomic.LoadInt64(&receivedMessages), atomic.LoadInt64(&receivedBytes), atomic.LoadInt64(&abortedTransactions))
+
+	if err = msgIndex.close(); err != nil {
+		log.Println(err)
+	}
+	if err = archive.close(); err != nil {
+		log.Println(err)
+	}
+	if err = statsd.close(); err != nil {
+		log.Println(err)
+	}
+
+	if pidFile != "" {
+		err = removePidFile(pidFile)
+		if err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 const (
 	fileFormatHelp = `File path template to use when saving file data. The following replacement is done:
 	- %h the sha256 hash of mail data received.
 	- %H the sha256 hash of mail data received + header appended.
-	- %s reception date in unix timestamp.
-	- %N nanoseconds`
+	- %s reception date in unix timestamp, or formatted with -received-date-format.
+	- %N nanoseconds
+	- %md5 the md5 hash of mail data received + header appended.
+	- %cipher the negotiated TLS cipher suite, empty without TLS.
+	- %sni the server name requested by the TLS client, empty without TLS or SNI.
+	- %entropy the Shannon entropy of the message body, in bits per byte.
+	- %country the country code of the client per -geoip-db, empty if unknown.
+	- %asn the autonomous system number of the client per -geoip-db, empty if unknown.`
+
+	lmtpHelp = `Speak LMTP (RFC 2033) instead of SMTP. Differences with SMTP:
+	- clients greet with LHLO, HELO and EHLO are rejected.
+	- after DATA one reply is sent per accepted recipient.`
 
 	logFormatHead = "remote: %v, MAIL From: <%s>, RCPT To: %v"
+
+	maxDateLength = 64 // Maximum length of a formatted %s.
 )
 
 var (
 	needTimestamp    uint // bitmask from low to high: nanosecond, second
 	needDataHash     bool
 	needFullDataHash bool
+	needTLSInfo      bool
+	needMD5          bool
+	needEntropy      bool
+	needGeoIP        bool
 
 	timestampRegex    *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%s")
 	nanosecondsRegex  *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%N")
 	dataHashRegex     *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%h")
 	fulldataHashRegex *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%H")
+	cipherRegex       *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%cipher")
+	sniRegex          *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%sni")
+	md5Regex          *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%md5")
+	entropyRegex      *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%entropy")
+	countryRegex      *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%country")
+	asnRegex          *regexp.Regexp = regexp.MustCompile("(^|[^%](%%)*)%asn")
 	percentRegex      *regexp.Regexp = regexp.MustCompile("%%")
+
+	// unsafe characters in a path component, replaced in formatted dates.
+	pathUnsafeReplacer = strings.NewReplacer(":", "_", "/", "_", "\\", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_", "$", "_")
 )
 
-// mailProcessing procresses mail according to a configuration
-func mailProcessing(remoteAddr net.Addr, from string, to []string, data []byte) (err error) {
-	var date time.Time
-	var timestamp int64
-	var nano int
-	var dataChecksum []byte
-	var filename string = fileFormat
+// receivedDate renders the %s replacement for date.
+func receivedDate(date time.Time) string {
+	if dateFormat == "" {
+		return fmt.Sprintf("%d", date.Unix())
+	}
+	if !localTime {
+		date = date.UTC()
+	}
+	return pathUnsafeReplacer.Replace(date.Format(dateFormat))
+}
 
-	// filename treatment
+// checkDateFormat verifies -received-date-format renders at most
+// maxDateLength characters.
+func checkDateFormat() error {
+	if dateFormat == "" {
+		return nil
+	}
+	if d := receivedDate(time.Now()); len(d) > maxDateLength {
+		return fmt.Errorf("-received-date-format renders %d characters, maximum is %d", len(d), maxDateLength)
+	}
+	return nil
+}
+
+// tlsInfo returns the cipher suite name and SNI server name of the session.
+// Both are empty if TLS is not in use.
+func tlsInfo(remoteAddr net.Addr) (cipher, sni string) {
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok && peer.TLS != nil {
+		return tls.CipherSuiteName(peer.TLS.CipherSuite), peer.TLS.ServerName
+	}
+	return "", ""
+}
+
+// mailFilename expands the -fileformat placeholders for data received at
+// date. It also returns the %h or %H checksum and the body entropy, when
+// they were computed.
+func mailFilename(remoteAddr net.Addr, data []byte, date time.Time) (filename string, dataChecksum []byte, entropy float64) {
+	filename = fileFormat
+	// %sni must be replaced before %s.
+	if needTLSInfo {
+		cipher, sni := tlsInfo(remoteAddr)
+		filename = cipherRegex.ReplaceAllString(filename, "${1}"+cipher)
+		filename = sniRegex.ReplaceAllString(filename, "${1}"+pathUnsafeReplacer.Replace(sni))
+	}
+	if needGeoIP {
+		var info geoInfo
+		if remoteAddr != nil {
+			info = geoLookup(remoteIP(remoteAddr))
+		}
+		// Database values, made safe as path elements as MIME file names are.
+		filename = countryRegex.ReplaceAllString(filename, "${1}"+strings.TrimLeft(pathUnsafeReplacer.Replace(info.country), "."))
+		filename = asnRegex.ReplaceAllString(filename, "${1}"+strings.TrimLeft(pathUnsafeReplacer.Replace(info.asn), "."))
+	}
 	if needTimestamp > 0 {
-		date = time.Now()
-		timestamp = date.Unix()
-		nano = date.Nanosecond()
+		nano := date.Nanosecond()
 		if needTimestamp&1 > 0 {
 			filename = nanosecondsRegex.ReplaceAllString(filename, "${1}"+fmt.Sprintf("%0.9d", nano))
 		}
 		if needTimestamp&2 > 0 {
-			filename = timestampRegex.ReplaceAllString(filename, "${1}"+fmt.Sprintf("%d", timestamp))
+			filename = timestampRegex.ReplaceAllString(filename, "${1}"+receivedDate(date))
 		}
 	}
-	if needDataHash {
-		var payloadstart int
-		for i := 0; i < 3; i++ {
-			payloadstart += bytes.Index(data[payloadstart:], []byte{'\n'})
-			payloadstart++
+	if needDataHash || needEntropy {
+		// Hash the payload and measure the entropy of its body in a single pass.
+		payload := data[payloadStart(data):]
+		body := bodyOffset(payload)
+		var dataHash hash.Hash
+		var counts byteCounts
+		var writers []io.Writer
+		if needDataHash {
+			dataHash = sha256.New()
+			dataHash.Write(payload[:body])
+			writers = append(writers, dataHash)
+		}
+		if needEntropy {
+			writers = append(writers, &counts)
+		}
+		io.MultiWriter(writers...).Write(payload[body:])
+		if needDataHash {
+			dataChecksum = dataHash.Sum(nil)
+			filename = dataHashRegex.ReplaceAllString(filename, "${1}"+hex.EncodeToString(dataChecksum))
+		}
+		if needEntropy {
+			entropy = math.Round(counts.entropy()*100) / 100
+			filename = entropyRegex.ReplaceAllString(filename, "${1}"+strconv.FormatFloat(entropy, 'f', 2, 64))
 		}
-		var checksum [32]byte = sha256.Sum256(data[payloadstart:])
-		dataChecksum = checksum[:]
-		filename = dataHashRegex.ReplaceAllString(filename, "${1}"+hex.EncodeToString(dataChecksum))
 	}
-	if needFullDataHash {
-		var checksum [32]byte = sha256.Sum256(data)
-		dataChecksum = checksum[:]
-		filename = fulldataHashRegex.ReplaceAllString(filename, "${1}"+hex.EncodeToString(dataChecksum))
+	if needFullDataHash || needMD5 {
+		// Compute all hashes of the full data in a single pass.
+		var fullHash, md5Hash hash.Hash
+		var hashes []io.Writer
+		if needFullDataHash {
+			fullHash = sha256.New()
+			hashes = append(hashes, fullHash)
+		}
+		if needMD5 {
+			md5Hash = md5.New()
+			hashes = append(hashes, md5Hash)
+		}
+		io.MultiWriter(hashes...).Write(data)
+		if needFullDataHash {
+			dataChecksum = fullHash.Sum(nil)
+			filename = fulldataHashRegex.ReplaceAllString(filename, "${1}"+hex.EncodeToString(dataChecksum))
+		}
+		if needMD5 {
+			filename = md5Regex.ReplaceAllString(filename, "${1}"+hex.EncodeToString(md5Hash.Sum(nil)))
+		}
 	}
 	if filename != "" {
 		filename = percentRegex.ReplaceAllString(filename, "%")
+		if shardBy != "" {
+			filename = shardPath(filename, date)
+		}
+		if casRoot != "" {
+			filename = casPath(filename)
+		}
+	}
+	return filename, dataChecksum, entropy
+}
+
+// mailProcessing procresses mail according to a configuration
+func mailProcessing(remoteAddr net.Addr, from string, to []string, data []byte) (err error) {
+	var date time.Time = now()
+
+	if logLatency {
+		defer func() {
+			elapsed := time.Since(date)
+			format := logFormatHead + ", processing_ms: %.3f"
+			if elapsed > latencyWarn {
+				format = "WARNING: " + format
+			}
+			log.Printf(format, remoteAddr, from, to, float64(elapsed)/float64(time.Millisecond))
+		}()
+	}
+
+	if strictAddr {
+		from, to = canonicalEnvelope(from, to)
+	}
+
+	atomic.AddInt64(&receivedMessages, 1)
+	atomic.AddInt64(&receivedBytes, int64(len(data)))
+	statsd.count("messages", 1)
+	statsd.count("bytes", int64(len(data)))
+	envelopeBytes := envelopeSize(remoteAddr, from, to, len(data))
+	statsd.count("envelope_bytes", int64(envelopeBytes))
+	statsd.count("body_bytes", int64(len(data)))
+
+	flowControlWait(remoteAddr, from, to)
+
+	if err = checkDeclaredSize(remoteAddr, from, to, data); err != nil {
+		return err
+	}
+	if err = checkHops(remoteAddr, from, to, data); err != nil {
+		return err
+	}
+	if err = checkBody(remoteAddr, from, to, data); err != nil {
+		return err
+	}
+	if err = checkMessageID(remoteAddr, from, to, data); err != nil {
+		return err
+	}
+	if err = checkHeaders(remoteAddr, from, to, data); err != nil {
+		return err
+	}
+	if err = checkDate(remoteAddr, from, to, data, date); err != nil {
+		return err
+	}
+	if err = reserveQuota(remoteAddr, from, to, len(data)); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releaseQuota(to, len(data))
+		}
+	}()
+
+	filename, dataChecksum, entropy := mailFilename(remoteAddr, data, date)
+
+	// Mails to role mailboxes go to their own directory, and to -fileformat
+	// only when they have other recipients.
+	var roleFiles []string
+	if dirs, others := roleRecipients(to); len(dirs) > 0 {
+		roleFiles = rolePaths(dirs, filename, date.UnixNano())
+		if !others {
+			filename = ""
+		}
+	}
+
+	var discarded bool
+	if (filename != "" || len(roleFiles) > 0) && !storeRcptMatch(to) {
+		filename, roleFiles = "", nil
+		discarded = true
+	}
+
+	stored := roleFiles
+	if filename != "" {
+		stored = append([]string{filename}, roleFiles...)
+	}
+	var spf string // Received-SPF header, evaluated outside of the write slot
+	if receivedSPF && len(stored) > 0 {
+		spf = spfHeader(remoteAddr, from)
+	}
+	if len(stored) > 0 {
+		for _, path := range stored {
+			if err = checkDiskSpace(path); err != nil {
+				reason := err.Error()
+				if err == errDiskFull {
+					reason = "less than " + diskMinFree.String() + " of free disk space"
+				}
+				logRejection(remoteAddr, from, to, "disk", reason)
+				return err
+			}
+		}
+		if err = acquireWriteSlot(); err != nil {
+			logRejection(remoteAddr, from, to, "write_busy", fmt.Sprintf("no storage write slot within %v", srv.Timeout))
+			return err
+		}
+	}
+
+	var bcc bool
+	var headerRcpts []string
+	if bccDetectLog || bccInjectHeader {
+		headerRcpts = headerRecipients(data[payloadStart(data):])
+		bcc = bccRecipients(to, headerRcpts)
 	}
 
 	// log output
 	if !logQuiet || smtpd.Debug {
-		logString := fmt.Sprintf(logFormatHead, remoteAddr, from, to)
+		logString := fmt.Sprintf(logFormatHead, remoteAddr, from, to) + sessionField(remoteAddr) + geoFields(remoteAddr)
+		if logEntropy {
+			logString = fmt.Sprintf("%s, entropy: %.2f", logString, entropy)
+		}
+		if dsnLog {
+			logString += dsnFields(remoteAddr)
+		}
+		if envelopeSizeLog {
+			logString = fmt.Sprintf("%s, envelope_bytes: %d, body_bytes: %d", logString, envelopeBytes, len(data))
+		}
+		if bccDetectLog && bcc {
+			logString = fmt.Sprintf("%s, bcc_detected: envelope: %v, header: %v", logString, to, headerRcpts)
+		}
+		if logTLS {
+			cipher, sni := tlsInfo(remoteAddr)
+			logString = fmt.Sprintf("%s, TLS: %s, SNI: %s", logString, cipher, sni)
+		}
 		if filename != "" {
 			logString = fmt.Sprintf("%s mail data: \"%s\"", logString, filename)
+		} else if discarded {
+			logString += ", not stored: no recipient matches -store-only-rcpt"
+		}
+		if len(roleFiles) > 0 {
+			logString = fmt.Sprintf("%s, role mail data: %q", logString, roleFiles)
 		}
 		if logFull {
 			logString = fmt.Sprintf("%s\n%s%s", logString, data, dataEnd)
 		}
 		log.Print(logString)
 	}
+	var storedFile string // filename, once written
+	if len(stored) > 0 {
+		var headers bytes.Buffer
+		headers.WriteString(spf)
+		if addMissingMsgID && !hasMessageID(data[payloadStart(data):]) {
+			headers.WriteString(newMessageID())
+		}
+		if envelopeHeaders {
+			fmt.Fprintf(&headers, "Envelope-From: <%s>\r\n", from)
+			fmt.Fprintf(&headers, "Envelope-To: <%s>\r\n", strings.Join(to, ">, <"))
+		}
+		if bccInjectHeader && bcc {
+			headers.WriteString("X-BCC-Detected: true\r\n")
+		}
+		if dkimKey != nil {
+			signature, derr := dkimSign(data[payloadStart(data):], date)
+			if derr != nil {
+				log.Print(derr)
+			}
+			headers.Write(signature)
+		}
+		message := withHeaders(data, headers.Bytes())
+		if preludeTemplate != "" {
+			message = append(prelude(remoteAddr, from, to, date), message...)
+		}
+		if err = acquireFileSlot(remoteAddr, from, to); err != nil {
+			releaseWriteSlot()
+			logRejection(remoteAddr, from, to, "write_busy", fmt.Sprintf("no file write slot within %v", srv.Timeout))
+			return err
+		}
+		if filename != "" {
+			writeStart := time.Now()
+			ferr := storeMail(filename, message)
+			statsd.timing("write", time.Since(writeStart))
+			if ferr != nil {
+				log.Print(ferr)
+			} else {
+				storedFile = filename
+			}
+			if transcript && ferr == nil {
+				if terr := writeTranscript(remoteAddr, filename); terr != nil {
+					log.Print(terr)
+				}
+			}
+			if extractText && ferr == nil {
+				text, terr := plainText(data[payloadStart(data):])
+				if terr != nil && text == nil {
+					log.Printf(logFormatHead+", text not extracted: %v", remoteAddr, from, to, terr)
+				} else if terr != nil {
+					log.Printf(logFormatHead+", text part saved undecoded: %v", remoteAddr, from, to, terr)
+				}
+				if text != nil {
+					if terr = writeFile(filename+".txt", text, 0666); terr != nil {
+						log.Print(terr)
+					}
+				}
+			}
+		}
+		for _, path := range roleFiles {
+			if rerr := storeRoleMail(path, message); rerr != nil {
+				log.Print(rerr)
+			}
+		}
+		releaseFileSlot()
+		releaseWriteSlot()
+	}
 
-	if filename != "" {
-		ferr := os.WriteFile(filename, data, 0666)
-		if ferr != nil {
-			log.Print(ferr)
+	// The FIFO and the webhook get the mails once stored, so that a mail
+	// refused for lack of disk space is not delivered to them on each retry.
+	if fifoPath != "" && storeRcptMatch(to) && (filename == "" || storedFile != "") {
+		writeStart := time.Now()
+		if err = writeFIFO(data); err != nil {
+			logRejection(remoteAddr, from, to, "fifo", "FIFO write failed: "+err.Error())
+			return err
+		}
+		statsd.timing("fifo_write", time.Since(writeStart))
+	}
+
+	if webhookURL != "" && storeRcptMatch(to) && (filename == "" || storedFile != "") {
+		postStart := time.Now()
+		if err = postWebhook(from, to, data); err != nil {
+			logRejection(remoteAddr, from, to, "webhook", "webhook delivery failed: "+err.Error())
+			return errWebhook
+		}
+		statsd.timing("webhook_post", time.Since(postStart))
+	}
+	if attachmentDir != "" {
+		paths, aerr := extractAttachments(data[payloadStart(data):])
+		if aerr != nil {
+			log.Printf(logFormatHead+", attachments not extracted: %v", remoteAddr, from, to, aerr)
+		} else if len(paths) > 0 && (!logQuiet || smtpd.Debug) {
+			log.Printf(logFormatHead+", attachments: %q", remoteAddr, from, to, paths)
+		}
+	}
+	if (syslogger != nil || archiveDir != "" || indexPath != "") && !needFullDataHash {
+		var checksum [32]byte = sha256.Sum256(data)
+		dataChecksum = checksum[:]
+	}
+	if archiveDir != "" {
+		aerr := archive.append(&archiveRecord{
+			TS:      time.Now(),
+			From:    from,
+			To:      to,
+			Remote:  remoteAddr.String(),
+			Size:    len(data),
+			Hash:    hex.EncodeToString(dataChecksum),
+			Entropy: entropy,
+			Body:    data,
+		})
+		if aerr != nil {
+			log.Print(aerr)
+		}
+	}
+	if indexPath != "" && storedFile != "" {
+		ierr := msgIndex.append(&indexRecord{Hash: dataChecksum, TS: date, From: from, To: to, Path: storedFile})
+		if ierr != nil {
+			log.Print(ierr)
 		}
 	}
+	if syslogger != nil {
+		serr := syslogger.mailEvent(from, to, len(data), hex.EncodeToString(dataChecksum), fmt.Sprintf(logFormatHead, remoteAddr, from, to))
+		if serr != nil {
+			log.Print(serr)
+		}
+	}
+
+	return
+}
+
+// payloadStart returns the offset of the data received from the client,
+// after the Received header added by smtpd.
+func payloadStart(data []byte) (start int) {
+	for i := 0; i < 3; i++ {
+		start += bytes.Index(data[start:], []byte{'\n'})
+		start++
+	}
 	return
 }
 
+// withHeaders returns data with headers inserted after the Received header.
+func withHeaders(data []byte, headers []byte) []byte {
+	if len(headers) == 0 {
+		return data
+	}
+	start := payloadStart(data)
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + len(headers))
+	buffer.Write(data[:start])
+	buffer.Write(headers)
+	buffer.Write(data[start:])
+	return buffer.Bytes()
+}
+
 // ListenAndServe implemented and copied from smtpd to handle graceful shutdown.
 // Small fix in vendor in Shutdown (delete default, which speed up the loop...)
 func ListenAndServe() error {
@@ -237,13 +1126,18 @@ func ListenAndServe() error {
 
 	var err error
 
+	ln, err = net.Listen(listenNetwork, srv.Addr)
+	if err != nil {
+		return err
+	}
+	ln = &listener{Listener: ln}
+
 	// If TLSListener is enabled, listen for TLS connections only.
 	if srv.TLSConfig != nil && srv.TLSListener {
-		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
-	} else {
-		ln, err = net.Listen("tcp", srv.Addr)
+		ln = tls.NewListener(ln, srv.TLSConfig)
 	}
-	if err != nil {
+	if err = dropPrivileges(); err != nil {
+		ln.Close()
 		return err
 	}
 	return srv.Serve(ln)
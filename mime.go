@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	maxMIMEParts int // Maximum number of MIME entities walked in a message.
+	maxMIMEDepth int // Maximum nesting of multipart entities walked.
+)
+
+// errMIMELimit is wrapped by the errors of messages exceeding a MIME limit.
+var errMIMELimit = errors.New("MIME limit exceeded")
+
+// mimePart is a leaf entity of a MIME message, with its body decoded from
+// its Content-Transfer-Encoding. The body is left encoded if decoding failed
+// with decodeErr.
+type mimePart struct {
+	header    textproto.MIMEHeader
+	body      []byte
+	decodeErr error
+}
+
+// mimeParts returns the header of message and its leaf parts in their order
+// of appearance. A message without MIME structure is a single part.
+func mimeParts(message []byte) (mail.Header, []mimePart, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, nil, err
+	}
+	var w mimeWalker
+	parts, err := w.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	return msg.Header, parts, err
+}
+
+// messageID returns the Message-ID of a message as a file name element,
+// or a hash of the message when it has none.
+func messageID(header mail.Header, message []byte) string {
+	id := strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+	if id == "" {
+		sum := sha256.Sum256(message)
+		return hex.EncodeToString(sum[:16])
+	}
+	return sanitizeFileName(id)
+}
+
+// mimeWalker collects the leaf parts of a message within -max-mime-parts
+// and -max-mime-depth.
+type mimeWalker struct {
+	entities int
+}
+
+func (w *mimeWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int) ([]mimePart, error) {
+	if w.entities++; maxMIMEParts > 0 && w.entities > maxMIMEParts {
+		return nil, fmt.Errorf("%w: more than %d parts", errMIMELimit, maxMIMEParts)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		// Parts without a valid Content-Type are text/plain (RFC 2045 section 5.2).
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		content, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), raw)
+		if err != nil {
+			return []mimePart{{header: header, body: raw, decodeErr: err}}, nil
+		}
+		return []mimePart{{header: header, body: content}}, nil
+	}
+	if maxMIMEDepth > 0 && depth >= maxMIMEDepth {
+		return nil, fmt.Errorf("%w: multipart nested more than %d levels", errMIMELimit, maxMIMEDepth)
+	}
+	if params["boundary"] == "" {
+		return nil, errors.New("multipart entity without boundary")
+	}
+
+	var parts []mimePart
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		children, err := w.walk(p.Header, p, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, children...)
+	}
+}
+
+// decodeTransfer decodes raw from the given Content-Transfer-Encoding.
+func decodeTransfer(encoding string, raw []byte) ([]byte, error) {
+	var body io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: bytes.NewReader(raw)})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(bytes.NewReader(raw))
+	default:
+		return raw, nil
+	}
+	return io.ReadAll(body)
+}
+
+// base64Cleaner drops the line breaks and spaces of a base64 body.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	clean := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			clean = append(clean, b)
+		}
+	}
+	return len(clean), err
+}
+
+// fileName returns the file name of a part, from its Content-Disposition
+// or its Content-Type name parameter. It is empty for non-attachment parts.
+func (p *mimePart) fileName() string {
+	disposition, params, _ := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+	name := params["filename"]
+	if name == "" {
+		_, params, _ = mime.ParseMediaType(p.header.Get("Content-Type"))
+		name = params["name"]
+	}
+	if name == "" && disposition == "attachment" {
+		name = "attachment"
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// sanitizeFileName turns name into a single path element safe to create.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	name = strings.TrimLeft(pathUnsafeReplacer.Replace(name), ".")
+	if len(name) > 200 {
+		name = name[len(name)-200:]
+	}
+	if name == "" {
+		name = "attachment"
+	}
+	return name
+}
+
+var attachmentDir string // Directory receiving extracted attachments.
+
+// extractAttachments writes the attachments of message to -extract-attachments,
+// named after the message ID and their file name. It returns the paths written.
+func extractAttachments(message []byte) ([]string, error) {
+	header, parts, err := mimeParts(message)
+	if errors.Is(err, errMIMELimit) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed MIME message: %w", err)
+	}
+	id := messageID(header, message)
+	var written []string
+	for _, part := range parts {
+		name := part.fileName()
+		if name == "" {
+			continue
+		}
+		if part.decodeErr != nil {
+			return written, fmt.Errorf("attachment %q: %w", name, part.decodeErr)
+		}
+		base := filepath.Join(attachmentDir, id+"_"+sanitizeFileName(name))
+		path := base
+		for i := 2; ; i++ {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if os.IsExist(err) {
+				path = fmt.Sprintf("%s-%d", base, i)
+				continue
+			}
+			if err != nil {
+				return written, err
+			}
+			_, err = f.Write(part.body)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return written, err
+			}
+			break
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+var extractText bool // Save the text/plain part of mails next to them.
+
+// plainText returns the first text/plain part of message, decoded and
+// converted to UTF-8, or nil if it has none. The body of a message that is
+// not valid MIME is returned as is, unless it exceeds a MIME limit. On
+// decoding errors the part is returned undecoded along with the error.
+func plainText(message []byte) ([]byte, error) {
+	_, parts, err := mimeParts(message)
+	if errors.Is(err, errMIMELimit) {
+		return nil, err
+	}
+	if err != nil {
+		_, body := splitMessage(message)
+		return body, fmt.Errorf("malformed MIME message: %w", err)
+	}
+	for _, part := range parts {
+		mediaType, params, _ := mime.ParseMediaType(part.header.Get("Content-Type"))
+		if part.header.Get("Content-Type") != "" && mediaType != "text/plain" || part.fileName() != "" {
+			continue
+		}
+		if part.decodeErr != nil {
+			return part.body, part.decodeErr
+		}
+		return toUTF8(params["charset"], part.body)
+	}
+	return nil, nil
+}
+
+// toUTF8 converts text from charset to UTF-8. Only ASCII, UTF-8, ISO-8859-1
+// and Windows-1252 are supported, text in other charsets is returned as is
+// with an error.
+func toUTF8(charset string, text []byte) ([]byte, error) {
+	switch strings.ToLower(charset) {
+	case "", "us-ascii", "ascii", "utf-8", "utf8":
+		return text, nil
+	case "iso-8859-1", "latin1", "l1", "windows-1252", "cp1252":
+		var b strings.Builder
+		for _, c := range text {
+			if c >= 0x80 && c < 0xa0 && strings.HasSuffix(strings.ToLower(charset), "1252") {
+				b.WriteRune(windows1252[c-0x80])
+			} else {
+				b.WriteRune(rune(c))
+			}
+		}
+		return []byte(b.String()), nil
+	}
+	return text, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// windows1252 maps the 0x80-0x9f bytes of Windows-1252, which differ from ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
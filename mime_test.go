@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"not mime",
+			"Subject: test\r\n\r\nHello.\r\n",
+			"Hello.\r\n"},
+		{"quoted-printable",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Caf=C3=A9 cr=C3=A8me, a line soft broken by the =\r\nencoder.\r\n",
+			"Café crème, a line soft broken by the encoder.\r\n"},
+		{"quoted-printable latin1",
+			"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: Quoted-Printable\r\n\r\nCaf=E9\r\n",
+			"Café\r\n"},
+		{"base64 multipart",
+			"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>Hello.</p>\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+				"SGVsbG8sIHdv\r\ncmxkIOKAlCBi\r\nYXNlNjQu\r\n" +
+				"--b--\r\n",
+			"Hello, world — base64."},
+	}
+	for _, tt := range tests {
+		got, err := plainText([]byte(tt.message))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	message := "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nnot base64!\r\n"
+	got, err := plainText([]byte(message))
+	if err == nil || !strings.HasPrefix(string(got), "not base64!") {
+		t.Errorf("invalid base64: got %q, %v, want the undecoded body and an error", got, err)
+	}
+}
+
+func TestExtractAttachments(t *testing.T) {
+	defer func(dir string) { attachmentDir = dir }(attachmentDir)
+	attachmentDir = t.TempDir()
+
+	message := "Message-ID: <1234@client.example.org>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+		"--b\r\nContent-Type: text/plain; name=notes.txt\r\nContent-Disposition: attachment; filename=\"../notes.txt\"\r\n\r\n" +
+		"Some notes.\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"report.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\nAAECAw==\r\n" +
+		"--b--\r\n"
+	paths, err := extractAttachments([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, content string }{
+		{"1234@client.example.org_notes.txt", "Some notes."},
+		{"1234@client.example.org_report.bin", "\x00\x01\x02\x03"},
+	}
+	if len(paths) != len(want) {
+		t.Fatalf("extracted %v, want %d attachments", paths, len(want))
+	}
+	for i, w := range want {
+		if paths[i] != filepath.Join(attachmentDir, w.name) {
+			t.Errorf("attachment %d: path %s, want %s", i, paths[i], w.name)
+		}
+		if data, err := os.ReadFile(paths[i]); err != nil || string(data) != w.content {
+			t.Errorf("attachment %d: content %q, %v, want %q", i, data, err, w.content)
+		}
+	}
+
+	// A message extracted again does not overwrite its attachments.
+	paths, err = extractAttachments([]byte(message))
+	if err != nil || len(paths) != 2 || paths[0] != filepath.Join(attachmentDir, want[0].name+"-2") {
+		t.Errorf("extracted again: %v, %v", paths, err)
+	}
+}
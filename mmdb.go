@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataStart marks the metadata section at the end of a MaxMind DB.
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is a MaxMind DB file, format version 2, loaded in memory.
+type mmdb struct {
+	path       string
+	tree       []byte // binary search tree of the IP bits
+	data       []byte // data section, the tree records point to
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node of ::/96, where IPv4 lookups start in an IPv6 tree
+	ipVersion  uint
+}
+
+// openMMDB reads the MaxMind DB at path.
+func openMMDB(path string) (*mmdb, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(file, mmdbMetadataStart)
+	if i == -1 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB, no metadata", path)
+	}
+	db := &mmdb{path: path}
+	meta, _, err := db.decode(file[i+len(mmdbMetadataStart):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %v", path, err)
+	}
+	fields, _ := meta.(map[string]interface{})
+	if major, _ := fields["binary_format_major_version"].(uint64); major != 2 {
+		return nil, fmt.Errorf("%s: unsupported format version %v", path, fields["binary_format_major_version"])
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	db.tree = file[:treeSize]
+	db.data = file[treeSize+16 : i]
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node uint, bit byte) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+uint(bit)*4:]))
+	}
+}
+
+// lookup returns the data of the network holding ip, nil when there is none.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	bits := ip.To4()
+	node := uint(0)
+	if bits != nil && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if bits == nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		bits = ip.To16()
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-uint(i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, fmt.Errorf("%s: invalid data pointer", db.path)
+	}
+	value, _, err := db.decode(db.data, offset, 0)
+	return value, err
+}
+
+var errMMDBCorrupt = errors.New("corrupt data section")
+
+// mmdbMaxDepth bounds the nesting of maps, arrays and pointers, so that
+// pointer loops of a corrupt file do not recurse forever.
+const mmdbMaxDepth = 64
+
+// decode decodes the value at offset of section, nested depth levels
+// deep, returning the offset following it. Maps are decoded as
+// map[string]interface{}, arrays as []interface{} and unsigned integers as
+// uint64.
+func (db *mmdb) decode(section []byte, offset uint, depth int) (interface{}, uint, error) {
+	if offset >= uint(len(section)) || depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := section[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == 1 { // pointer
+		size := uint(ctrl>>3) & 3
+		if offset+size+1 > uint(len(section)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		var target uint
+		if size < 3 {
+			target = uint(ctrl & 7)
+		}
+		for _, b := range section[offset : offset+size+1] {
+			target = target<<8 | uint(b)
+		}
+		target += []uint{0, 2048, 526336, 0}[size]
+		value, _, err := db.decode(section, target, depth+1)
+		return value, offset + size + 1, err
+	}
+	if kind == 0 { // extended type
+		if offset >= uint(len(section)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		kind = 7 + uint(section[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(section)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := uint(0)
+		for _, b := range section[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+	switch kind {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := db.decode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := db.decode(section, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[k], offset = value, next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := db.decode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, value), next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(section)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := section[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case 4, 10: // bytes, uint128
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
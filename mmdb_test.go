@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The helpers below encode MaxMind DB values and files as described by the
+// format specification, https://maxmind.github.io/MaxMind-DB/.
+
+func mmdbString(v string) []byte {
+	return append([]byte{2<<5 | byte(len(v))}, v...)
+}
+
+func mmdbUint32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	b = bytes.TrimLeft(b, "\x00")
+	return append([]byte{6<<5 | byte(len(b))}, b...)
+}
+
+func mmdbUint64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	b = bytes.TrimLeft(b, "\x00")
+	return append([]byte{byte(len(b)), 9 - 7}, b...) // extended type
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	m := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		m = append(m, p...)
+	}
+	return m
+}
+
+func mmdbPointer(offset int) []byte {
+	return []byte{1<<5 | byte(offset>>8), byte(offset)}
+}
+
+// testNetwork is a network of a test database and the offset of its data.
+type testNetwork struct {
+	cidr   string
+	offset int
+}
+
+// writeTestMMDB writes a database of ipVersion with the given record size.
+// IPv4 networks of an IPv6 database are stored under ::/96.
+func writeTestMMDB(t *testing.T, recordSize, ipVersion int, data []byte, networks ...testNetwork) string {
+	t.Helper()
+	nodes := [][2]int{{-1, -1}}
+	type leaf struct{ node, bit, offset int }
+	var leaves []leaf
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipVersion == 4 {
+			ip = ipNet.IP.To4()
+		} else if ipNet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8] >> (7 - uint(i%8)) & 1)
+			if i == ones-1 {
+				leaves = append(leaves, leaf{node, bit, n.offset})
+				break
+			}
+			if nodes[node][bit] == -1 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	count := len(nodes)
+	for _, l := range leaves {
+		nodes[l.node][l.bit] = count + 16 + l.offset
+	}
+
+	var file bytes.Buffer
+	for _, n := range nodes {
+		for i := range n {
+			if n[i] == -1 {
+				n[i] = count
+			}
+		}
+		switch recordSize {
+		case 24:
+			file.Write([]byte{byte(n[0] >> 16), byte(n[0] >> 8), byte(n[0]), byte(n[1] >> 16), byte(n[1] >> 8), byte(n[1])})
+		case 28:
+			file.Write([]byte{byte(n[0] >> 16), byte(n[0] >> 8), byte(n[0]), byte(n[0]>>24)<<4 | byte(n[1]>>24), byte(n[1] >> 16), byte(n[1] >> 8), byte(n[1])})
+		case 32:
+			binary.Write(&file, binary.BigEndian, [2]uint32{uint32(n[0]), uint32(n[1])})
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(data)
+	file.Write(mmdbMetadataStart)
+	file.Write(mmdbMap(
+		mmdbString("binary_format_major_version"), mmdbUint32(2),
+		mmdbString("binary_format_minor_version"), mmdbUint32(0),
+		mmdbString("build_epoch"), mmdbUint64(1700000000),
+		mmdbString("database_type"), mmdbString("Test"),
+		mmdbString("ip_version"), mmdbUint32(uint32(ipVersion)),
+		mmdbString("node_count"), mmdbUint32(uint32(count)),
+		mmdbString("record_size"), mmdbUint32(uint32(recordSize)),
+	))
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testCountryData is the data section of a country database whose records
+// point to shared country maps, and share a key, as GeoIP2 databases do.
+func testCountryData() (data []byte, fr, de, us int) {
+	frCountry := len(data)
+	data = append(data, mmdbMap(mmdbString("iso_code"), mmdbString("FR"))...)
+	deCountry := len(data)
+	data = append(data, mmdbMap(mmdbString("iso_code"), mmdbString("DE"))...)
+	fr = len(data)
+	data = append(data, mmdbMap(mmdbString("country"), mmdbPointer(frCountry))...)
+	de = len(data)
+	data = append(data, mmdbMap(mmdbPointer(fr+1), mmdbPointer(deCountry))...)
+	us = len(data)
+	data = append(data, mmdbMap(mmdbString("registered_country"), mmdbMap(mmdbString("iso_code"), mmdbString("US")))...)
+	return data, fr, de, us
+}
+
+func TestMMDBLookup(t *testing.T) {
+	data, fr, de, us := testCountryData()
+	for _, size := range []int{24, 28, 32} {
+		path := writeTestMMDB(t, size, 6, data,
+			testNetwork{"127.0.0.0/8", fr},
+			testNetwork{"192.0.2.128/25", de},
+			testNetwork{"2001:db8::/32", us})
+		db, err := openMMDB(path)
+		if err != nil {
+			t.Fatalf("record size %d: %v", size, err)
+		}
+		for ip, want := range map[string]string{
+			"127.0.0.1":      "FR",
+			"127.255.0.9":    "FR",
+			"192.0.2.200":    "DE",
+			"192.0.2.1":      "",
+			"10.0.0.1":       "",
+			"2001:db8::cb01": "US",
+			"2001:db9::1":    "",
+		} {
+			value, err := db.lookup(net.ParseIP(ip))
+			if err != nil {
+				t.Fatalf("record size %d: %s: %v", size, ip, err)
+			}
+			fields, _ := value.(map[string]interface{})
+			if got := countryCode(fields); got != want {
+				t.Errorf("record size %d: %s: got %q, want %q", size, ip, got, want)
+			}
+		}
+	}
+}
+
+func TestMMDBIPv4(t *testing.T) {
+	data := mmdbMap(mmdbString("autonomous_system_number"), mmdbUint32(64500))
+	db, err := openMMDB(writeTestMMDB(t, 24, 4, data, testNetwork{"198.51.100.0/24", 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.lookup(net.ParseIP("198.51.100.7"))
+	if fields, _ := value.(map[string]interface{}); err != nil || fields["autonomous_system_number"] != uint64(64500) {
+		t.Errorf("got %v, %v", value, err)
+	}
+	if value, err := db.lookup(net.ParseIP("2001:db8::1")); value != nil || err != nil {
+		t.Errorf("IPv6 in an IPv4 database: got %v, %v", value, err)
+	}
+}
+
+func TestMMDBCorrupt(t *testing.T) {
+	loop := mmdbPointer(0) // a pointer to itself
+	db, err := openMMDB(writeTestMMDB(t, 24, 6, loop, testNetwork{"127.0.0.0/8", 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.lookup(net.ParseIP("127.0.0.1")); err != errMMDBCorrupt {
+		t.Errorf("pointer loop: got %v, want %v", err, errMMDBCorrupt)
+	}
+
+	truncated := mmdbMap(mmdbString("iso_code"), mmdbString("FR"))
+	db, err = openMMDB(writeTestMMDB(t, 24, 6, truncated[:len(truncated)-1], testNetwork{"127.0.0.0/8", 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.lookup(net.ParseIP("127.0.0.1")); err != errMMDBCorrupt {
+		t.Errorf("truncated data: got %v, want %v", err, errMMDBCorrupt)
+	}
+
+	path := filepath.Join(t.TempDir(), "empty.mmdb")
+	os.WriteFile(path, []byte("not a database"), 0600)
+	if _, err := openMMDB(path); err == nil {
+		t.Error("file without metadata opened")
+	}
+}
+
+func TestGeoLookup(t *testing.T) {
+	data, fr, _, _ := testCountryData()
+	country, err := openMMDB(writeTestMMDB(t, 28, 6, data, testNetwork{"127.0.0.0/8", fr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asn, err := openMMDB(writeTestMMDB(t, 24, 4, mmdbMap(mmdbString("autonomous_system_number"), mmdbUint32(64500)), testNetwork{"127.0.0.0/16", 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*mmdb) { geoIPDBs = saved }(geoIPDBs)
+	geoIPDBs = []*mmdb{country, asn}
+	geoCache = make(map[string]geoInfo)
+
+	for ip, want := range map[string]string{
+		"127.0.0.1": ", country: FR, asn: 64500",
+		"127.1.0.1": ", country: FR, asn: -",
+		"10.0.0.1":  ", country: -, asn: -",
+	} {
+		if got := geoFields(&net.TCPAddr{IP: net.ParseIP(ip)}); got != want {
+			t.Errorf("%s: got %q, want %q", ip, got, want)
+		}
+	}
+}
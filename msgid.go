@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	requireMsgID    bool // Reject mails without Message-ID header.
+	addMissingMsgID bool // Add a Message-ID header to mails without one.
+)
+
+var errMsgIDRequired = errors.New("554 5.6.0 Message-ID header required")
+
+// hasMessageID reports whether the header block of payload has a Message-ID
+// header.
+func hasMessageID(payload []byte) bool {
+	for len(payload) > 0 {
+		line := payload
+		if i := bytes.IndexByte(payload, '\n'); i != -1 {
+			line, payload = payload[:i], payload[i+1:]
+		} else {
+			payload = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if len(line) > 11 && bytes.EqualFold(line[:11], []byte("message-id:")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMessageID refuses mails without Message-ID header when -require-msg-id
+// is set.
+func checkMessageID(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	if !requireMsgID || hasMessageID(data[payloadStart(data):]) {
+		return nil
+	}
+	logRejection(remoteAddr, from, to, "msgid", "no Message-ID header")
+	return errMsgIDRequired
+}
+
+// newMessageID returns a Message-ID header made of a random UUID and the
+// server hostname.
+func newMessageID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("Message-ID: <%x-%x-%x-%x-%x@%s>\r\n", u[:4], u[4:6], u[6:8], u[8:10], u[10:], srv.Hostname)
+}
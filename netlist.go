@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"smtp_receiver/smtpd"
+)
+
+// netList is a flag of comma separated networks in CIDR notation, a bare IP
+// address being a network of its own. It can be repeated.
+type netList []*net.IPNet
+
+func (l *netList) String() string {
+	if l == nil {
+		return ""
+	}
+	var nets []string
+	for _, n := range *l {
+		nets = append(nets, n.String())
+	}
+	return strings.Join(nets, ",")
+}
+
+func (l *netList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		n, err := parseNet(strings.TrimSpace(field))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// contains reports whether ip belongs to one of the networks.
+func (l netList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNet parses a network in CIDR notation or a single IP address.
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// remoteIP returns the IP address of a remote address, nil if it has none.
+func remoteIP(addr net.Addr) net.IP {
+	if peer, ok := addr.(*smtpd.Peer); ok {
+		addr = peer.Addr
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	rejectNullMX   bool          // Refuse senders whose domain publishes a null MX.
+	mxCheckTimeout time.Duration // Time given to the MX lookup of a sender domain.
+
+	nullMXResolver = net.DefaultResolver
+)
+
+var errNullMX = errors.New("550 5.7.27 Sender domain has null MX record")
+
+// checkNullMX refuses senders whose domain publishes the RFC 7505 null MX,
+// "0 .", telling it sends no mail. Lookup failures accept the sender.
+func checkNullMX(remoteAddr net.Addr, from string) error {
+	domain := domainOf(from)
+	if domain == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mxCheckTimeout)
+	defer cancel()
+	mxs, err := nullMXResolver.LookupMX(ctx, domain)
+	if err != nil {
+		if smtpd.Debug && !isNotFound(err) {
+			log.Printf("WARNING: remote: %v, MAIL From: <%s>, null MX check skipped: %v", remoteAddr, from, err)
+		}
+		return nil
+	}
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		logRejection(remoteAddr, from, nil, "null_mx", "sender domain "+strings.ToLower(domain)+" has a null MX")
+		return errNullMX
+	}
+	return nil
+}
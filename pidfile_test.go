@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp_receiver.pid")
+	self := strconv.Itoa(os.Getpid()) + "\n"
+
+	if err := writePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != self {
+		t.Errorf("created: got %q, want %q", content, self)
+	}
+	if err := removePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("not cleaned up: %v", err)
+	}
+
+	// A stale file is replaced, the one of a running process is kept.
+	os.WriteFile(path, []byte("999999999\n"), 0644)
+	if err := writePidFile(path); err != nil {
+		t.Errorf("stale file: %v", err)
+	}
+	running := strconv.Itoa(os.Getppid()) + "\n"
+	os.WriteFile(path, []byte(running), 0644)
+	if err := writePidFile(path); err == nil {
+		t.Error("file of a running process replaced")
+	}
+	if err := removePidFile(path); err == nil {
+		t.Error("file of another process removed")
+	}
+	if content, _ := os.ReadFile(path); string(content) != running {
+		t.Errorf("file of another process: got %q", content)
+	}
+}
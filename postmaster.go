@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	postmasterPath string // Directory receiving the mails to postmaster@.
+	abusePath      string // Directory receiving the mails to abuse@.
+)
+
+// roleDir returns the directory of the RFC 2142 role mailbox of rcpt, if
+// one is configured for it.
+func roleDir(rcpt string) string {
+	local := routingAddr(rcpt)
+	if i := strings.LastIndexByte(local, '@'); i != -1 {
+		local = local[:i]
+	}
+	switch strings.ToLower(local) {
+	case "postmaster":
+		return postmasterPath
+	case "abuse":
+		return abusePath
+	}
+	return ""
+}
+
+// roleRecipients returns the distinct role directories of the recipients,
+// and whether some recipients are not role mailboxes.
+func roleRecipients(to []string) (dirs []string, others bool) {
+	for _, rcpt := range to {
+		dir := roleDir(rcpt)
+		if dir == "" {
+			others = true
+			continue
+		}
+		seen := false
+		for _, d := range dirs {
+			seen = seen || d == dir
+		}
+		if !seen {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, others
+}
+
+// checkRoleDirs verifies the -postmaster-path and -abuse-path directories
+// are writable.
+func checkRoleDirs() error {
+	// Paths are relative to the chroot, checked once privileges are dropped.
+	if chrootDir != "" {
+		return nil
+	}
+	for flagName, dir := range map[string]string{"postmaster-path": postmasterPath, "abuse-path": abusePath} {
+		if dir == "" {
+			continue
+		}
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("-%s is not writable: %w", flagName, err)
+		}
+	}
+	return nil
+}
+
+// rolePaths returns the files to write in dirs. They keep the path of
+// filename, made relative, so that they are as unique as the -fileformat
+// files, or are named after the reception date when no -fileformat is set.
+func rolePaths(dirs []string, filename string, nano int64) []string {
+	// Cleaned as an absolute path, filename cannot climb out of the directories.
+	name := filepath.Clean(string(filepath.Separator) + filename)
+	if filename == "" {
+		name = fmt.Sprintf("%d.eml", nano)
+	}
+	paths := make([]string, len(dirs))
+	for i, dir := range dirs {
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths
+}
+
+// storeRoleMail stores a mail in a role directory, creating the
+// directories of its -fileformat path.
+func storeRoleMail(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return storeMail(path, data)
+}
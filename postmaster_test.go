@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRoleDir(t *testing.T) {
+	defer func(postmaster, abuse string) { postmasterPath, abusePath = postmaster, abuse }(postmasterPath, abusePath)
+	postmasterPath, abusePath = "/var/mail/postmaster", "/var/mail/abuse"
+
+	for rcpt, want := range map[string]string{
+		"postmaster@example.com":  postmasterPath,
+		"POSTMASTER@EXAMPLE.COM":  postmasterPath,
+		"PostMaster@Example.com":  postmasterPath,
+		"Postmaster":              postmasterPath,
+		"abuse@example.com":       abusePath,
+		"ABUSE@example.org":       abusePath,
+		"user@example.com":        "",
+		"postmasters@example.com": "",
+		"user@postmaster":         "",
+	} {
+		if got := roleDir(rcpt); got != want {
+			t.Errorf("roleDir(%q) = %q, want %q", rcpt, got, want)
+		}
+	}
+
+	dirs, others := roleRecipients([]string{"postmaster@example.com", "user@example.com", "POSTMASTER@EXAMPLE.COM", "Abuse@example.com"})
+	if len(dirs) != 2 || dirs[0] != postmasterPath || dirs[1] != abusePath || !others {
+		t.Errorf("mixed recipients: %q, %v", dirs, others)
+	}
+	dirs, others = roleRecipients([]string{"Postmaster@example.com", "postmaster@example.org"})
+	if len(dirs) != 1 || dirs[0] != postmasterPath || others {
+		t.Errorf("postmaster recipients: %q, %v", dirs, others)
+	}
+
+	abusePath = ""
+	if dir := roleDir("abuse@example.com"); dir != "" {
+		t.Errorf("abuse@ without -abuse-path: %q", dir)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var preludeTemplate string // Comma separated fields of the metadata prelude of the stored files.
+
+// preludeFields are the fields -prelude may list, in lowercase.
+var preludeFields = map[string]string{
+	"from":     "From",
+	"to":       "To",
+	"remote":   "Remote",
+	"received": "Received",
+}
+
+// checkPrelude validates the -prelude fields.
+func checkPrelude() error {
+	for _, field := range strings.Split(preludeTemplate, ",") {
+		if _, ok := preludeFields[strings.ToLower(strings.TrimSpace(field))]; !ok {
+			return fmt.Errorf("-prelude: unknown field %q, must be from, to, remote or received", field)
+		}
+	}
+	return nil
+}
+
+// prelude returns the metadata lines of -prelude, in its order, followed by
+// the blank line separating them from the message.
+func prelude(remoteAddr net.Addr, from string, to []string, date time.Time) []byte {
+	var b bytes.Buffer
+	for _, field := range strings.Split(preludeTemplate, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		var value string
+		switch field {
+		case "from":
+			value = from
+		case "to":
+			value = strings.Join(to, ", ")
+		case "remote":
+			value = remoteIP(remoteAddr).String()
+		case "received":
+			value = date.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", preludeFields[field], value)
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// stripPrelude returns the message following the prelude of a stored file,
+// which is what the hashes of -fileformat are computed on.
+func stripPrelude(data []byte) []byte {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[i+4:]
+	}
+	return data
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "errors"
+
+// dropPrivileges is only supported on Unix systems.
+func dropPrivileges() error {
+	if runUser == "" && runGroup == "" && chrootDir == "" {
+		return nil
+	}
+	return errors.New("-user, -group and -chroot are not supported on this platform")
+}
@@ -0,0 +1,64 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges chroots and switches to the configured user and group.
+// It is meant to be called once the listening socket is bound.
+func dropPrivileges() error {
+	if runUser == "" && runGroup == "" && chrootDir == "" {
+		return nil
+	}
+
+	// Lookups must happen before the chroot hides /etc.
+	uid, gid := -1, -1
+	if runUser != "" {
+		u, err := user.Lookup(runUser)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if runGroup != "" {
+		g, err := user.LookupGroup(runGroup)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			return fmt.Errorf("chroot %s: %w", chrootDir, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	log.Printf("Privileges dropped: uid=%d gid=%d", os.Geteuid(), os.Getegid())
+
+	return checkOutputDir()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var dataProgress byteSize // Mail data bytes between two progress log lines.
+
+var sizeParamRE = regexp.MustCompile(`(?i)\sSIZE=(\d+)`)
+
+// progressConn logs the progress of the mail data received from the client
+// every -data-progress-interval bytes. Commands are followed until
+// STARTTLS, encrypted mail data is not reported. Pipelined commands are
+// queued until their reply is seen.
+type progressConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	line     []byte   // incomplete client line
+	pending  []string // commands whose reply is not seen yet, "." for the end of data
+	rcpts    int      // recipients accepted in the transaction
+	size     int64    // SIZE announced with MAIL FROM, -1 if none
+	data     bool     // receiving mail data
+	midLine  bool     // the start of the current mail data line was counted
+	blind    bool     // TLS started
+	received int64    // mail data bytes received
+	next     int64    // received count of the next progress line
+}
+
+func newProgressConn(conn net.Conn) net.Conn {
+	return &progressConn{Conn: conn, size: -1}
+}
+
+func (c *progressConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blind {
+		return n, err
+	}
+	c.line = append(c.line, b[:n]...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i == -1 {
+			break
+		}
+		line := c.line[:i+1]
+		c.line = c.line[i+1:]
+		if c.data {
+			if !c.midLine && string(bytes.TrimRight(line, "\r\n")) == "." {
+				c.data = false
+				// LMTP replies once per accepted recipient.
+				replies := 1
+				if srv.LMTP && c.rcpts > 1 {
+					replies = c.rcpts
+				}
+				for ; replies > 0; replies-- {
+					c.pending = append(c.pending, ".")
+				}
+				continue
+			}
+			c.midLine = false
+			c.count(len(line))
+			continue
+		}
+		command := strings.TrimRight(string(line), "\r\n")
+		verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+		c.pending = append(c.pending, verb)
+		switch verb {
+		case "MAIL":
+			c.size, c.rcpts = -1, 0
+			if m := sizeParamRE.FindStringSubmatch(command); m != nil {
+				c.size, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+		case "RSET", "HELO", "EHLO", "LHLO":
+			c.size, c.rcpts = -1, 0
+		}
+	}
+	// Count the start of a line longer than the end of data marker instead
+	// of keeping it.
+	if c.data && len(c.line) > len(".\r\n") {
+		c.count(len(c.line))
+		c.line = c.line[:0]
+		c.midLine = true
+	}
+	return n, err
+}
+
+// count accounts n bytes of mail data, logging the progress every
+// -data-progress-interval bytes.
+func (c *progressConn) count(n int) {
+	c.received += int64(n)
+	if c.received >= c.next {
+		c.logProgress()
+		for c.next <= c.received {
+			c.next += int64(dataProgress)
+		}
+	}
+}
+
+// Write matches each reply with the oldest pending command. Replies to no
+// command, as the banner, are ignored.
+func (c *progressConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) < 3 || len(line) > 3 && line[3] == '-' || len(c.pending) == 0 {
+			continue
+		}
+		command := c.pending[0]
+		c.pending = c.pending[1:]
+		switch {
+		case command == "RCPT" && line[0] == '2':
+			c.rcpts++
+		case command == "DATA" && bytes.HasPrefix(line, []byte("354")):
+			c.data, c.received, c.next = true, 0, int64(dataProgress)
+		case command == "STARTTLS" && bytes.HasPrefix(line, []byte("220")):
+			c.blind = true
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// logProgress logs the mail data received so far, out of the announced
+// SIZE if any.
+func (c *progressConn) logProgress() {
+	if c.size >= 0 {
+		log.Printf("remote: %v, DATA in progress: %d/%d bytes", c.RemoteAddr(), c.received, c.size)
+	} else {
+		log.Printf("remote: %v, DATA in progress: %d bytes", c.RemoteAddr(), c.received)
+	}
+}
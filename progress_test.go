@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// TestDataProgress delivers 1MB in 1KB chunks after pipelined MAIL, RCPT
+// and DATA commands, and checks that a progress line is logged every 256KB.
+func TestDataProgress(t *testing.T) {
+	defer func(interval byteSize) { dataProgress = interval }(dataProgress)
+	dataProgress = 256 << 10
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan int, 1)
+	server := &smtpd.Server{Hostname: "mx.example.com", MaxSize: 2 << 20,
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			delivered <- len(data)
+			return nil
+		}}
+	go server.Serve(&listener{Listener: ln})
+	defer ln.Close()
+
+	c, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.ReadResponse(220)
+	c.PrintfLine("EHLO client.example.org")
+	c.ReadResponse(250)
+	const size = 1 << 20
+	c.PrintfLine("MAIL FROM:<sender@example.org> SIZE=%d\r\nRCPT TO:<user@example.com>\r\nDATA", size)
+	for _, code := range []int{250, 250, 354} {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("pipelined reply %d: %s: %v", code, msg, err)
+		}
+	}
+	chunk := []byte(strings.Repeat("x", 1022) + "\r\n")
+	for i := 0; i < size/len(chunk); i++ {
+		c.W.Write(chunk)
+		c.W.Flush()
+		time.Sleep(100 * time.Microsecond)
+	}
+	c.PrintfLine(".")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("end of data: %s: %v", msg, err)
+	}
+	<-delivered
+
+	progress := regexp.MustCompile(`DATA in progress: (\d+)/1048576 bytes`).FindAllStringSubmatch(logs.String(), -1)
+	if len(progress) != 4 {
+		t.Fatalf("got %d progress lines, want 4:\n%s", len(progress), logs.String())
+	}
+	for i, m := range progress {
+		if n, _ := strconv.Atoi(m[1]); n < (i+1)*int(dataProgress) || n >= (i+1)*int(dataProgress)+len(chunk) {
+			t.Errorf("progress line %d: %s bytes", i+1, m[1])
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var protocolLogDir string // Directory of the per connection protocol dumps.
+
+// protocolChunk is a piece of data seen on a connection.
+type protocolChunk struct {
+	at     time.Time
+	client bool
+	data   []byte
+}
+
+// protocolLogConn dumps the bytes exchanged on a connection to a file,
+// written from a separate goroutine so the session is never slowed down.
+type protocolLogConn struct {
+	net.Conn
+	chunks  chan protocolChunk
+	dropped uint64        // atomic count of chunks lost because the writer lagged
+	closed  chan struct{} // closed by Close, chunks is never closed
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newProtocolLogConn starts dumping conn to a new file of -protocol-log-dir,
+// named after the connection id.
+func newProtocolLogConn(conn net.Conn, id string) (net.Conn, error) {
+	now := time.Now()
+	f, err := os.OpenFile(filepath.Join(protocolLogDir, id+".pcap.txt"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return conn, err
+	}
+	c := &protocolLogConn{
+		Conn:   conn,
+		chunks: make(chan protocolChunk, 1024),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "[%s] connection from %v to %v\n", now.Format("15:04:05.000"), conn.RemoteAddr(), conn.LocalAddr())
+	go func() {
+		defer close(c.done)
+		for c.dump(w) {
+		}
+		if n := atomic.LoadUint64(&c.dropped); n > 0 {
+			fmt.Fprintf(w, "%d chunks not logged\n", n)
+		}
+		fmt.Fprintf(w, "[%s] connection closed\n", time.Now().Format("15:04:05.000"))
+		if err := w.Flush(); err != nil {
+			log.Printf("WARNING: protocol log %s: %v", f.Name(), err)
+		}
+		f.Close()
+	}()
+	return c, nil
+}
+
+// dump writes the next chunk, or the chunks left once the connection is
+// closed. It returns false when done.
+func (c *protocolLogConn) dump(w *bufio.Writer) bool {
+	select {
+	case chunk := <-c.chunks:
+		dumpChunk(w, chunk)
+		return true
+	case <-c.closed:
+	}
+	for {
+		select {
+		case chunk := <-c.chunks:
+			dumpChunk(w, chunk)
+		default:
+			return false
+		}
+	}
+}
+
+// log queues a copy of b for the writer. Data seen after Close, as a
+// Read or Write racing with it may return, is not logged.
+func (c *protocolLogConn) log(client bool, b []byte) {
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	chunk := protocolChunk{at: time.Now(), client: client, data: append([]byte(nil), b...)}
+	select {
+	case c.chunks <- chunk:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+func (c *protocolLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.log(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *protocolLogConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.log(false, b[:n])
+	}
+	return n, err
+}
+
+func (c *protocolLogConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
+
+// dumpChunk writes chunk as lines of 16 bytes in hexadecimal and ASCII,
+// prefixed by the time and > for client or < for server data.
+func dumpChunk(w *bufio.Writer, chunk protocolChunk) {
+	direction := '<'
+	if chunk.client {
+		direction = '>'
+	}
+	stamp := chunk.at.Format("15:04:05.000")
+	for data := chunk.data; len(data) > 0; {
+		line := data
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		data = data[len(line):]
+
+		fmt.Fprintf(w, "[%s] %c", stamp, direction)
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(w, " %02x", line[i])
+			} else {
+				w.WriteString("   ")
+			}
+		}
+		w.WriteString("  ")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			w.WriteByte(b)
+		}
+		w.WriteByte('\n')
+	}
+}
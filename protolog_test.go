@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestProtocolLogClose closes the connection while it is written to, which
+// must neither panic nor lose the data logged before.
+func TestProtocolLogClose(t *testing.T) {
+	defer func(dir string) { protocolLogDir = dir }(protocolLogDir)
+	protocolLogDir = t.TempDir()
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := newProtocolLogConn(server, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("220 ready\r\n"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := conn.Write([]byte("250 ok\r\n")); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	conn.Close()
+	wg.Wait()
+	conn.(*protocolLogConn).log(false, []byte("after close"))
+	<-conn.(*protocolLogConn).done
+
+	dump, err := os.ReadFile(filepath.Join(protocolLogDir, "test.pcap.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "220 read") || !strings.HasSuffix(string(dump), "connection closed\n") {
+		t.Errorf("dump:\n%s", dump)
+	}
+}
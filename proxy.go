@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var trustedProxies netList // Peers allowed to give the client address with a PROXY header.
+
+// proxyHeaderTimeout bounds the wait for the PROXY header of trusted proxies,
+// sent at once by the proxies before any SMTP exchange.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1Prefix starts the text headers of PROXY protocol version 1,
+// proxyV2Signature the binary headers of version 2.
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+// proxyConn is a connection whose remote address was given by a PROXY
+// protocol header (version 1 or 2) or was checked for one.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	peeked bool // The data of an untrusted peer was checked for a PROXY header
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if !c.peeked {
+		c.peeked = true
+		c.stripUntrusted()
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acceptProxy reads the PROXY header a trusted proxy sends first, and
+// returns the connection with the client address it gives.
+func acceptProxy(conn net.Conn) (net.Conn, error) {
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr(), peeked: true}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	addr, err := readProxyHeader(c.r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		c.remote = addr
+		log.Printf("remote: %v, PROXY header accepted from %v", addr, conn.RemoteAddr())
+	}
+	return c, nil
+}
+
+// untrustedProxy returns conn checked for a PROXY header, which is ignored
+// as the peer is not a trusted proxy.
+func untrustedProxy(conn net.Conn) net.Conn {
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr()}
+}
+
+// stripUntrusted drops the PROXY header an untrusted peer starts with. The
+// peer may only speak after the banner, so this is done on its first read.
+// Read errors are left to the next read.
+func (c *proxyConn) stripUntrusted() {
+	switch {
+	case peekPrefix(c.r, proxyV1Prefix):
+		line, err := readProxyLine(c.r)
+		if err != nil {
+			log.Printf("SECURITY: remote: %v, malformed PROXY header from untrusted peer: %v", c.remote, err)
+			return
+		}
+		log.Printf("SECURITY: remote: %v, PROXY header ignored from untrusted peer: %q", c.remote, strings.TrimSpace(line))
+	case peekPrefix(c.r, proxyV2Signature):
+		addr, err := readProxyV2(c.r)
+		if err != nil {
+			log.Printf("SECURITY: remote: %v, malformed PROXY header from untrusted peer: %v", c.remote, err)
+			return
+		}
+		log.Printf("SECURITY: remote: %v, PROXY version 2 header ignored from untrusted peer, source: %v", c.remote, addr)
+	}
+}
+
+// peekPrefix reports whether r starts with prefix, peeking one byte more
+// at a time so that a peer sending less than prefix is not waited for.
+func peekPrefix(r *bufio.Reader, prefix string) bool {
+	for n := 1; n <= len(prefix); n++ {
+		b, err := r.Peek(n)
+		if err != nil || !strings.HasPrefix(prefix, string(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// readProxyHeader reads a PROXY header of either version and returns the
+// source address it gives, nil for the UNKNOWN protocol or LOCAL command.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(1); err == nil && b[0] == proxyV2Signature[0] {
+		return readProxyV2(r)
+	}
+	line, err := readProxyLine(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseProxyHeader(line)
+}
+
+// readProxyLine reads a PROXY header line, of at most 107 bytes.
+func readProxyLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for len(line) <= 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("reading PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			return string(line), nil
+		}
+	}
+	return "", errors.New("PROXY header too long")
+}
+
+// parseProxyHeader returns the source address of a PROXY protocol version 1
+// header, nil for the UNKNOWN protocol.
+func parseProxyHeader(line string) (net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("PROXY header not ended by CRLF")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("missing PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(line))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a PROXY protocol version 2 header and returns its
+// source address, nil for the LOCAL command and the families other than
+// TCP over IPv4 or IPv6.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	if string(hdr[:12]) != proxyV2Signature {
+		return nil, errors.New("missing PROXY header")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %w", err)
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", hdr[12]&0xf)
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("PROXY header addresses truncated")
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a PROXY version 2 header of the command and family bytes
+// carrying addrs.
+func proxyV2(command, family byte, addrs []byte) string {
+	hdr := []byte(proxyV2Signature)
+	hdr = append(hdr, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+var proxyV2TCP4 = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xd4, 0x31, 0, 25}
+
+var proxyV2TCP6 = append(append(append([]byte(nil),
+	net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0xd4, 0x31, 0, 25)
+
+var proxyTests = []struct {
+	name   string
+	header string
+	want   string // Source address, "<nil>" for none
+	err    string // Error substring, empty when the header is valid
+}{
+	{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\r\n", "192.0.2.1:54321", ""},
+	{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 54321 25\r\n", "[2001:db8::1]:54321", ""},
+	{"v1 unknown", "PROXY UNKNOWN\r\n", "<nil>", ""},
+	{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51", "", "EOF"},
+	{"v1 without crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 54321 25\n", "", "not ended by CRLF"},
+	{"v1 missing fields", "PROXY TCP4 192.0.2.1\r\n", "", "malformed"},
+	{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 54321 25\r\n", "", "invalid PROXY source address"},
+	{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", "", "invalid PROXY source port"},
+	{"v1 too long", "PROXY " + strings.Repeat("x", 120) + "\r\n", "", "too long"},
+	{"not proxy", "EHLO client.example.org\r\n", "", "missing PROXY header"},
+	{"v2 tcp4", proxyV2(1, 0x11, proxyV2TCP4), "192.0.2.1:54321", ""},
+	{"v2 tcp6", proxyV2(1, 0x21, proxyV2TCP6), "[2001:db8::1]:54321", ""},
+	{"v2 local", proxyV2(0, 0x00, nil), "<nil>", ""},
+	{"v2 unix", proxyV2(1, 0x31, make([]byte, 216)), "<nil>", ""},
+	{"v2 truncated header", proxyV2Signature + "\x21", "", "EOF"},
+	{"v2 truncated body", proxyV2(1, 0x11, proxyV2TCP4)[:20], "", "EOF"},
+	{"v2 short addresses", proxyV2(1, 0x21, proxyV2TCP4), "", "truncated"},
+	{"v2 bad version", strings.Replace(proxyV2(1, 0x11, proxyV2TCP4), "\x21", "\x11", 1), "", "unsupported PROXY version"},
+	{"v2 bad command", proxyV2(2, 0x11, proxyV2TCP4), "", "unsupported PROXY command"},
+}
+
+// proxySource formats the source address of a PROXY header.
+func proxySource(addr net.Addr) string {
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tt := range proxyTests {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.header)))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got := proxySource(addr); got != tt.want {
+			t.Errorf("%s: source %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range proxyTests {
+		data := tt.header
+		if tt.err == "" {
+			data += "EHLO client.example.org\r\n"
+		}
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, data)
+			client.Close()
+		}()
+		conn, err := acceptProxy(server)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("%s: connection accepted, want %q", tt.name, tt.err)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			server.Close()
+			continue
+		}
+		want := tt.want
+		if want == "<nil>" {
+			want = server.RemoteAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("%s: remote %s, want %s", tt.name, got, want)
+		}
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "EHLO client.example.org\r\n" {
+			t.Errorf("%s: read %q after the header", tt.name, line)
+		}
+		conn.Close()
+	}
+}
+
+func TestUntrustedProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range append(proxyTests, struct{ name, header, want, err string }{"no header", "", "", ""}) {
+		if tt.err != "" {
+			continue
+		}
+		client, server := net.Pipe()
+		go func(header string) {
+			io.WriteString(client, header+"EHLO client.example.org\r\n")
+			client.Close()
+		}(tt.header)
+		conn := untrustedProxy(server)
+		if got, want := conn.RemoteAddr(), server.RemoteAddr(); got != want {
+			t.Errorf("%s: remote %v, want the peer %v", tt.name, got, want)
+		}
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "EHLO client.example.org\r\n" {
+			t.Errorf("%s: read %q after the header", tt.name, line)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"smtp_receiver/smtpd"
+)
+
+var rcptQuotaFile string // File of "recipient bytes" quota lines.
+
+// Quotas by lowercase address, "@domain" or "*", and the bytes accepted for
+// each recipient since the server started.
+var (
+	rcptQuotas map[string]int64
+	quotaMutex sync.Mutex
+	quotaUsage = map[string]int64{}
+)
+
+// loadRcptQuotas reads -rcpt-quota-file. Each line gives the number of bytes
+// a recipient address, the addresses of a @domain or any address (*) may
+// receive.
+func loadRcptQuotas() error {
+	if rcptQuotaFile == "" {
+		return nil
+	}
+	f, err := os.Open(rcptQuotaFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rcptQuotas = map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected recipient and bytes", rcptQuotaFile, line)
+		}
+		limit, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("%s:%d: invalid number of bytes %q", rcptQuotaFile, line, fields[1])
+		}
+		rcptQuotas[strings.ToLower(fields[0])] = limit
+	}
+	return scanner.Err()
+}
+
+// rcptQuota returns the quota of a recipient, -1 when it has none.
+func rcptQuota(rcpt string) int64 {
+	rcpt = strings.ToLower(rcpt)
+	for _, key := range []string{rcpt, "@" + domainOf(rcpt), "*"} {
+		if limit, ok := rcptQuotas[key]; ok {
+			return limit
+		}
+	}
+	return -1
+}
+
+// quotaKey returns the key of the usage of a recipient: its lowercase
+// routing address, so that user+tag@domain counts as user@domain.
+func quotaKey(rcpt string) string {
+	return strings.ToLower(routingAddr(rcpt))
+}
+
+// quotaKeys returns the distinct usage keys of the recipients, a mailbox
+// receiving the mail once however many of its addresses are listed.
+func quotaKeys(to []string) []string {
+	seen := make(map[string]bool, len(to))
+	var keys []string
+	for _, rcpt := range to {
+		if key := quotaKey(rcpt); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reserveQuota checks the quota of every recipient against the size of the
+// mail, and accounts it when all of them can receive it. Otherwise the over
+// quota recipients get a 552 and, in LMTP, the others a 451 so that the mail
+// is retried for them only.
+func reserveQuota(remoteAddr net.Addr, from string, to []string, size int) error {
+	if rcptQuotas == nil {
+		return nil
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	var over []string
+	errs := make(smtpd.RcptErrors, len(to))
+	logged := map[string]bool{}
+	for i, rcpt := range to {
+		key := quotaKey(rcpt)
+		limit := rcptQuota(key)
+		if limit < 0 || quotaUsage[key]+int64(size) <= limit {
+			continue
+		}
+		over = append(over, rcpt)
+		errs[i] = fmt.Errorf("552 5.2.2 <%s>: Mailbox full", rcpt)
+		if !logged[key] {
+			logged[key] = true
+			logRejection(remoteAddr, from, to, "quota",
+				fmt.Sprintf("recipient <%s> over quota: %d + %d > %d bytes", key, quotaUsage[key], size, limit))
+		}
+	}
+	if len(over) == 0 {
+		for _, key := range quotaKeys(to) {
+			quotaUsage[key] += int64(size)
+		}
+		return nil
+	}
+	if !srv.LMTP {
+		return fmt.Errorf("552 5.2.2 Mailbox full: <%s>", strings.Join(over, ">, <"))
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = errors.New("451 4.2.2 Not delivered, another recipient is over quota")
+		}
+	}
+	return errs
+}
+
+// releaseQuota gives back the quota reserved for a mail which was not stored.
+func releaseQuota(to []string, size int) {
+	if rcptQuotas == nil {
+		return
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	for _, key := range quotaKeys(to) {
+		quotaUsage[key] -= int64(size)
+	}
+}
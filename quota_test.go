@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReserveQuota(t *testing.T) {
+	defer func(quotas map[string]int64, plus bool, sep string) {
+		rcptQuotas, plusAddressing, plusSeparator = quotas, plus, sep
+	}(rcptQuotas, plusAddressing, plusSeparator)
+	rcptQuotas = map[string]int64{"user@example.com": 100}
+	plusAddressing, plusSeparator = true, "+"
+	quotaUsage = map[string]int64{}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+
+	// A mailbox listed twice is charged once.
+	if err := reserveQuota(addr, "", []string{"user@example.com", "User@example.com"}, 60); err != nil {
+		t.Fatalf("first mail: %v", err)
+	}
+	if got := quotaUsage["user@example.com"]; got != 60 {
+		t.Errorf("usage: got %d, want 60", got)
+	}
+	// Tagged addresses share the quota of their mailbox.
+	if err := reserveQuota(addr, "", []string{"user+news@example.com"}, 60); err == nil {
+		t.Error("tagged address over the quota of its mailbox accepted")
+	}
+	if err := reserveQuota(addr, "", []string{"user+news@example.com"}, 40); err != nil {
+		t.Errorf("tagged address within quota: %v", err)
+	}
+	releaseQuota([]string{"user+news@example.com", "user@example.com"}, 40)
+	if got := quotaUsage["user@example.com"]; got != 60 {
+		t.Errorf("usage after release: got %d, want 60", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var isTerminal = isatty // Replaced by the tests.
+
+// rateWindow is the number of seconds the displayed rates are averaged over.
+const rateWindow = 5
+
+// rateDisplay prints the receiving throughput to out every second,
+// overwriting the previous line. Nothing is printed if out is not a terminal.
+func rateDisplay(out *os.File) {
+	if !isTerminal(out) {
+		log.Print("WARNING: -rate-display ignored, stderr is not a terminal")
+		return
+	}
+
+	var msgs, size [rateWindow + 1]int64
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; ; i++ {
+		now := <-ticker.C
+		cur := i % len(msgs)
+		msgs[cur] = atomic.LoadInt64(&receivedMessages)
+		size[cur] = atomic.LoadInt64(&receivedBytes)
+
+		span, old := i, 0
+		if i > rateWindow {
+			span, old = rateWindow, (i+1)%len(msgs)
+		}
+		fmt.Fprintf(out, "\r[%s] %d msg/s   %s/s   total: %d msgs  %s",
+			now.Format("15:04:05"), (msgs[cur]-msgs[old])/int64(span),
+			formatBytes(float64(size[cur]-size[old])/float64(span)),
+			msgs[cur], formatBytes(float64(size[cur])))
+	}
+}
+
+// formatBytes formats n bytes with a decimal unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1000 && i < len(units)-1; i++ {
+		n /= 1000
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
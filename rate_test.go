@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRateDisplay(t *testing.T) {
+	defer func(check func(*os.File) bool, msgs, size int64) {
+		isTerminal = check
+		atomic.StoreInt64(&receivedMessages, msgs)
+		atomic.StoreInt64(&receivedBytes, size)
+	}(isTerminal, atomic.LoadInt64(&receivedMessages), atomic.LoadInt64(&receivedBytes))
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	isTerminal = func(*os.File) bool { return false }
+	rateDisplay(w)
+	if !strings.Contains(logs.String(), "-rate-display ignored") {
+		t.Errorf("no warning without terminal: %q", logs.String())
+	}
+
+	// The display keeps running, writing to the closed pipe after the test.
+	isTerminal = func(*os.File) bool { return true }
+	atomic.StoreInt64(&receivedMessages, 10)
+	atomic.StoreInt64(&receivedBytes, 1500000)
+	go rateDisplay(w)
+	buf := make([]byte, 256)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^\r\[\d\d:\d\d:\d\d\] 10 msg/s   1\.5 MB/s   total: 10 msgs  1\.5 MB$`)
+	if !want.Match(buf[:n]) {
+		t.Errorf("display %q", buf[:n])
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[float64]string{0: "0.0 B", 999: "999.0 B", 1000: "1.0 KB", 2.5e9: "2.5 GB", 7e15: "7000.0 TB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%v) = %q, want %q", n, got, want)
+		}
+	}
+}
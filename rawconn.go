@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+)
+
+// maxRawConnBytes bounds the data kept in memory for a raw connection file.
+const maxRawConnBytes = 64 << 20
+
+var rawConnDir string // Directory of the raw streams of the connections.
+
+// rawConn keeps the bytes exchanged on a connection, the client ones after
+// a "> " marker and the server ones after a "< " marker, to write them to
+// a file once the connection is closed.
+type rawConn struct {
+	net.Conn
+	id string
+
+	mu        sync.Mutex
+	stream    bytes.Buffer
+	client    bool // direction of the last bytes kept
+	truncated bool
+	once      sync.Once
+}
+
+func newRawConn(conn net.Conn, id string) net.Conn {
+	return &rawConn{Conn: conn, id: id}
+}
+
+func (c *rawConn) keep(client bool, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream.Len()+len(b)+2 > maxRawConnBytes {
+		c.truncated = true
+		return
+	}
+	if c.stream.Len() == 0 || client != c.client {
+		if client {
+			c.stream.WriteString("> ")
+		} else {
+			c.stream.WriteString("< ")
+		}
+		c.client = client
+	}
+	c.stream.Write(b)
+}
+
+func (c *rawConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.keep(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *rawConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.keep(false, b[:n])
+	}
+	return n, err
+}
+
+// Close closes the connection then writes <id>.raw to -raw-conn-dir, at
+// once so that the file never holds a partial capture.
+func (c *rawConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.truncated {
+			fmt.Fprintf(&c.stream, "\n[truncated after %d bytes]\n", maxRawConnBytes)
+		}
+		if werr := writeFileAtomic(filepath.Join(rawConnDir, c.id+".raw"), c.stream.Bytes(), 0600); werr != nil {
+			log.Printf("WARNING: unable to save raw connection %s: %v", c.id, werr)
+		}
+	})
+	return err
+}
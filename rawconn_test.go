@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// TestRawConnRoundTrip checks that the raw capture of a session is named
+// after its Peer.ID and holds both directions of the dialog.
+func TestRawConnRoundTrip(t *testing.T) {
+	defer func(dir string) { rawConnDir = dir }(rawConnDir)
+	rawConnDir = t.TempDir()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(chan string, 1)
+	server := &smtpd.Server{Hostname: "mx.example.com", Appname: "test",
+		HandlerClose: func(remoteAddr net.Addr) { ids <- remoteAddr.(*smtpd.Peer).ID }}
+	go server.Serve(&listener{Listener: ln})
+	defer ln.Close()
+
+	c, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		cmd  string
+		code int
+	}{{"", 220}, {"EHLO client.example.org", 250}, {"QUIT", 221}} {
+		if step.cmd != "" {
+			c.PrintfLine("%s", step.cmd)
+		}
+		if _, _, err := c.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q: %v", step.cmd, err)
+		}
+	}
+	c.Close()
+
+	// The capture is written when smtpd closes the connection, just after
+	// calling HandlerClose.
+	id := <-ids
+	raw, err := os.ReadFile(filepath.Join(rawConnDir, id+".raw"))
+	for i := 0; err != nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		raw, err = os.ReadFile(filepath.Join(rawConnDir, id+".raw"))
+	}
+	if err != nil {
+		t.Fatalf("capture of session %s: %v", id, err)
+	}
+	for _, want := range []string{"< 220 mx.example.com test ESMTP Service ready\r\n", "> EHLO client.example.org\r\n< 250-", "> QUIT\r\n< 221 "} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("capture lacks %q:\n%s", want, raw)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	localDomainList  string          // Comma separated local domains.
+	localDomainsFile string          // File of local domains, one per line.
+	localSubdomains  bool            // Accept subdomains of local domains.
+	localDomains     map[string]bool // Lower cased local domains.
+
+	storeOnlyRcpt regexpList // Recipient patterns of the mails to save.
+
+	plusAddressing bool   // Ignore the tag of user+tag addresses for routing.
+	plusSeparator  string // Separator of the plus addressing tag.
+)
+
+var errForeignDomain = errors.New("550 5.1.2 Invalid recipient domain")
+
+// loadLocalDomains builds the local domain set from the flags.
+func loadLocalDomains() error {
+	var domains []string
+	if localDomainList != "" {
+		domains = strings.Split(localDomainList, ",")
+	}
+	if localDomainsFile != "" {
+		f, err := os.Open(localDomainsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				domains = append(domains, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			if localDomains == nil {
+				localDomains = make(map[string]bool)
+			}
+			localDomains[domain] = true
+		}
+	}
+	return nil
+}
+
+// rcptProcessing checks a recipient against the recipient policies.
+func rcptProcessing(remoteAddr net.Addr, from string, to string) error {
+	// RFC 5321 section 4.1.1.3: <Postmaster> without domain must be accepted.
+	if strictAddr && !strings.EqualFold(to, "postmaster") {
+		if _, ok := canonicalAddr(to); !ok {
+			logRejection(remoteAddr, from, []string{to}, "syntax", "invalid recipient address")
+			return errRecipientSyntax
+		}
+	}
+	if localDomains != nil && !isLocalDomain(domainOf(to)) {
+		logRejection(remoteAddr, from, []string{to}, "rcpt_domain", "foreign recipient domain")
+		return errForeignDomain
+	}
+	if err := checkBATV(remoteAddr, from, to); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isLocalDomain reports whether domain is one of the local domains.
+func isLocalDomain(domain string) bool {
+	domain = strings.ToLower(domain)
+	if localDomains[domain] {
+		return true
+	}
+	for localSubdomains {
+		i := strings.IndexByte(domain, '.')
+		if i == -1 {
+			break
+		}
+		domain = domain[i+1:]
+		if localDomains[domain] {
+			return true
+		}
+	}
+	return false
+}
+
+// domainOf returns the domain part of an address.
+func domainOf(address string) string {
+	return address[strings.LastIndexByte(address, '@')+1:]
+}
+
+// storeRcptMatch reports whether a mail sent to recipients must be saved:
+// always without -store-only-rcpt, otherwise when any recipient matches.
+func storeRcptMatch(recipients []string) bool {
+	if len(storeOnlyRcpt) == 0 {
+		return true
+	}
+	for _, rcpt := range recipients {
+		rcpt = routingAddr(rcpt)
+		for _, re := range storeOnlyRcpt {
+			if re.MatchString(rcpt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routingAddr returns the address used by the recipient policies: with
+// -plus-addressing, user+tag@domain is routed as user@domain.
+func routingAddr(address string) string {
+	if !plusAddressing {
+		return address
+	}
+	at := strings.LastIndexByte(address, '@')
+	if at == -1 {
+		at = len(address)
+	}
+	if i := strings.Index(address[:at], plusSeparator); i > 0 {
+		return address[:i] + address[at:]
+	}
+	return address
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalDomains(t *testing.T) {
+	defer func(list, file string, sub bool, domains map[string]bool) {
+		localDomainList, localDomainsFile, localSubdomains, localDomains = list, file, sub, domains
+	}(localDomainList, localDomainsFile, localSubdomains, localDomains)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	localDomainsFile = filepath.Join(t.TempDir(), "domains")
+	os.WriteFile(localDomainsFile, []byte("# Local domains\n\n  mail.example.org\n"), 0600)
+	localDomainList, localDomains = "example.com, Example.NET", nil
+	if err := loadLocalDomains(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	tests := []struct {
+		rcpt             string
+		local, subdomain bool // Accepted without and with -local-domains-subdomain
+	}{
+		{"user@example.com", true, true},
+		{"user@example.net", true, true},
+		{"user@mail.example.org", true, true},
+		{"User@EXAMPLE.COM", true, true},
+		{"user@Mail.Example.Org", true, true},
+		{"user@sub.example.com", false, true},
+		{"user@a.b.EXAMPLE.net", false, true},
+		{"user@example.org", false, false},
+		{"user@example.com.evil.test", false, false},
+		{"user@notexample.com", false, false},
+		{"user@foreign.test", false, false},
+	}
+	for _, sub := range []bool{false, true} {
+		localSubdomains = sub
+		for _, tt := range tests {
+			want := tt.local
+			if sub {
+				want = tt.subdomain
+			}
+			err := rcptProcessing(addr, "sender@example.org", tt.rcpt)
+			if want && err != nil {
+				t.Errorf("subdomains %v: %s: %v, want accepted", sub, tt.rcpt, err)
+			} else if !want && err != errForeignDomain {
+				t.Errorf("subdomains %v: %s: %v, want %v", sub, tt.rcpt, err, errForeignDomain)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	requireRDNS    bool          // Refuse clients without reverse DNS.
+	requireFCRDNS  bool          // Refuse clients without forward-confirmed reverse DNS.
+	rdnsRejectCode int           // Reply code of refused clients, 450 or 550.
+	rdnsTimeout    time.Duration // Time given to the lookups of a client.
+
+	rdnsResolver rdnsDNS = net.DefaultResolver
+
+	rdnsMu    sync.Mutex
+	rdnsCache = make(map[string]rdnsVerdict)
+)
+
+// rdnsDNS is the part of net.Resolver used by the reverse DNS checks.
+type rdnsDNS interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// rdnsCacheTTL is the time a verdict is reused for the same IP,
+// rdnsCacheSize bounds the number of verdicts kept.
+const (
+	rdnsCacheTTL  = 10 * time.Minute
+	rdnsCacheSize = 10000
+)
+
+// rdnsVerdict is the result of the reverse DNS check of an IP.
+type rdnsVerdict struct {
+	name   string // Confirmed name, or first PTR name
+	pass   bool
+	reason string
+	expiry time.Time
+}
+
+var errRDNSTemporary = errors.New("451 4.7.25 Client host rejected: reverse DNS lookup failed, try again later")
+
+// checkRDNS refuses clients failing -require-rdns or -require-fcrdns.
+// Authenticated clients are not checked.
+func checkRDNS(remoteAddr net.Addr, from string) error {
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok && peer.Authenticated {
+		return nil
+	}
+	ip := remoteIP(remoteAddr)
+	v, err := rdnsCheck(ip)
+	if err != nil {
+		logRejection(remoteAddr, from, nil, "rdns", "reverse DNS lookup failed: "+err.Error())
+		return errRDNSTemporary
+	}
+	if !v.pass {
+		logRejection(remoteAddr, from, nil, "rdns", v.reason)
+		class := rdnsRejectCode / 100
+		return fmt.Errorf("%d %d.7.25 Client host rejected: %s [%s]", rdnsRejectCode, class, v.reason, ip)
+	}
+	return nil
+}
+
+// rdnsCheck returns the verdict for ip, from the cache when possible.
+// Lookup failures other than a missing name are not cached.
+func rdnsCheck(ip net.IP) (rdnsVerdict, error) {
+	key := ip.String()
+	rdnsMu.Lock()
+	v, ok := rdnsCache[key]
+	if ok && time.Now().After(v.expiry) {
+		delete(rdnsCache, key)
+		ok = false
+	}
+	rdnsMu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	v, err := rdnsLookup(ctx, ip)
+	if err != nil {
+		return v, err
+	}
+	verdict := "pass"
+	if !v.pass {
+		verdict = "fail, " + v.reason
+	}
+	if v.name != "" {
+		verdict += ", name: " + v.name
+	}
+	log.Printf("remote: %v, rDNS: %s", ip, verdict)
+
+	v.expiry = time.Now().Add(rdnsCacheTTL)
+	rdnsMu.Lock()
+	if len(rdnsCache) >= rdnsCacheSize {
+		now := time.Now()
+		for k, old := range rdnsCache {
+			if now.After(old.expiry) {
+				delete(rdnsCache, k)
+			}
+		}
+		if len(rdnsCache) >= rdnsCacheSize {
+			rdnsCache = make(map[string]rdnsVerdict)
+		}
+	}
+	rdnsCache[key] = v
+	rdnsMu.Unlock()
+	return v, nil
+}
+
+// rdnsLookup resolves the PTR names of ip and, with -require-fcrdns, looks
+// for one resolving back to ip.
+func rdnsLookup(ctx context.Context, ip net.IP) (rdnsVerdict, error) {
+	names, err := rdnsResolver.LookupAddr(ctx, ip.String())
+	if err != nil && !isNotFound(err) {
+		return rdnsVerdict{}, err
+	}
+	if len(names) == 0 {
+		return rdnsVerdict{reason: "no reverse DNS"}, nil
+	}
+	if !requireFCRDNS {
+		return rdnsVerdict{name: names[0], pass: true}, nil
+	}
+	for _, name := range names {
+		addrs, err := rdnsResolver.LookupIPAddr(ctx, name)
+		if err != nil && !isNotFound(err) {
+			return rdnsVerdict{}, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return rdnsVerdict{name: name, pass: true}, nil
+			}
+		}
+	}
+	return rdnsVerdict{name: names[0], reason: "reverse DNS " + strings.TrimSuffix(names[0], ".") + " not confirmed"}, nil
+}
+
+// isNotFound reports whether a lookup error means the name does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
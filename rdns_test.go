@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowDNS answers no lookup before the deadline of its context.
+type slowDNS struct{}
+
+func (slowDNS) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (slowDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCheckRDNS(t *testing.T) {
+	defer func(resolver rdnsDNS, rdns, fcrdns bool, code int, timeout time.Duration) {
+		rdnsResolver, requireRDNS, requireFCRDNS, rdnsRejectCode, rdnsTimeout = resolver, rdns, fcrdns, code, timeout
+		rdnsCache = make(map[string]rdnsVerdict)
+	}(rdnsResolver, requireRDNS, requireFCRDNS, rdnsRejectCode, rdnsTimeout)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	rdnsResolver = &fakeDNS{
+		ptr: map[string][]string{
+			"192.0.2.1": {"mail.example.org"},
+			"192.0.2.2": {"forged.example.org"},
+		},
+		addr: map[string][]string{
+			"mail.example.org":   {"192.0.2.1"},
+			"forged.example.org": {"198.51.100.7"},
+		},
+	}
+	requireRDNS, requireFCRDNS, rdnsRejectCode, rdnsTimeout = true, true, 550, time.Second
+	rdnsCache = make(map[string]rdnsVerdict)
+
+	tests := []struct {
+		ip   string
+		want string // Reply prefix, empty when accepted
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.2", "550 5.7.25 Client host rejected: reverse DNS forged.example.org not confirmed [192.0.2.2]"},
+		{"192.0.2.3", "550 5.7.25 Client host rejected: no reverse DNS [192.0.2.3]"},
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 25}
+		err := checkRDNS(addr, "sender@example.org")
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v, want accepted", tt.ip, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: %v, want %q", tt.ip, err, tt.want)
+		}
+	}
+
+	rdnsRejectCode = 450
+	rdnsCache = make(map[string]rdnsVerdict)
+	err := checkRDNS(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 25}, "sender@example.org")
+	if err == nil || !strings.HasPrefix(err.Error(), "450 4.7.25 ") {
+		t.Errorf("mismatch with -rdns-reject-code 450: %v", err)
+	}
+
+	rdnsResolver, rdnsTimeout = slowDNS{}, 10*time.Millisecond
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 25}
+	if err := checkRDNS(addr, "sender@example.org"); err != errRDNSTemporary {
+		t.Errorf("timeout: %v, want %v", err, errRDNSTemporary)
+	}
+	if _, ok := rdnsCache["203.0.113.9"]; ok {
+		t.Error("timeout: verdict cached")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecordedBytes bounds the data kept in memory for a recorded session.
+const maxRecordedBytes = 1 << 20
+
+var recordDir string // Directory of the sessions recorded as Go tests.
+
+// recordedStep is a client message and the server response that followed.
+type recordedStep struct {
+	client, server bytes.Buffer
+}
+
+// recorderConn records a session to write it as a Go table test on close.
+type recorderConn struct {
+	net.Conn
+	id    string
+	start time.Time
+
+	mu        sync.Mutex
+	steps     []*recordedStep
+	size      int
+	truncated bool
+	once      sync.Once
+}
+
+func newRecorderConn(conn net.Conn, id string) net.Conn {
+	return &recorderConn{Conn: conn, id: id, start: time.Now(), steps: []*recordedStep{{}}}
+}
+
+func (c *recorderConn) record(client bool, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size+len(b) > maxRecordedBytes {
+		c.truncated = true
+		return
+	}
+	c.size += len(b)
+	step := c.steps[len(c.steps)-1]
+	if client && step.server.Len() > 0 {
+		step = &recordedStep{}
+		c.steps = append(c.steps, step)
+	}
+	if client {
+		step.client.Write(b)
+	} else {
+		step.server.Write(b)
+	}
+}
+
+func (c *recorderConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *recorderConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(false, b[:n])
+	}
+	return n, err
+}
+
+func (c *recorderConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if werr := c.writeTestCase(); werr != nil {
+			log.Printf("WARNING: unable to record session %s: %v", c.id, werr)
+		}
+	})
+	return err
+}
+
+// writeTestCase writes the session as a Go test calling replay with one
+// {client, server} entry per exchange. The package receiving the file
+// provides the replay function and the replayStep type.
+func (c *recorderConn) writeTestCase() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by smtp_receiver -record-test-cases-dir. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "// Session %s from %v, recorded %s.\n", c.id, c.RemoteAddr(), c.start.UTC().Format(time.RFC3339))
+	if c.truncated {
+		fmt.Fprintf(&src, "// The session was truncated after %d bytes.\n", maxRecordedBytes)
+	}
+	fmt.Fprintf(&src, "\npackage recorded\n\nimport \"testing\"\n\n")
+	fmt.Fprintf(&src, "func TestSession_%s(t *testing.T) {\n", strings.ReplaceAll(c.id, "-", "_"))
+	fmt.Fprintf(&src, "replay(t, []replayStep{\n")
+	for _, step := range c.steps {
+		fmt.Fprintf(&src, "{client: %s, server: %s},\n", strconv.Quote(step.client.String()), strconv.Quote(step.server.String()))
+	}
+	fmt.Fprintf(&src, "})\n}\n")
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(recordDir, "session_"+strings.ReplaceAll(c.id, "-", "_")+"_test.go"), formatted, 0666)
+}
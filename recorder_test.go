@@ -0,0 +1,77 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	defer func(dir string) { recordDir = dir }(recordDir)
+	recordDir = t.TempDir()
+
+	steps := [][2]string{
+		{"", "220 mx.example.com ESMTP\r\n"},
+		{"EHLO client.example.org\r\n", "250-mx.example.com\r\n250 8BITMIME\r\n"},
+		{"NOOP \"`\\\x00\xff\r\n", "250 2.0.0 Ok\r\n"},
+		{"QUIT\r\n", "221 2.0.0 Bye\r\n"},
+	}
+	server, client := net.Pipe()
+	conn := newRecorderConn(server, "1a2b-3c")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 256)
+		for _, step := range steps {
+			io.ReadFull(conn, buf[:len(step[0])])
+			io.WriteString(conn, step[1])
+		}
+	}()
+	buf := make([]byte, 256)
+	for _, step := range steps {
+		if step[0] != "" {
+			io.WriteString(client, step[0])
+		}
+		io.ReadFull(client, buf[:len(step[1])])
+	}
+	<-done
+	conn.Close()
+
+	path := filepath.Join(recordDir, "session_1a2b_3c_test.go")
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]string
+	ast.Inspect(f, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok || len(lit.Elts) != 2 {
+			return true
+		}
+		var step [2]string
+		for i, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				return true
+			}
+			if step[i], err = strconv.Unquote(kv.Value.(*ast.BasicLit).Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got = append(got, step)
+		return false
+	})
+	if len(got) != len(steps) {
+		t.Fatalf("recorded %q, want %q", got, steps)
+	}
+	for i := range steps {
+		if got[i] != steps[i] {
+			t.Errorf("step %d: recorded %q, want %q", i, got[i], steps[i])
+		}
+	}
+}
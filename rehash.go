@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var rehashDir string // Directory of stored mails to rename per -fileformat.
+
+// sidecarSuffixes are the files written next to a mail file, moved with it.
+var sidecarSuffixes = []string{".txt", ".transcript"}
+
+// rehash renames the mail files found under dir to the name -fileformat
+// gives to their content, dated by their modification time. %cipher,
+// %sni, %country and %asn are unknown and left empty. With -prelude, the content follows the
+// prelude of the files. The headers added at receipt are left out of the
+// hashes, as they were when the mails were named. Existing files are never
+// overwritten.
+func rehash(dir string) error {
+	if fileFormat == "" {
+		return errors.New("-rehash needs -fileformat")
+	}
+	// List the files first, renamed files may land in directories not
+	// walked yet.
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") && !isSidecar(path) {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var renamed, unchanged, skipped int
+	defer func() {
+		log.Printf("rehash: renamed: %d, unchanged: %d, skipped: %d.", renamed, unchanged, skipped)
+	}()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if preludeTemplate != "" {
+			data = stripPrelude(data)
+		}
+		data = stripAddedHeaders(data)
+		target, _, _ := mailFilename(nil, data, info.ModTime())
+		switch same, err := samePath(path, target); {
+		case err != nil:
+			return err
+		case same:
+			unchanged++
+			continue
+		}
+		if _, err := os.Lstat(target); err == nil {
+			log.Printf("WARNING: %s not renamed, %s already exists", path, target)
+			skipped++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		for _, suffix := range sidecarSuffixes {
+			if err := os.Rename(path+suffix, target+suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+		renamed++
+	}
+	return nil
+}
+
+// addedMsgIDRegex matches the Message-ID headers of newMessageID.
+var addedMsgIDRegex = regexp.MustCompile(`^Message-ID: <[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}@[^>]*>\r\n$`)
+
+// stripAddedHeaders returns a stored mail without the headers inserted
+// after its Received header at receipt, as mailFilename got it. Only the
+// headers of the current flags are looked for, in their order of insertion,
+// and a Message-ID only when it has the form of newMessageID and the
+// message has no other.
+func stripAddedHeaders(data []byte) []byte {
+	start := payloadStart(data)
+	end := start
+	for _, h := range []struct {
+		name  string
+		added bool
+	}{
+		{"Received-SPF", receivedSPF},
+		{"Message-ID", addMissingMsgID},
+		{"Envelope-From", envelopeHeaders},
+		{"Envelope-To", envelopeHeaders},
+		{"X-BCC-Detected", bccInjectHeader},
+		{"DKIM-Signature", dkimDomain != ""},
+	} {
+		if !h.added {
+			continue
+		}
+		next := headerEnd(data, end)
+		if next == end || headerName(string(data[end:next])) != strings.ToLower(h.name) {
+			continue
+		}
+		if h.name == "Message-ID" && (!addedMsgIDRegex.Match(data[end:next]) || hasMessageID(data[next:])) {
+			continue
+		}
+		end = next
+	}
+	if end == start {
+		return data
+	}
+	return append(append([]byte(nil), data[:start]...), data[end:]...)
+}
+
+// headerEnd returns the offset following the header field at offset start
+// of data, with its continuation lines, or start at the end of the header.
+func headerEnd(data []byte, start int) int {
+	end := start
+	for end < len(data) {
+		i := bytes.IndexByte(data[end:], '\n')
+		if i == -1 {
+			return start
+		}
+		if end > start && data[end] != ' ' && data[end] != '\t' {
+			break
+		}
+		if end == start && (data[end] == '\r' || data[end] == '\n') {
+			return start
+		}
+		end += i + 1
+	}
+	return end
+}
+
+// isSidecar reports whether path is a file written next to a mail file.
+func isSidecar(path string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			if _, err := os.Stat(strings.TrimSuffix(path, suffix)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// samePath reports whether two paths name the same file location.
+func samePath(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestStripAddedHeaders(t *testing.T) {
+	defer func(spf, msgID, envelope bool) {
+		receivedSPF, addMissingMsgID, envelopeHeaders = spf, msgID, envelope
+	}(receivedSPF, addMissingMsgID, envelopeHeaders)
+	receivedSPF, addMissingMsgID, envelopeHeaders = true, true, true
+
+	received := "Received: from [192.0.2.1] (client [192.0.2.1])\r\n\tby mx (smtpd) with SMTP\r\n\tfor <b@example.com>; Fri, 16 Oct 2026 01:13:01 +0000 (UTC)\r\n"
+	spf := "Received-SPF: none (mx: domain of a@example.org does not provide an SPF record)\r\n\tclient-ip=192.0.2.1; envelope-from=a@example.org; helo=client\r\n"
+	envelope := "Envelope-From: <a@example.org>\r\nEnvelope-To: <b@example.com>\r\n"
+	tests := []struct {
+		stored, received string
+	}{
+		{received + spf + "Message-ID: <0d906d67-6dea-43ed-a6b5-b41dbdcd2076@mx>\r\n" + envelope + "Subject: x\r\n\r\nbody\r\n", received + "Subject: x\r\n\r\nbody\r\n"},
+		// The first header of the message is its own Message-ID.
+		{received + spf + envelope + "Message-ID: <1@x>\r\n\r\nbody\r\n", received + "Message-ID: <1@x>\r\n\r\nbody\r\n"},
+		{received + "Message-ID: <1@x>\r\nSubject: x\r\n\r\nbody\r\n", received + "Message-ID: <1@x>\r\nSubject: x\r\n\r\nbody\r\n"},
+		{received + "\r\nbody\r\n", received + "\r\nbody\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(stripAddedHeaders([]byte(tt.stored))); got != tt.received {
+			t.Errorf("%q: got %q, want %q", tt.stored, got, tt.received)
+		}
+	}
+}
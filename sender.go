@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	protectDomainList string          // Comma separated protected sender domains.
+	protectAllowNets  netList         // Networks allowed to send from protected domains.
+	protectDomains    map[string]bool // Lower cased protected sender domains.
+)
+
+var errSpoofedSender = errors.New("550 5.7.1 Sender address rejected: spoofing detected")
+
+// loadProtectDomains builds the protected sender domain set from the flags.
+func loadProtectDomains() {
+	for _, domain := range strings.Split(protectDomainList, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			if protectDomains == nil {
+				protectDomains = make(map[string]bool)
+			}
+			protectDomains[domain] = true
+		}
+	}
+}
+
+// mailFromProcessing checks a sender against the sender policies.
+func mailFromProcessing(remoteAddr net.Addr, from string) error {
+	if strictAddr && from != "" {
+		if _, ok := canonicalAddr(from); !ok {
+			logRejection(remoteAddr, from, nil, "syntax", "invalid sender address")
+			return errSenderSyntax
+		}
+	}
+	if requireRDNS || requireFCRDNS {
+		if err := checkRDNS(remoteAddr, from); err != nil {
+			return err
+		}
+	}
+	if protectDomains[strings.ToLower(domainOf(from))] && !trustedSender(remoteAddr) {
+		logRejection(remoteAddr, from, nil, "spoofing", "protected sender domain used by an unauthenticated client "+remoteIP(remoteAddr).String())
+		return errSpoofedSender
+	}
+	if rejectNullMX {
+		if err := checkNullMX(remoteAddr, from); err != nil {
+			return err
+		}
+	}
+	if receivedSPF {
+		// Evaluated now and cached, the header is built after DATA.
+		spfCheck(remoteAddr, from)
+	}
+	return nil
+}
+
+// trustedSender reports whether the client authenticated or connects from
+// one of the -protect-domains-allow networks.
+func trustedSender(remoteAddr net.Addr) bool {
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok && peer.Authenticated {
+		return true
+	}
+	return len(protectAllowNets) > 0 && protectAllowNets.contains(remoteIP(remoteAddr))
+}
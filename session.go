@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	keepAliveWarn     int  // NOOP or RSET count above which a session is logged.
+	starttlsDowngrade bool // Log sessions sending mail without the STARTTLS they were offered.
+)
+
+// sessionClose is called when a SMTP session ends.
+func sessionClose(remoteAddr net.Addr) {
+	peer, ok := remoteAddr.(*smtpd.Peer)
+	if !ok {
+		return
+	}
+	if t := peer.Aborted; t != nil {
+		atomic.AddInt64(&abortedTransactions, 1)
+		phase := "before DATA"
+		if t.Data {
+			phase = "during DATA"
+		}
+		if !logQuiet || smtpd.Debug {
+			log.Printf(logFormatHead+", transaction aborted %s", remoteAddr, t.From, t.To, phase)
+		}
+	}
+
+	if starttlsDowngrade && startTLSSkipped(peer) {
+		log.Printf("SECURITY: remote: %v, HELO: %s, session: %s, MAIL FROM sent without STARTTLS although it was advertised, possible STARTTLS stripping",
+			remoteAddr, peer.HeloName, peer.ID)
+	}
+
+	noop, rset := peer.Commands["NOOP"], peer.Commands["RSET"]
+	if keepAliveWarn > 0 && (noop > keepAliveWarn || rset > keepAliveWarn) && (!logQuiet || smtpd.Debug) {
+		log.Printf("remote: %v, NOOP: %d, RSET: %d, possible keep-alive abuse", remoteAddr, noop, rset)
+	}
+}
+
+var abortedTransactions int64 // atomic count of transactions left incomplete
+
+// sessionField returns the ", session: <id>" log field of the session
+// identifier sent in the banner with -connection-id-in-greeting.
+func sessionField(remoteAddr net.Addr) string {
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok && srv.GreetingID {
+		return ", session: " + peer.ID
+	}
+	return ""
+}
+
+// startTLSSkipped reports whether a client offered STARTTLS in the EHLO
+// response went on with MAIL FROM in clear text, while -tlsrequired is set.
+// A man in the middle removing STARTTLS from the EHLO response leads to it.
+func startTLSSkipped(peer *smtpd.Peer) bool {
+	if srv.TLSConfig == nil || !srv.TLSRequired || srv.TLSListener || srv.DisabledCmds["STARTTLS"] {
+		return false
+	}
+	if srv.TLSLoopbackFree && remoteIP(peer).IsLoopback() {
+		return false
+	}
+	greetings := peer.Commands["EHLO"] + peer.Commands["LHLO"]
+	return greetings > 0 && peer.Commands["MAIL"] > 0 && peer.Commands["STARTTLS"] == 0 && peer.TLS == nil
+}
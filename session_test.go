@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// lockedBuffer is a bytes.Buffer read while the server logs.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestAbortedTransaction closes client connections before and during DATA,
+// and checks the transactions are logged as aborted without mail written.
+func TestAbortedTransaction(t *testing.T) {
+	dir := t.TempDir()
+	defer func(format string) { fileFormat = format }(fileFormat)
+	fileFormat = filepath.Join(dir, "%N.eml")
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	server := &smtpd.Server{Hostname: "mx.example.com", Handler: mailProcessing, HandlerClose: sessionClose}
+	go server.Serve(&listener{Listener: ln})
+
+	for _, tt := range []struct {
+		cmds  []string
+		phase string
+	}{
+		{[]string{"MAIL FROM:<sender@example.org>", "RCPT TO:<user@example.com>"}, "before DATA"},
+		{[]string{"MAIL FROM:<sender@example.org>", "RCPT TO:<user@example.com>", "DATA"}, "during DATA"},
+	} {
+		aborted := atomic.LoadInt64(&abortedTransactions)
+		c, err := textproto.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ReadResponse(220)
+		c.PrintfLine("EHLO client.example.org")
+		c.ReadResponse(250)
+		for _, cmd := range tt.cmds {
+			c.PrintfLine("%s", cmd)
+			c.ReadResponse(0)
+		}
+		c.PrintfLine("Subject: partial\r\n\r\nThe client goes away")
+		c.Close()
+
+		want := "MAIL From: <sender@example.org>, RCPT To: [user@example.com], transaction aborted " + tt.phase
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), want); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no %q log line:\n%s", want, logs.String())
+			}
+		}
+		if n := atomic.LoadInt64(&abortedTransactions); n != aborted+1 {
+			t.Errorf("%d aborted transactions, want %d", n, aborted+1)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("aborted transactions wrote %d files", len(files))
+	}
+}
+
+// TestSessionCloseQuiet checks -quiet silences the session logs, aborted
+// transactions still being counted.
+func TestSessionCloseQuiet(t *testing.T) {
+	defer func(quiet bool, warn int) { logQuiet, keepAliveWarn = quiet, warn }(logQuiet, keepAliveWarn)
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	logQuiet, keepAliveWarn = true, 2
+
+	aborted := atomic.LoadInt64(&abortedTransactions)
+	sessionClose(&smtpd.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		Commands: map[string]int{"NOOP": 10},
+		Aborted:  &smtpd.Transaction{From: "sender@example.org", To: []string{"user@example.com"}, Data: true},
+	})
+	if logs.String() != "" {
+		t.Errorf("logged with -quiet: %s", logs.String())
+	}
+	if n := atomic.LoadInt64(&abortedTransactions); n != aborted+1 {
+		t.Errorf("%d aborted transactions, want %d", n, aborted+1)
+	}
+}
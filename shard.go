@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+var shardBy string // Period of the date subdirectories mail data is sharded in.
+
+// checkShardBy validates the -auto-shard-by period.
+func checkShardBy() error {
+	switch shardBy {
+	case "", "hour", "day", "week", "month":
+		return nil
+	}
+	return fmt.Errorf("-auto-shard-by must be one of hour, day, week or month, got %q", shardBy)
+}
+
+// shardPath inserts the date subdirectory of the shard period containing date
+// between the directory and the base name of filename.
+func shardPath(filename string, date time.Time) string {
+	if !localTime {
+		date = date.UTC()
+	}
+	var shard string
+	switch shardBy {
+	case "hour":
+		shard = date.Format("2006-01-02_15")
+	case "day":
+		shard = date.Format("2006-01-02")
+	case "week":
+		year, week := date.ISOWeek()
+		shard = fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		shard = date.Format("2006-01")
+	default:
+		return filename
+	}
+	return filepath.Join(filepath.Dir(filename), shard, filepath.Base(filename))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShardPath(t *testing.T) {
+	defer func(by string, local bool) { shardBy, localTime = by, local }(shardBy, localTime)
+	localTime = false
+	paris := time.FixedZone("CET", 3600)
+	for _, test := range []struct {
+		by   string
+		date time.Time
+		want string
+	}{
+		{"hour", time.Date(2024, 1, 15, 9, 59, 59, 999999999, time.UTC), "/mail/2024-01-15_09/x.eml"},
+		{"hour", time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), "/mail/2024-01-15_10/x.eml"},
+		{"day", time.Date(2024, 1, 15, 23, 59, 59, 0, time.UTC), "/mail/2024-01-15/x.eml"},
+		{"day", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC), "/mail/2024-01-16/x.eml"},
+		{"day", time.Date(2024, 1, 16, 0, 30, 0, 0, paris), "/mail/2024-01-15/x.eml"}, // UTC without -local-time
+		{"week", time.Date(2024, 1, 14, 23, 59, 59, 0, time.UTC), "/mail/2024-W02/x.eml"},
+		{"week", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), "/mail/2024-W03/x.eml"},
+		{"week", time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), "/mail/2025-W01/x.eml"}, // ISO year
+		{"month", time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC), "/mail/2024-01/x.eml"},
+		{"month", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), "/mail/2024-02/x.eml"},
+	} {
+		shardBy = test.by
+		if got := shardPath("/mail/x.eml", test.date); got != filepath.FromSlash(test.want) {
+			t.Errorf("%s %v: got %s, want %s", test.by, test.date, got, test.want)
+		}
+	}
+
+	localTime = true
+	shardBy = "day"
+	if got := shardPath("/mail/x.eml", time.Date(2024, 1, 16, 0, 30, 0, 0, paris)); got != filepath.FromSlash("/mail/2024-01-16/x.eml") {
+		t.Errorf("-local-time: got %s", got)
+	}
+}
+
+// TestShardRollover delivers mails on both sides of midnight with a mocked
+// clock and checks they are stored in the shard of their day.
+func TestShardRollover(t *testing.T) {
+	dir := t.TempDir()
+	defer func(format, by string, clock func() time.Time) {
+		fileFormat, shardBy, now = format, by, clock
+	}(fileFormat, shardBy, now)
+	fileFormat, shardBy = filepath.Join(dir, "mail.eml"), "day"
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	data := []byte("Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <user@example.com>\r\nSubject: test\r\n\r\nbody\r\n")
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	for _, date := range []time.Time{
+		time.Date(2024, 1, 15, 23, 59, 59, 0, time.UTC),
+		time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC),
+	} {
+		now = func() time.Time { return date }
+		if err := mailProcessing(addr, "sender@example.org", []string{"user@example.com"}, data); err != nil {
+			t.Fatalf("%v: %v", date, err)
+		}
+	}
+	for _, shard := range []string{"2024-01-15", "2024-01-16"} {
+		if _, err := os.Stat(filepath.Join(dir, shard, "mail.eml")); err != nil {
+			t.Errorf("shard %s: %v", shard, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowProfiles are the predefined -slow-profile delays, by command.
+// GREETING is the delay of the banner, "." the one of the reply to the end
+// of mail data and "*" the one of the commands not listed.
+var slowProfiles = map[string]map[string]time.Duration{
+	// RFC 5321 section 4.5.3.2 minimum client timeouts.
+	"rfc5321": {
+		"GREETING": 5 * time.Minute,
+		"MAIL":     5 * time.Minute,
+		"RCPT":     5 * time.Minute,
+		"DATA":     2 * time.Minute,
+		".":        10 * time.Minute,
+	},
+	// Just under the 5 minutes clients usually wait for any reply.
+	"saturation": {
+		"*": 4*time.Minute + 59*time.Second,
+	},
+}
+
+var (
+	slowProfile string                   // Name of a predefined profile.
+	slowDelays  string                   // Custom COMMAND=delay list.
+	replyDelays map[string]time.Duration // Delays applied, by command.
+)
+
+// loadReplyDelays builds the delays from -slow-profile and -simulate-slow-server,
+// whose delays take precedence.
+func loadReplyDelays() error {
+	if slowProfile != "" {
+		profile, ok := slowProfiles[slowProfile]
+		if !ok {
+			return fmt.Errorf("unknown -slow-profile %q, must be rfc5321 or saturation", slowProfile)
+		}
+		replyDelays = make(map[string]time.Duration)
+		for cmd, d := range profile {
+			replyDelays[cmd] = d
+		}
+	}
+	for _, item := range strings.Split(slowDelays, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		i := strings.IndexByte(item, '=')
+		if i == -1 {
+			return fmt.Errorf("-simulate-slow-server: %q is not COMMAND=delay", item)
+		}
+		d, err := time.ParseDuration(item[i+1:])
+		if err != nil {
+			return fmt.Errorf("-simulate-slow-server: %v", err)
+		}
+		if replyDelays == nil {
+			replyDelays = make(map[string]time.Duration)
+		}
+		replyDelays[strings.ToUpper(item[:i])] = d
+	}
+	return nil
+}
+
+// slowConn delays the server replies according to the command they answer.
+// Commands are followed until STARTTLS, encrypted traffic is not delayed.
+type slowConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	line    []byte // incomplete client line
+	pending string // command whose reply is not sent yet
+	data    bool   // receiving mail data
+	toData  bool   // DATA sent, waiting for the 354 reply
+	blind   bool   // TLS started
+}
+
+func newSlowConn(conn net.Conn) net.Conn {
+	return &slowConn{Conn: conn, pending: "GREETING"}
+}
+
+func (c *slowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blind {
+		return n, err
+	}
+	c.line = append(c.line, b[:n]...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i == -1 {
+			break
+		}
+		line := strings.TrimRight(string(c.line[:i]), "\r")
+		c.line = c.line[i+1:]
+		if c.data {
+			if line == "." {
+				c.data = false
+				c.pending = "."
+			}
+			continue
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		c.pending = verb
+		c.toData = verb == "DATA"
+	}
+	return n, err
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	var delay time.Duration
+	if !c.blind && c.pending != "" {
+		var ok bool
+		if delay, ok = replyDelays[c.pending]; !ok {
+			delay = replyDelays["*"]
+		}
+		if c.toData && bytes.HasPrefix(b, []byte("354")) {
+			c.data = true
+		}
+		if c.pending == "STARTTLS" && bytes.HasPrefix(b, []byte("220")) {
+			c.blind = true
+		}
+		c.pending, c.toData = "", false
+	}
+	c.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+		// smtpd set its write deadline before the delay.
+		if srv.Timeout > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(srv.Timeout))
+		}
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// TestSlowReplies times the replies of a session and checks they are
+// delayed as configured, within 10%.
+func TestSlowReplies(t *testing.T) {
+	defer func(delays map[string]time.Duration) { replyDelays = delays }(replyDelays)
+	replyDelays = map[string]time.Duration{
+		"GREETING": 200 * time.Millisecond,
+		"EHLO":     300 * time.Millisecond,
+		"*":        250 * time.Millisecond,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (&smtpd.Server{Hostname: "mx.example.com"}).Serve(&listener{Listener: ln})
+	defer ln.Close()
+
+	start := time.Now()
+	c, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, step := range []struct {
+		cmd   string
+		code  int
+		delay time.Duration
+	}{
+		{"", 220, 200 * time.Millisecond},
+		{"EHLO client.example.org", 250, 300 * time.Millisecond},
+		{"NOOP", 250, 250 * time.Millisecond},
+		{"VRFY user", 502, 250 * time.Millisecond},
+		{"BDAT 10 LAST", 500, 250 * time.Millisecond},
+		{"QUIT", 221, 250 * time.Millisecond},
+	} {
+		if step.cmd != "" {
+			start = time.Now()
+			c.PrintfLine("%s", step.cmd)
+		}
+		if code, msg, _ := c.ReadResponse(0); code != step.code {
+			t.Fatalf("%q: got %d %s, want %d", step.cmd, code, msg, step.code)
+		}
+		if elapsed := time.Since(start); elapsed < step.delay || elapsed > step.delay*11/10 {
+			t.Errorf("%q: replied after %v, want %v", step.cmd, elapsed, step.delay)
+		}
+	}
+}
@@ -0,0 +1,1349 @@
+// Package smtpd implements a basic SMTP server.
+//
+// This is a fork of github.com/mhale/smtpd v0.8.0 carrying the changes
+// smtp_receiver needs on top of it.
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Debug `true` enables verbose logging.
+	Debug      = false
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+)>(\s(.*))?`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
+	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+	replyRE    = regexp.MustCompile(`^[2-5][0-9]{2}[ -]`)
+	enhancedRE = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3} `)
+	knownVerbs = map[string]bool{
+		"HELO": true, "EHLO": true, "LHLO": true, "MAIL": true, "RCPT": true, "DATA": true, "QUIT": true,
+		"RSET": true, "NOOP": true, "HELP": true, "VRFY": true, "EXPN": true, "STARTTLS": true, "AUTH": true,
+	}
+)
+
+// Handler function called upon successful receipt of an email.
+type Handler func(remoteAddr net.Addr, from string, to []string, data []byte) error
+
+// HandlerMail function called on MAIL. Return nil to accept the sender.
+// Errors formatted as an SMTP reply are sent as is.
+type HandlerMail func(remoteAddr net.Addr, from string) error
+
+// HandlerRcpt function called on RCPT. Return accept status.
+type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
+
+// HandlerRcptReply function called on RCPT after HandlerRcpt. Return nil to
+// accept the recipient. Errors formatted as an SMTP reply are sent as is.
+type HandlerRcptReply func(remoteAddr net.Addr, from string, to string) error
+
+// HandlerClose function called when a session ends.
+type HandlerClose func(remoteAddr net.Addr)
+
+// HandlerReply function called for every reply sent to the client.
+type HandlerReply func(remoteAddr net.Addr, reply string)
+
+// HandlerTLS function called when a TLS handshake succeeded, the remote
+// address Peer holds the TLS state.
+type HandlerTLS func(remoteAddr net.Addr)
+
+// RcptErrors can be returned by a Handler to report one result per recipient,
+// in the order of the to slice. A nil entry means the recipient was accepted.
+// It is only meaningful in LMTP mode, SMTP replies with the first error.
+type RcptErrors []error
+
+func (errs RcptErrors) Error() string {
+	for _, err := range errs {
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return "250 2.0.0 Ok: queued"
+}
+
+// AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
+type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
+
+var ErrServerClosed = errors.New("Server has been closed")
+
+// errLineTooLong is returned by readLine for lines above MaxLineLength.
+var errLineTooLong = errors.New("500 5.5.6 Line too long")
+
+// ListenAndServe listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections.
+func ListenAndServe(addr string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	return srv.ListenAndServe()
+}
+
+// ListenAndServeTLS listens on the TCP network address addr
+// and then calls Serve with handler to handle requests
+// on incoming connections. Connections may be upgraded to TLS if the client requests it.
+func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Handler, appname string, hostname string) error {
+	srv := &Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname}
+	err := srv.ConfigureTLS(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
+
+type maxSizeExceededError struct {
+	limit int
+}
+
+func maxSizeExceeded(limit int) maxSizeExceededError {
+	return maxSizeExceededError{limit}
+}
+
+// Error uses the RFC 5321 response message in preference to RFC 1870.
+// RFC 3463 defines enhanced status code x.3.4 as "Message too big for system".
+func (err maxSizeExceededError) Error() string {
+	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded storage allocation (%d)", err.limit)
+}
+
+// Peer describes the client of a session. It is the net.Addr given to the
+// handlers, which can type assert it to learn more about the session.
+type Peer struct {
+	ID            string               // Random identifier of the session, or the SessionID() of its connection
+	Addr          net.Addr             // Remote address of the connection
+	HeloName      string               // Name given by the client with HELO, EHLO or LHLO
+	Authenticated bool                 // Client authenticated successfully with AUTH
+	TLS           *tls.ConnectionState // TLS connection state, nil until TLS is established
+	Commands      map[string]int       // Count of commands received by verb, unrecognized ones are counted under ""
+	Aborted       *Transaction         // Transaction left incomplete when the session ended
+	RcptParams    []string             // ESMTP parameters of the accepted RCPT of the current transaction, in order
+	MailSize      int                  // SIZE parameter of the current transaction, -1 if none
+	Transcript    *bytes.Buffer        // Timestamped dialog of the session before its first MAIL and of the current transaction, nil unless Server.TranscriptSize is set
+}
+
+// Transaction is the envelope of a mail transaction.
+type Transaction struct {
+	From string
+	To   []string
+	Data bool // DATA content was being received
+}
+
+// Network returns the name of the network of the remote address.
+func (p *Peer) Network() string { return p.Addr.Network() }
+
+// String returns the remote address.
+func (p *Peer) String() string { return p.Addr.String() }
+
+// LogFunc is a function capable of logging the client-server communication.
+type LogFunc func(remoteIP, verb, line string)
+
+// Server is an SMTP server.
+type Server struct {
+	Addr             string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	Appname          string
+	AuthHandler      AuthHandler
+	AuthMechs        map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired     bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	Extensions       []string        // Additional EHLO keywords, with their parameters, to advertise
+	PreauthHideExt   bool            // Only advertise STARTTLS and AUTH until the client is authenticated. Ignored if AuthHandler is not configured.
+	DisabledCmds     map[string]bool // Commands answered as if they were not recognized, e.g. VRFY or NOOP. Disabled extensions are not advertised.
+	MailParams       map[string]bool // MAIL parameter keywords accepted besides SIZE, e.g. RET and ENVID of DSN
+	Handler          Handler
+	HandlerClose     HandlerClose
+	HandlerMail      HandlerMail
+	HandlerRcpt      HandlerRcpt
+	HandlerRcptReply HandlerRcptReply
+	HandlerReply     HandlerReply
+	HandlerTLS       HandlerTLS
+	Hostname         string
+	LMTP             bool // Speak LMTP (RFC 2033): LHLO replaces HELO and EHLO, and DATA is answered once per recipient.
+	LogRead          LogFunc
+	LogWrite         LogFunc
+	MaxSize          int    // Maximum message size allowed, in bytes
+	AnnouncedSize    int    // Size announced by the EHLO SIZE extension instead of MaxSize, when not 0
+	MaxUnknownCmds   int    // Close the session after this many unrecognized commands, 0 means no limit
+	MaxLineLength    int    // Close the session when a command line is longer, CRLF excluded, 0 means no limit
+	NoopReply        string // Reply to NOOP instead of "250 2.0.0 Ok"
+	QuitReply        string // Reply to QUIT instead of "221 2.0.0 <hostname> ... Service closing transmission channel"
+	GreetingID       bool   // Append " [connid=<Peer.ID>]" to the banner
+	RejectFooter     string // Text appended to the replies rejecting a sender, a recipient or a message
+	TranscriptSize   int    // Maximum size of Peer.Transcript, no transcript if 0
+	ReadBufferSize   int    // Size of the buffered reader of sessions, bufio default if 0
+	WriteBufferSize  int    // Size of the buffered writer of sessions, bufio default if 0
+	Timeout          time.Duration
+	CmdTimeout       time.Duration // Maximum idle time waiting for a command, defaults to Timeout
+	FirstCmdTimeout  time.Duration // Maximum time waiting for the first command after the banner, defaults to CmdTimeout
+	DataTimeout      time.Duration // Maximum time to receive the whole DATA content, defaults to Timeout for each line
+	RcptPhaseTimeout time.Duration // Maximum time from the first RCPT of a transaction to DATA, no limit if 0
+	TLSConfig        *tls.Config
+	TLSListener      bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSRequired      bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	TLSLoopbackFree  bool // Do not require TLS from loopback clients with TLSRequired
+
+	inShutdown   int32 // server was closed or shutdown
+	openSessions int32 // count of open sessions
+	inData       int32 // count of sessions receiving or handling DATA
+	mu           sync.Mutex
+	shutdownChan chan struct{} // let the sessions know we are shutting down
+}
+
+// ConfigureTLS creates a TLS configuration from certificate and key files.
+func (srv *Server) ConfigureTLS(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// ConfigureTLSWithPassphrase creates a TLS configuration from a certificate,
+// an encrypted key file and the associated passphrase:
+func (srv *Server) ConfigureTLSWithPassphrase(
+	certFile string,
+	keyFile string,
+	passphrase string,
+) error {
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	var pemBlock pem.Block
+	pemBlock.Type = keyDERBlock.Type
+	pemBlock.Bytes = keyPEMDecrypted
+	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// ListenAndServe listens on the TCP network address srv.Addr and then
+// calls Serve to handle requests on incoming connections.  If
+// srv.Addr is blank, ":25" is used.
+func (srv *Server) ListenAndServe() error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
+	}
+
+	if srv.Addr == "" {
+		srv.Addr = ":25"
+	}
+	if srv.Appname == "" {
+		srv.Appname = "smtpd"
+	}
+	if srv.Hostname == "" {
+		srv.Hostname, _ = os.Hostname()
+	}
+	if srv.Timeout == 0 {
+		srv.Timeout = 5 * time.Minute
+	}
+
+	var ln net.Listener
+	var err error
+
+	// If TLSListener is enabled, listen for TLS connections only.
+	if srv.TLSConfig != nil && srv.TLSListener {
+		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
+	} else {
+		ln, err = net.Listen("tcp", srv.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve creates a new SMTP session after a network connection is established.
+func (srv *Server) Serve(ln net.Listener) error {
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return ErrServerClosed
+	}
+
+	defer ln.Close()
+	for {
+
+		// if we are shutting down, don't accept new connections
+		select {
+		case <-srv.getShutdownChan():
+			return ErrServerClosed
+		default:
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		session := srv.newSession(conn)
+		atomic.AddInt32(&srv.openSessions, 1)
+		go session.serve()
+	}
+}
+
+type session struct {
+	srv           *Server
+	conn          net.Conn
+	peer          *Peer
+	br            *bufio.Reader
+	bw            *bufio.Writer
+	remoteIP      string // Remote IP address
+	remoteHost    string // Remote hostname according to reverse DNS lookup
+	remoteName    string // Remote hostname as supplied with EHLO
+	tls           bool
+	authenticated bool
+	unknownCmds   int       // Number of unrecognized commands received
+	gotCmd        bool      // A command line was received
+	rcptDeadline  time.Time // DATA must start before, set by the first RCPT of a transaction
+	inAuth        bool      // Lines read are AUTH credentials, hidden from the transcript
+	transcriptEnd bool      // The transcript reached TranscriptSize
+	transcriptPre int       // Transcript length before the first MAIL, -1 until then
+	lastEntry     int       // Transcript length before the last line transcribed
+}
+
+// Create new session from connection.
+func (srv *Server) newSession(conn net.Conn) (s *session) {
+	s = &session{
+		srv:           srv,
+		conn:          conn,
+		transcriptPre: -1,
+	}
+	s.newBuffers()
+
+	// Get remote end info for the Received header.
+	s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
+	names, err := net.LookupAddr(s.remoteIP)
+	if err == nil && len(names) > 0 {
+		s.remoteHost = names[0]
+	} else {
+		s.remoteHost = "unknown"
+	}
+
+	// Set tls = true if TLS is already in use.
+	_, s.tls = s.conn.(*tls.Conn)
+	s.peer = &Peer{ID: sessionID(conn), Addr: s.conn.RemoteAddr(), Commands: make(map[string]int), MailSize: -1}
+	if srv.TranscriptSize > 0 {
+		s.peer.Transcript = &bytes.Buffer{}
+	}
+
+	return
+}
+
+// sessionID returns the identifier of the session of conn: the one given by
+// its SessionID method, e.g. to match the files written by a listener
+// wrapping the connections, or else a random one.
+func sessionID(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if c, ok := conn.(interface{ SessionID() string }); ok {
+		return c.SessionID()
+	}
+	return newSessionID()
+}
+
+// newSessionID returns a random hexadecimal session identifier.
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (srv *Server) getShutdownChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
+	}
+
+	return srv.shutdownChan
+}
+
+func (srv *Server) closeShutdownChan() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownChan == nil {
+		srv.shutdownChan = make(chan struct{})
+	}
+
+	select {
+	case <-srv.shutdownChan:
+	default:
+		close(srv.shutdownChan)
+	}
+}
+
+// Activity returns the number of open sessions, and how many of them are
+// receiving or handling mail data.
+func (srv *Server) Activity() (sessions, deliveries int) {
+	return int(atomic.LoadInt32(&srv.openSessions)), int(atomic.LoadInt32(&srv.inData))
+}
+
+// Close - closes the connection without waiting
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+	return nil
+}
+
+// Shutdown - waits for current sessions to complete before closing
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+
+	// wait for up to 30 seconds to allow the current sessions to
+	// end
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+
+	for i := 0; i < 300; i++ {
+
+		// wait for open sessions to close
+		if atomic.LoadInt32(&srv.openSessions) == 0 {
+			break
+		}
+
+		select {
+		case <-timer.C:
+			timer.Reset(100 * time.Millisecond)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Function called to handle connection requests.
+func (s *session) serve() {
+	defer atomic.AddInt32(&s.srv.openSessions, -1)
+	defer s.conn.Close()
+	if s.srv.HandlerClose != nil {
+		defer s.srv.HandlerClose(s.peer)
+	}
+
+	var from string
+	var gotFrom bool
+	var to []string
+	var inData bool
+	var buffer bytes.Buffer
+
+	// Record a transaction the client did not complete.
+	defer func() {
+		if gotFrom {
+			s.peer.Aborted = &Transaction{From: from, To: to, Data: inData}
+		}
+	}()
+
+	// Complete the handshake of TLS only connections to know the TLS state.
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		if s.srv.Timeout > 0 {
+			s.conn.SetDeadline(time.Now().Add(s.srv.Timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		state := tlsConn.ConnectionState()
+		s.peer.TLS = &state
+		if s.srv.HandlerTLS != nil {
+			s.srv.HandlerTLS(s.peer)
+		}
+	}
+
+	// Send banner.
+	banner := fmt.Sprintf("220 %s %s %s Service ready", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+	if s.srv.GreetingID {
+		banner += " [connid=" + s.peer.ID + "]"
+	}
+	s.writef("%s", banner)
+
+loop:
+	for {
+		if !gotFrom {
+			s.rcptDeadline = time.Time{}
+		}
+
+		// Attempt to read a line from the socket.
+		// On timeout, send a timeout message and return from serve().
+		// On error, assume the client has gone away i.e. return from serve().
+		line, err := s.readLine()
+		if err != nil {
+			if err == errLineTooLong {
+				log.Println(s.remoteIP, "LINE TOO LONG")
+				s.writef("%s", err)
+				break
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if !s.gotCmd && s.srv.FirstCmdTimeout > 0 {
+					log.Println(s.remoteIP, "TIMEOUT", "waiting for the first command")
+					s.writef("421 4.4.2 No greeting received in time")
+					break
+				}
+				if !s.rcptDeadline.IsZero() && !time.Now().Before(s.rcptDeadline) {
+					log.Println(s.remoteIP, "TIMEOUT", "waiting for DATA after RCPT")
+					s.writef("421 4.4.2 %s %s %s Service closing transmission channel, DATA not started in time", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+					break
+				}
+				log.Println(s.remoteIP, "TIMEOUT", "waiting for a command")
+				s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+			}
+			break
+		}
+		s.gotCmd = true
+
+		verb, args := s.parseLine(line)
+		if knownVerbs[verb] {
+			s.peer.Commands[verb]++
+		} else {
+			s.peer.Commands[""]++
+		}
+
+		if s.srv.DisabledCmds[verb] {
+			s.writef("500 5.5.1 Command not recognized")
+			continue
+		}
+
+		// RFC 2033 section 4.1: LHLO is the only greeting command in LMTP.
+		if s.srv.LMTP && (verb == "HELO" || verb == "EHLO") || !s.srv.LMTP && verb == "LHLO" {
+			verb = ""
+		} else if verb == "LHLO" {
+			verb = "EHLO"
+		}
+
+		switch verb {
+		case "HELO":
+			s.remoteName = args
+			s.peer.HeloName = args
+			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
+
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
+			from = ""
+			gotFrom = false
+			to = nil
+			buffer.Reset()
+		case "EHLO":
+			s.remoteName = args
+			s.peer.HeloName = args
+			s.writef("%s", s.makeEHLOResponse())
+
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
+			from = ""
+			gotFrom = false
+			to = nil
+			buffer.Reset()
+		case "MAIL":
+			// The transcript keeps the dialog of the transaction MAIL starts.
+			if s.transcriptPre < 0 {
+				s.transcriptPre = s.lastEntry
+			} else {
+				s.resetTranscript(s.lastEntry)
+			}
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+
+			match := mailFromRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
+			} else {
+				// Validate the SIZE parameter if one was sent.
+				sizeOk := true
+				declared := -1
+				if len(match[2]) > 0 { // A parameter is present
+					sizeOk = false
+					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
+					if sizeMatch == nil && s.srv.acceptsMailParams(match[3]) {
+						sizeOk = true
+					} else if sizeMatch == nil {
+						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+					} else {
+						// Enforce the maximum message size if one is set, before any data is sent.
+						// Sizes overflowing an int are above any limit.
+						size, err := strconv.Atoi(sizeMatch[1])
+						if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange && s.srv.MaxSize > 0 {
+							size, err = s.srv.MaxSize+1, nil
+						}
+						if err != nil { // Bad SIZE parameter
+							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
+							// RFC 3463: 5.2.3 is a message length above an administrative limit.
+							s.writef("%s", s.srv.RejectReply(fmt.Sprintf("552 5.2.3 Message too large, maximum size is %d bytes", s.srv.MaxSize)))
+						} else { // SIZE ok
+							sizeOk = true
+							declared = size
+						}
+					}
+				}
+				var err error
+				if sizeOk {
+					s.peer.MailSize = declared
+				}
+				if sizeOk && s.srv.HandlerMail != nil {
+					err = s.srv.HandlerMail(s.peer, match[1])
+				}
+				if sizeOk && err != nil {
+					s.writef("%s", s.srv.errorReply(err, "451 4.3.0 Requested action aborted: local error in processing"))
+				} else if sizeOk {
+					from = match[1]
+					gotFrom = true
+					s.writef("250 2.1.0 Ok")
+				}
+			}
+			to = nil
+			s.rcptDeadline = time.Time{}
+			buffer.Reset()
+		case "RCPT":
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
+				break
+			}
+			if s.srv.RcptPhaseTimeout > 0 && s.rcptDeadline.IsZero() {
+				s.rcptDeadline = time.Now().Add(s.srv.RcptPhaseTimeout)
+			}
+
+			match := rcptToRE.FindStringSubmatch(args)
+			if match == nil {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			} else {
+				// RFC 5321 specifies 100 minimum recipients
+				if len(to) == 100 {
+					s.writef("452 4.5.3 Too many recipients")
+				} else {
+					accept := true
+					if s.srv.HandlerRcpt != nil {
+						accept = s.srv.HandlerRcpt(s.peer, from, match[1])
+					}
+					var err error
+					if accept && s.srv.HandlerRcptReply != nil {
+						err = s.srv.HandlerRcptReply(s.peer, from, match[1])
+					}
+					if !accept {
+						s.writef("%s", s.srv.RejectReply("550 5.1.0 Requested action not taken: mailbox unavailable"))
+					} else if err != nil {
+						s.writef("%s", s.srv.errorReply(err, "550 5.1.0 Requested action not taken: mailbox unavailable"))
+					} else {
+						if len(to) == 0 {
+							s.peer.RcptParams = nil
+						}
+						to = append(to, match[1])
+						s.peer.RcptParams = append(s.peer.RcptParams, strings.TrimSpace(match[3]))
+						s.writef("250 2.1.5 Ok")
+					}
+				}
+			}
+		case "DATA":
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+			if !gotFrom || len(to) == 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
+				break
+			}
+
+			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
+
+			// Attempt to read message body from the socket.
+			// On timeout, send a timeout message and return from serve().
+			// On net.Error, assume the client has gone away i.e. return from serve().
+			// On other errors, allow the client to try again.
+			inData = true
+			atomic.AddInt32(&s.srv.inData, 1)
+			data, err := s.readData()
+			s.transcribe("C:", fmt.Sprintf("<%d bytes of message data>", len(data)))
+			if _, tooBig := err.(maxSizeExceededError); err == nil || tooBig {
+				inData = false
+			}
+			if err != nil {
+				atomic.AddInt32(&s.srv.inData, -1)
+				switch err.(type) {
+				case net.Error:
+					if err.(net.Error).Timeout() {
+						log.Println(s.remoteIP, "TIMEOUT", "receiving DATA")
+						s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+					}
+					break loop
+				case maxSizeExceededError:
+					s.writeDataReply(to, err)
+				default:
+					// The client has gone away.
+					if err == io.EOF {
+						break loop
+					}
+					s.writeDataReply(to, errors.New("451 4.3.0 Requested action aborted: local error in processing"))
+				}
+				from = ""
+				gotFrom = false
+				to = nil
+				continue
+			}
+
+			// Create Received header & write message body into buffer.
+			buffer.Reset()
+			buffer.Write(s.makeHeaders(to))
+			buffer.Write(data)
+
+			// Pass mail on to handler.
+			if s.srv.Handler != nil {
+				err = s.srv.Handler(s.peer, from, to, buffer.Bytes())
+			}
+			s.writeDataReply(to, err)
+			atomic.AddInt32(&s.srv.inData, -1)
+
+			// Reset for next mail, the transaction is over whatever the reply.
+			from = ""
+			gotFrom = false
+			to = nil
+			buffer.Reset()
+		case "QUIT":
+			if s.srv.QuitReply != "" {
+				s.writef("%s", s.srv.QuitReply)
+			} else {
+				s.writef("221 2.0.0 %s %s %s Service closing transmission channel", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+			}
+			break loop
+		case "RSET":
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			s.writef("250 2.0.0 Ok")
+			from = ""
+			gotFrom = false
+			to = nil
+			buffer.Reset()
+			s.resetTranscript(-1)
+		case "NOOP":
+			if s.srv.NoopReply != "" {
+				s.writef("%s", s.srv.NoopReply)
+				break
+			}
+			s.writef("250 2.0.0 Ok")
+		case "HELP", "VRFY", "EXPN":
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("502 5.5.1 Command not implemented")
+		case "STARTTLS":
+			// Parameters are not allowed (RFC 3207 section 4).
+			if args != "" {
+				s.writef("501 5.5.2 Syntax error (no parameters allowed)")
+				break
+			}
+
+			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.TLSConfig == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// Handle case where STARTTLS is received when TLS is already in use.
+			if s.tls {
+				s.writef("503 5.5.1 Bad sequence of commands (TLS already in use)")
+				break
+			}
+
+			s.writef("220 2.0.0 Ready to start TLS")
+
+			// Establish a TLS connection with the client.
+			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
+			err := tlsConn.Handshake()
+			if err != nil {
+				s.writef("403 4.7.0 TLS handshake failed")
+				break
+			}
+
+			// TLS handshake succeeded, switch to using the TLS connection.
+			s.conn = tlsConn
+			s.newBuffers()
+			s.tls = true
+			state := tlsConn.ConnectionState()
+			s.peer.TLS = &state
+			if s.srv.HandlerTLS != nil {
+				s.srv.HandlerTLS(s.peer)
+			}
+
+			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
+			s.remoteName = ""
+			s.peer.HeloName = ""
+			from = ""
+			gotFrom = false
+			to = nil
+			buffer.Reset()
+		case "AUTH":
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
+			if s.srv.AuthHandler == nil {
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+
+			// Handle case where AUTH is received when already authenticated.
+			if s.authenticated {
+				s.writef("503 5.5.1 Bad sequence of commands (already authenticated for this session)")
+				break
+			}
+
+			// RFC 4954 specifies that AUTH is not permitted during mail transactions.
+			if gotFrom || len(to) > 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (AUTH not permitted during mail transaction)")
+				break
+			}
+
+			// RFC 4954 requires a mechanism parameter.
+			authType, authArgs := s.parseLine(args)
+			if authType == "" {
+				s.writef("501 5.5.4 Malformed AUTH input (argument required)")
+				break
+			}
+
+			// RFC 4954 requires rejecting unsupported authentication mechanisms with a 504 response.
+			allowedAuth := s.authMechs()
+			if allowed, found := allowedAuth[authType]; !found || !allowed {
+				s.writef("504 5.5.4 Unrecognized authentication type")
+				break
+			}
+
+			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments") should be returned
+			// when attempting to use an unsupported authentication type.
+			// Many servers return 5.7.4 ("Security features not supported") instead.
+			s.inAuth = true
+			switch authType {
+			case "PLAIN":
+				s.authenticated, err = s.handleAuthPlain(authArgs)
+			case "LOGIN":
+				s.authenticated, err = s.handleAuthLogin(authArgs)
+			case "CRAM-MD5":
+				s.authenticated, err = s.handleAuthCramMD5()
+			}
+			s.inAuth = false
+
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.writef("421 4.4.2 %s %s %s Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+					break loop
+				}
+
+				s.writef(err.Error())
+				if err == errLineTooLong {
+					break loop
+				}
+				break
+			}
+
+			if s.authenticated {
+				s.peer.Authenticated = true
+				s.writef("235 2.7.0 Authentication successful")
+			} else {
+				s.writef("535 5.7.8 Authentication credentials invalid")
+			}
+		default:
+			s.unknownCmds++
+			if Debug {
+				log.Println(s.remoteIP, "UNKNOWN", line)
+			}
+			if s.srv.MaxUnknownCmds > 0 && s.unknownCmds > s.srv.MaxUnknownCmds {
+				log.Println(s.remoteIP, "TOO MANY UNKNOWN COMMANDS", s.unknownCmds)
+				s.writef("421 4.7.0 %s %s %s Service closing transmission channel after too many unrecognized commands", s.srv.Hostname, s.srv.Appname, s.srv.protocol())
+				break loop
+			}
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.writef("500 5.5.2 Syntax error, command unrecognized")
+		}
+	}
+}
+
+// Name of the protocol spoken by the server, as announced in banners.
+func (srv *Server) protocol() string {
+	if srv.LMTP {
+		return "LMTP"
+	}
+	return "ESMTP"
+}
+
+// Reply to the end of the DATA phase.
+// Handler errors formatted as an SMTP reply are sent as is, others are reported
+// as a local processing failure. LMTP sends one reply per recipient.
+func (s *session) writeDataReply(to []string, err error) {
+	if !s.srv.LMTP {
+		s.writef("%s", s.srv.dataReply(err))
+		return
+	}
+	rcptErrs, perRcpt := err.(RcptErrors)
+	for i := range to {
+		if perRcpt {
+			err = nil
+			if i < len(rcptErrs) {
+				err = rcptErrs[i]
+			}
+		}
+		s.writef("%s", s.srv.dataReply(err))
+	}
+}
+
+func (srv *Server) dataReply(err error) string {
+	if err == nil {
+		return "250 2.0.0 Ok: queued"
+	}
+	return srv.errorReply(err, "451 4.3.5 Unable to process mail")
+}
+
+// Reply to a handler error, using fallback if it is not an SMTP reply.
+func (srv *Server) errorReply(err error, fallback string) string {
+	if replyRE.MatchString(err.Error()) {
+		return srv.RejectReply(err.Error())
+	}
+	return srv.RejectReply(fallback)
+}
+
+// RejectReply appends RejectFooter to a single line 4xx or 5xx reply. The
+// footer goes on a continuation line when the reply would exceed the 512
+// bytes limit of RFC 5321 section 4.5.3.1.5.
+func (srv *Server) RejectReply(reply string) string {
+	if srv.RejectFooter == "" || len(reply) < 4 || reply[0] != '4' && reply[0] != '5' || reply[3] != ' ' || strings.Contains(reply, "\n") {
+		return reply
+	}
+	if len(reply)+len("; ")+len(srv.RejectFooter)+len("\r\n") <= 512 {
+		return reply + "; " + srv.RejectFooter
+	}
+	code, text := reply[:3], reply[4:]
+	return code + "-" + text + "\r\n" + code + " " + enhancedRE.FindString(text) + srv.RejectFooter
+}
+
+// acceptsMailParams reports whether all the MAIL parameters are in MailParams.
+func (srv *Server) acceptsMailParams(params string) bool {
+	fields := strings.Fields(params)
+	for _, param := range fields {
+		if !srv.MailParams[strings.ToUpper(strings.SplitN(param, "=", 2)[0])] {
+			return false
+		}
+	}
+	return len(fields) > 0
+}
+
+// newBuffers creates the buffered reader and writer of the connection.
+func (s *session) newBuffers() {
+	s.br = bufio.NewReader(s.conn)
+	if s.srv.ReadBufferSize > 0 {
+		s.br = bufio.NewReaderSize(s.conn, s.srv.ReadBufferSize)
+	}
+	s.bw = bufio.NewWriter(s.conn)
+	if s.srv.WriteBufferSize > 0 {
+		s.bw = bufio.NewWriterSize(s.conn, s.srv.WriteBufferSize)
+	}
+}
+
+// Wrapper function for writing a complete line to the socket.
+func (s *session) writef(format string, args ...interface{}) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	line := fmt.Sprintf(format, args...)
+	s.bw.WriteString(line + "\r\n")
+	err := s.bw.Flush()
+	for _, l := range strings.Split(line, "\r\n") {
+		s.transcribe("S:", l)
+	}
+	if s.srv.HandlerReply != nil {
+		s.srv.HandlerReply(s.peer, line)
+	}
+
+	if Debug {
+		verb := "WROTE"
+		if s.srv.LogWrite != nil {
+			s.srv.LogWrite(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
+		}
+	}
+
+	return err
+}
+
+// tlsRequired reports whether TLS is required from the client.
+func (s *session) tlsRequired() bool {
+	if s.srv.TLSConfig == nil || !s.srv.TLSRequired {
+		return false
+	}
+	return !s.srv.TLSLoopbackFree || !net.ParseIP(s.remoteIP).IsLoopback()
+}
+
+// Add a line of the dialog to the transcript, prefixed by the time and by
+// who sent it.
+func (s *session) transcribe(who, line string) {
+	if s.peer.Transcript == nil {
+		return
+	}
+	s.lastEntry = s.peer.Transcript.Len()
+	if s.transcriptEnd {
+		return
+	}
+	entry := time.Now().Format("15:04:05.000") + " " + who + " " + line + "\n"
+	if s.peer.Transcript.Len()+len(entry) > s.srv.TranscriptSize {
+		s.peer.Transcript.WriteString("[transcript truncated]\n")
+		s.transcriptEnd = true
+		return
+	}
+	s.peer.Transcript.WriteString(entry)
+}
+
+// Drop the dialog of the previous transaction from the transcript, up to
+// end or to its end if negative, keeping what preceded the first MAIL.
+func (s *session) resetTranscript(end int) {
+	if s.peer.Transcript == nil || s.transcriptPre < 0 {
+		return
+	}
+	b := s.peer.Transcript.Bytes()
+	if end < 0 {
+		end = len(b)
+	}
+	kept := append(append([]byte(nil), b[:s.transcriptPre]...), b[end:]...)
+	s.peer.Transcript.Reset()
+	s.peer.Transcript.Write(kept)
+	s.transcriptEnd = false
+}
+
+// Read a line up to its \n, failing with errLineTooLong as soon as more than
+// MaxLineLength bytes are buffered.
+func (s *session) readBoundedString() (string, error) {
+	if s.srv.MaxLineLength <= 0 {
+		return s.br.ReadString('\n')
+	}
+	var line []byte
+	for {
+		chunk, err := s.br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(bytes.TrimRight(line, "\r\n")) > s.srv.MaxLineLength {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Read a complete line from the socket.
+func (s *session) readLine() (string, error) {
+	var deadline time.Time
+	if !s.gotCmd && s.srv.FirstCmdTimeout > 0 {
+		deadline = time.Now().Add(s.srv.FirstCmdTimeout)
+	} else if s.srv.CmdTimeout > 0 {
+		deadline = time.Now().Add(s.srv.CmdTimeout)
+	} else if s.srv.Timeout > 0 {
+		deadline = time.Now().Add(s.srv.Timeout)
+	}
+	// The RCPT phase deadline cuts the command timeout short.
+	if !s.rcptDeadline.IsZero() && (deadline.IsZero() || s.rcptDeadline.Before(deadline)) {
+		deadline = s.rcptDeadline
+	}
+	if !deadline.IsZero() {
+		s.conn.SetReadDeadline(deadline)
+	}
+
+	line, err := s.readBoundedString()
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line) // Strip trailing \r\n
+
+	// Keep credentials out of the transcript.
+	if s.inAuth {
+		s.transcribe("C:", "***")
+	} else if fields := strings.Fields(line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		s.transcribe("C:", fields[0]+" "+fields[1]+" ***")
+	} else {
+		s.transcribe("C:", line)
+	}
+
+	if Debug {
+		verb := "READ"
+		if s.srv.LogRead != nil {
+			s.srv.LogRead(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.remoteIP, verb, line)
+		}
+	}
+
+	return line, err
+}
+
+// Parse a line read from the socket.
+func (s *session) parseLine(line string) (verb string, args string) {
+	if idx := strings.Index(line, " "); idx != -1 {
+		verb = strings.ToUpper(line[:idx])
+		args = strings.TrimSpace(line[idx+1:])
+	} else {
+		verb = strings.ToUpper(line)
+		args = ""
+	}
+	return verb, args
+}
+
+// Read the message data following a DATA command.
+func (s *session) readData() ([]byte, error) {
+	var data []byte
+	if s.srv.DataTimeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.DataTimeout))
+	}
+	for {
+		if s.srv.DataTimeout == 0 && s.srv.Timeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+		}
+
+		line, err := s.br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		// Handle end of data denoted by lone period (\r\n.\r\n)
+		if bytes.Equal(line, []byte(".\r\n")) {
+			break
+		}
+		// Remove leading period (RFC 5321 section 4.5.2)
+		if line[0] == '.' {
+			line = line[1:]
+		}
+
+		// Enforce the maximum message size limit.
+		if s.srv.MaxSize > 0 {
+			if len(data)+len(line) > s.srv.MaxSize {
+				_, _ = s.br.Discard(s.br.Buffered()) // Discard the buffer remnants.
+				return nil, maxSizeExceeded(s.srv.MaxSize)
+			}
+		}
+
+		data = append(data, line...)
+	}
+	return data, nil
+}
+
+// Create the Received header to comply with RFC 2821 section 3.8.2.
+// TODO: Work out what to do with multiple to addresses.
+func (s *session) makeHeaders(to []string) []byte {
+	var buffer bytes.Buffer
+	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
+	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
+	with := "SMTP"
+	if s.srv.LMTP {
+		with = "LMTP"
+	}
+	buffer.WriteString(fmt.Sprintf("        by %s (%s) with %s\r\n", s.srv.Hostname, s.srv.Appname, with))
+	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+	return buffer.Bytes()
+}
+
+// Determine allowed authentication mechanisms.
+// RFC 4954 specifies that plaintext authentication mechanisms such as LOGIN and PLAIN require a TLS connection.
+// This can be explicitly overridden e.g. setting s.srv.AuthMechs["LOGIN"] = true.
+func (s *session) authMechs() (mechs map[string]bool) {
+	mechs = map[string]bool{"LOGIN": s.tls, "PLAIN": s.tls, "CRAM-MD5": true}
+
+	for mech := range mechs {
+		allowed, found := s.srv.AuthMechs[mech]
+		if found {
+			mechs[mech] = allowed
+		}
+	}
+
+	return
+}
+
+// Create the greeting string sent in response to an EHLO command.
+func (s *session) makeEHLOResponse() (response string) {
+	lines := append([]string{fmt.Sprintf("%s greets %s", s.srv.Hostname, s.remoteName)}, s.ehloExtensions()...)
+	for _, line := range lines[:len(lines)-1] {
+		response += "250-" + line + "\r\n"
+	}
+	response += "250 " + lines[len(lines)-1]
+	return
+}
+
+// EHLOExtensions returns the extensions advertised in response to EHLO by a
+// session in the given TLS and authentication state.
+func (srv *Server) EHLOExtensions(tls, authenticated bool) []string {
+	s := &session{srv: srv, tls: tls, authenticated: authenticated}
+	return s.ehloExtensions()
+}
+
+// ehloExtensions lists the extensions of the EHLO response, one per line.
+func (s *session) ehloExtensions() (lines []string) {
+	// Unauthenticated clients only learn how to authenticate.
+	hide := s.srv.PreauthHideExt && s.srv.AuthHandler != nil && !s.authenticated
+
+	if !hide {
+		// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
+		size := s.srv.MaxSize
+		if s.srv.AnnouncedSize != 0 {
+			size = s.srv.AnnouncedSize
+		}
+		lines = append(lines, fmt.Sprintf("SIZE %d", size))
+	}
+
+	// Only list STARTTLS if TLS is configured, but not currently in use.
+	if s.srv.TLSConfig != nil && !s.tls && !s.srv.DisabledCmds["STARTTLS"] {
+		lines = append(lines, "STARTTLS")
+	}
+
+	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed.
+	if s.srv.AuthHandler != nil && !s.srv.DisabledCmds["AUTH"] {
+		var mechs []string
+		for mech, allowed := range s.authMechs() {
+			if allowed {
+				mechs = append(mechs, mech)
+			}
+		}
+		sort.Strings(mechs)
+		if len(mechs) > 0 {
+			lines = append(lines, "AUTH "+strings.Join(mechs, " "))
+		}
+	}
+
+	if !hide {
+		lines = append(lines, s.srv.Extensions...)
+		lines = append(lines, "ENHANCEDSTATUSCODES")
+	}
+	return
+}
+
+func (s *session) handleAuthLogin(arg string) (bool, error) {
+	var err error
+
+	if arg == "" {
+		s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	username, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+	line, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
+
+	password, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.peer, "LOGIN", username, password, nil)
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthPlain(arg string) (bool, error) {
+	var err error
+
+	// If fast mode (AUTH PLAIN [arg]) is not used, prompt for credentials.
+	if arg == "" {
+		s.writef("334 ")
+		arg, err = s.readLine()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.peer, "PLAIN", parts[1], parts[2], nil)
+
+	return authenticated, err
+}
+
+func (s *session) handleAuthCramMD5() (bool, error) {
+	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(time.Now().Nanosecond()) + "@" + s.srv.Hostname + ">"
+
+	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte(shared)))
+
+	data, err := s.readLine()
+	if err != nil {
+		return false, err
+	}
+
+	if data == "*" {
+		return false, errors.New("501 5.7.0 Authentication cancelled")
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+	}
+
+	fields := strings.Split(string(buf), " ")
+	if len(fields) < 2 {
+		return false, errors.New("501 5.5.2 Syntax error (unable to parse)")
+	}
+
+	// Validate credentials.
+	authenticated, err := s.srv.AuthHandler(s.peer, "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+
+	return authenticated, err
+}
@@ -0,0 +1,402 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSession runs a server session on one end of a pipe and returns the
+// client end, past the banner.
+func testSession(t *testing.T, srv *Server) *textproto.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	go srv.newSession(server).serve()
+	c := textproto.NewConn(client)
+	t.Cleanup(func() { c.Close() })
+	if code, msg, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("banner: %d %s: %v", code, msg, err)
+	}
+	return c
+}
+
+// cmd sends a command and checks the code of its reply.
+func cmd(t *testing.T, c *textproto.Conn, want int, format string, args ...interface{}) {
+	t.Helper()
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	if code, msg, _ := c.ReadResponse(0); code != want {
+		t.Fatalf("%q: got %d %s, want %d", format, code, msg, want)
+	}
+}
+
+// sendMail runs a transaction up to the end of data, returning the reply
+// codes read after it.
+func sendMail(t *testing.T, c *textproto.Conn, to []string, replies int) []int {
+	t.Helper()
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	for _, rcpt := range to {
+		cmd(t, c, 250, "RCPT TO:<%s>", rcpt)
+	}
+	cmd(t, c, 354, "DATA")
+	if err := c.PrintfLine("Subject: test\r\n\r\nbody\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	var codes []int
+	for i := 0; i < replies; i++ {
+		code, _, err := c.ReadResponse(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func TestLMTPReplyPerRecipient(t *testing.T) {
+	to := []string{"a@example.com", "b@example.com", "c@example.com"}
+	tests := []struct {
+		name string
+		err  error
+		want []int
+	}{
+		{"accepted", nil, []int{250, 250, 250}},
+		{"per recipient", RcptErrors{nil, errors.New("550 5.1.1 No such user"), errors.New("452 4.2.2 Mailbox full")}, []int{250, 550, 452}},
+		{"short list", RcptErrors{errors.New("552 5.2.2 Over quota")}, []int{552, 250, 250}},
+		{"same error", errors.New("554 5.6.0 Rejected"), []int{554, 554, 554}},
+		{"local failure", errors.New("disk full"), []int{451, 451, 451}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			srv := &Server{Hostname: "mx.example.com", Appname: "test", LMTP: true,
+				Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+					got = to
+					return tt.err
+				}}
+			c := testSession(t, srv)
+			cmd(t, c, 250, "LHLO client.example.org")
+			codes := sendMail(t, c, to, len(to))
+			for i := range tt.want {
+				if codes[i] != tt.want[i] {
+					t.Errorf("replies: got %v, want %v", codes, tt.want)
+					break
+				}
+			}
+			if len(got) != len(to) {
+				t.Errorf("handler recipients: got %v, want %v", got, to)
+			}
+			cmd(t, c, 221, "QUIT")
+		})
+	}
+}
+
+func TestSMTPSingleReply(t *testing.T) {
+	srv := &Server{Hostname: "mx.example.com", Appname: "test",
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			return RcptErrors{nil, errors.New("550 5.1.1 No such user")}
+		}}
+	c := testSession(t, srv)
+	cmd(t, c, 250, "EHLO client.example.org")
+	if codes := sendMail(t, c, []string{"a@example.com", "b@example.com"}, 1); codes[0] != 550 {
+		t.Errorf("got %v, want the first error", codes)
+	}
+	// The next command gets its own reply, there is no other DATA reply.
+	cmd(t, c, 250, "NOOP")
+}
+
+func TestLMTPGreeting(t *testing.T) {
+	srv := &Server{Hostname: "mx.example.com", Appname: "test", LMTP: true}
+	c := testSession(t, srv)
+	cmd(t, c, 500, "EHLO client.example.org")
+	cmd(t, c, 500, "HELO client.example.org")
+	cmd(t, c, 250, "LHLO client.example.org")
+
+	srv = &Server{Hostname: "mx.example.com", Appname: "test"}
+	c = testSession(t, srv)
+	cmd(t, c, 500, "LHLO client.example.org")
+}
+
+func TestTranscriptPerTransaction(t *testing.T) {
+	var transcripts []string
+	srv := &Server{Hostname: "mx.example.com", Appname: "test", TranscriptSize: 4096,
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			transcripts = append(transcripts, remoteAddr.(*Peer).Transcript.String())
+			return nil
+		}}
+	c := testSession(t, srv)
+	cmd(t, c, 250, "EHLO client.example.org")
+	sendMail(t, c, []string{"first@example.com"}, 1)
+	cmd(t, c, 250, "MAIL FROM:<aborted@example.org>")
+	cmd(t, c, 250, "RSET")
+	sendMail(t, c, []string{"second@example.com"}, 1)
+
+	if len(transcripts) != 2 {
+		t.Fatalf("got %d transcripts, want 2", len(transcripts))
+	}
+	for i, want := range []string{"first@example.com", "second@example.com"} {
+		tr := transcripts[i]
+		if !strings.Contains(tr, "C: EHLO client.example.org") || !strings.Contains(tr, want) {
+			t.Errorf("transcript %d lacks the greeting or %s:\n%s", i+1, want, tr)
+		}
+	}
+	if tr := transcripts[1]; strings.Contains(tr, "first@") || strings.Contains(tr, "aborted@") || strings.Contains(tr, "RSET") {
+		t.Errorf("second transcript holds previous transactions:\n%s", tr)
+	}
+}
+
+// TestEHLOExtensions checks that EHLOExtensions lists what EHLO replies,
+// keywords with a % sign included.
+// TestRSETRecipients fills a transaction up to the recipient limit, and
+// checks RSET starts the next one with an empty recipient list.
+func TestRSETRecipients(t *testing.T) {
+	var delivered []string
+	c := testSession(t, &Server{Hostname: "mx.example.com",
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			delivered = to
+			return nil
+		}})
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	for i := 0; i < 100; i++ {
+		cmd(t, c, 250, "RCPT TO:<user%d@example.com>", i)
+	}
+	cmd(t, c, 452, "RCPT TO:<one-too-many@example.com>")
+	cmd(t, c, 250, "RSET")
+
+	to := make([]string, 100)
+	for i := range to {
+		to[i] = fmt.Sprintf("other%d@example.com", i)
+	}
+	if codes := sendMail(t, c, to, 1); codes[0] != 250 {
+		t.Fatalf("mail after RSET: %d", codes[0])
+	}
+	if len(delivered) != 100 || delivered[0] != to[0] {
+		t.Errorf("delivered to %d recipients starting with %q, want the 100 sent after RSET", len(delivered), delivered[0])
+	}
+}
+
+func TestEHLOExtensions(t *testing.T) {
+	auth := func(net.Addr, string, []byte, []byte, []byte) (bool, error) { return true, nil }
+	srv := &Server{
+		Hostname:      "mx.example.com",
+		MaxSize:       1000,
+		AnnouncedSize: 2000,
+		AuthHandler:   auth,
+		Extensions:    []string{"DSN", "X-FOO 100%d%%"},
+	}
+	want := []string{"SIZE 2000", "AUTH CRAM-MD5", "DSN", "X-FOO 100%d%%", "ENHANCEDSTATUSCODES"}
+	if got := srv.EHLOExtensions(false, false); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c := testSession(t, srv)
+	if err := c.PrintfLine("EHLO client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(msg, "\n"); strings.Join(lines[1:], "|") != strings.Join(want, "|") {
+		t.Errorf("EHLO: got %q, want %q", lines[1:], want)
+	}
+
+	srv.PreauthHideExt = true
+	if got := srv.EHLOExtensions(true, false); strings.Join(got, "|") != "AUTH CRAM-MD5 LOGIN PLAIN" {
+		t.Errorf("before AUTH: got %q", got)
+	}
+}
+
+// BenchmarkLargeMessage measures the throughput of 8MB messages sent over
+// TCP, per size of the session read buffer.
+func BenchmarkLargeMessage(b *testing.B) {
+	line := strings.Repeat("x", 998) + "\r\n"
+	data := strings.Repeat(line, 8<<20/len(line))
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("read-buffer-%d", size), func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			srv := &Server{Hostname: "mx.example.com", ReadBufferSize: size,
+				Handler: func(net.Addr, string, []string, []byte) error { return nil }}
+			go srv.Serve(ln)
+			defer srv.Close()
+
+			c, err := textproto.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			c.ReadResponse(220)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.PrintfLine("MAIL FROM:<sender@example.org>\r\nRCPT TO:<user@example.com>\r\nDATA")
+				for _, code := range []int{250, 250, 354} {
+					if _, msg, err := c.ReadResponse(code); err != nil {
+						b.Fatalf("%d: %s: %v", code, msg, err)
+					}
+				}
+				c.W.WriteString(data)
+				c.PrintfLine(".")
+				if _, msg, err := c.ReadResponse(250); err != nil {
+					b.Fatalf("end of data: %s: %v", msg, err)
+				}
+			}
+		})
+	}
+}
+
+// TestPeer checks the session details the handlers get through Peer.
+func TestPeer(t *testing.T) {
+	var peer *Peer
+	srv := &Server{Hostname: "mx.example.com", Appname: "test", GreetingID: true,
+		HandlerMail: func(remoteAddr net.Addr, from string) error {
+			peer = remoteAddr.(*Peer)
+			return nil
+		}}
+	server, client := net.Pipe()
+	go srv.newSession(server).serve()
+	c := textproto.NewConn(client)
+	defer c.Close()
+	_, banner, err := c.ReadResponse(220)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 500, "FOO")
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org> SIZE=1234")
+	cmd(t, c, 250, "RCPT TO:<a@example.com> NOTIFY=NEVER")
+	cmd(t, c, 250, "RCPT TO:<b@example.com>")
+
+	if peer == nil {
+		t.Fatal("HandlerMail not called")
+	}
+	if peer.ID == "" || !strings.Contains(banner, "[connid="+peer.ID+"]") {
+		t.Errorf("ID %q not in the banner %q", peer.ID, banner)
+	}
+	if peer.HeloName != "client.example.org" {
+		t.Errorf("HeloName: got %q", peer.HeloName)
+	}
+	if peer.Commands["EHLO"] != 1 || peer.Commands["NOOP"] != 1 || peer.Commands["RCPT"] != 2 || peer.Commands[""] != 1 {
+		t.Errorf("Commands: got %v", peer.Commands)
+	}
+	if peer.MailSize != 1234 {
+		t.Errorf("MailSize: got %d, want 1234", peer.MailSize)
+	}
+	if strings.Join(peer.RcptParams, "|") != "NOTIFY=NEVER|" {
+		t.Errorf("RcptParams: got %q", peer.RcptParams)
+	}
+	if peer.Authenticated || peer.TLS != nil {
+		t.Errorf("Authenticated: %v, TLS: %v", peer.Authenticated, peer.TLS)
+	}
+}
+
+// TestHandlerHooks checks the replies of the MAIL and RCPT handlers, that
+// HandlerReply sees every reply and that HandlerClose gets the aborted
+// transaction.
+func TestHandlerHooks(t *testing.T) {
+	var replies []string
+	closed := make(chan *Peer, 1)
+	srv := &Server{Hostname: "mx.example.com", Appname: "test", RejectFooter: "see https://example.com/policy",
+		HandlerMail: func(remoteAddr net.Addr, from string) error {
+			if from == "spammer@example.org" {
+				return errors.New("550 5.7.1 Sender blocked")
+			}
+			return nil
+		},
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			return to != "nobody@example.com"
+		},
+		HandlerRcptReply: func(remoteAddr net.Addr, from string, to string) error {
+			if to == "full@example.com" {
+				return errors.New("452 4.2.2 Mailbox full")
+			}
+			return nil
+		},
+		HandlerReply: func(remoteAddr net.Addr, reply string) { replies = append(replies, reply) },
+		HandlerClose: func(remoteAddr net.Addr) { closed <- remoteAddr.(*Peer) },
+	}
+	c := testSession(t, srv)
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 550, "MAIL FROM:<spammer@example.org>")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	if err := c.PrintfLine("RCPT TO:<nobody@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(550); err != nil || !strings.Contains(msg, "see https://example.com/policy") {
+		t.Errorf("rejected recipient: %q, %v", msg, err)
+	}
+	cmd(t, c, 452, "RCPT TO:<full@example.com>")
+	cmd(t, c, 250, "RCPT TO:<user@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: cut short")
+	c.Close()
+
+	peer := <-closed
+	if peer.Aborted == nil || peer.Aborted.From != "sender@example.org" || len(peer.Aborted.To) != 1 || !peer.Aborted.Data {
+		t.Errorf("Aborted: got %+v", peer.Aborted)
+	}
+	if len(replies) != 8 || !strings.HasPrefix(replies[0], "220 ") || !strings.HasPrefix(replies[7], "354 ") {
+		t.Errorf("HandlerReply: got %q", replies)
+	}
+}
+
+// TestHandlerTLS checks that HandlerTLS is called after STARTTLS, with the
+// TLS state in Peer.
+func TestHandlerTLS(t *testing.T) {
+	cert := testCertificate(t)
+	handshakes := make(chan *tls.ConnectionState, 1)
+	srv := &Server{Hostname: "mx.example.com", Appname: "test",
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandlerTLS: func(remoteAddr net.Addr) { handshakes <- remoteAddr.(*Peer).TLS }}
+	server, client := net.Pipe()
+	go srv.newSession(server).serve()
+	c := textproto.NewConn(client)
+	c.ReadResponse(220)
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 220, "STARTTLS")
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	defer tc.Close()
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if state := <-handshakes; state == nil || !state.HandshakeComplete {
+		t.Errorf("Peer.TLS: got %+v", state)
+	}
+}
+
+// testCertificate returns a self-signed certificate for mx.example.com.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
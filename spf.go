@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var receivedSPF bool // Add a Received-SPF header to stored mails.
+
+// spfTimeout bounds a whole SPF evaluation (RFC 7208 section 4.6.4
+// recommends at least 20 seconds).
+const spfTimeout = 20 * time.Second
+
+// spfResolver resolves the DNS records of SPF evaluations.
+var spfResolver spfDNS = net.DefaultResolver
+
+// spfDNS is the part of net.Resolver used by SPF evaluations.
+type spfDNS interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// spfCacheTTL is the time a result is reused for the same IP and domain,
+// spfCacheSize bounds the number of results kept.
+const (
+	spfCacheTTL  = 10 * time.Minute
+	spfCacheSize = 10000
+)
+
+// spfVerdict is a cached check_host() result.
+type spfVerdict struct {
+	result, reason string
+	expiry         time.Time
+}
+
+var (
+	spfMu    sync.Mutex
+	spfCache = make(map[string]spfVerdict)
+)
+
+// spfChecker evaluates the check_host() function of RFC 7208 for a client.
+type spfChecker struct {
+	ctx     context.Context
+	ip      net.IP
+	sender  string // MAIL FROM, or postmaster@helo for the null sender
+	helo    string
+	lookups int  // Terms causing DNS lookups, at most 10
+	voids   int  // Lookups without answer, at most 2
+	private bool // A macro used the local part or the HELO name, the result is not cached
+}
+
+// errSPFPerm and errSPFTemp abort an evaluation with permerror or temperror.
+type errSPFPerm string
+type errSPFTemp string
+
+func (e errSPFPerm) Error() string { return string(e) }
+func (e errSPFTemp) Error() string { return string(e) }
+
+// spfHeader returns the Received-SPF header (RFC 7208 section 9.1) for the
+// MAIL FROM identity of a mail.
+func spfHeader(remoteAddr net.Addr, from string) string {
+	var helo string
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok {
+		helo = peer.HeloName
+	}
+	ip := remoteIP(remoteAddr)
+	sender, result, reason := spfCheck(remoteAddr, from)
+	return fmt.Sprintf("Received-SPF: %s (%s)\r\n\tclient-ip=%s; envelope-from=%s; helo=%s\r\n",
+		result, spfExplanation(result, reason, sender, ip), ip, spfValue(from), spfValue(helo))
+}
+
+// spfCheck returns the check_host() result of the MAIL FROM identity, or of
+// postmaster@helo for the null sender, cached by client IP and domain. It
+// is called at MAIL FROM so that the DNS lookups are done before DATA.
+func spfCheck(remoteAddr net.Addr, from string) (sender, result, reason string) {
+	var helo string
+	if peer, ok := remoteAddr.(*smtpd.Peer); ok {
+		helo = peer.HeloName
+	}
+	ip := remoteIP(remoteAddr)
+	sender = from
+	if from == "" {
+		sender = "postmaster@" + helo
+	}
+	domain := strings.ToLower(domainOf(sender))
+	key := ip.String() + " " + domain
+	spfMu.Lock()
+	v, ok := spfCache[key]
+	spfMu.Unlock()
+	if ok && time.Now().Before(v.expiry) {
+		return sender, v.result, v.reason
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+	defer cancel()
+	c := &spfChecker{ctx: ctx, ip: ip, sender: sender, helo: helo}
+	result, reason = c.checkHost(domain)
+	if !c.private && result != "temperror" {
+		spfMu.Lock()
+		if len(spfCache) >= spfCacheSize {
+			spfCache = make(map[string]spfVerdict)
+		}
+		spfCache[key] = spfVerdict{result: result, reason: reason, expiry: time.Now().Add(spfCacheTTL)}
+		spfMu.Unlock()
+	}
+	return sender, result, reason
+}
+
+// spfExplanation returns the comment of a Received-SPF header.
+func spfExplanation(result, reason, sender string, ip net.IP) string {
+	host := srv.Hostname
+	switch result {
+	case "pass":
+		return fmt.Sprintf("%s: domain of %s designates %s as permitted sender", host, sender, ip)
+	case "fail":
+		return fmt.Sprintf("%s: domain of %s does not designate %s as permitted sender", host, sender, ip)
+	case "softfail":
+		return fmt.Sprintf("%s: domain of transitioning %s does not designate %s as permitted sender", host, sender, ip)
+	case "neutral":
+		return fmt.Sprintf("%s: %s is neither permitted nor denied by domain of %s", host, ip, sender)
+	case "none":
+		return fmt.Sprintf("%s: domain of %s does not provide an SPF record", host, sender)
+	case "temperror":
+		return fmt.Sprintf("%s: error in processing during lookup of %s: %s", host, sender, reason)
+	}
+	return fmt.Sprintf("%s: permanent error in processing domain of %s: %s", host, sender, reason)
+}
+
+// spfValue formats a key-value-pair value, quoted unless it is a dot-atom.
+func spfValue(v string) string {
+	atom := v != "" && !strings.HasPrefix(v, ".") && !strings.HasSuffix(v, ".") && !strings.Contains(v, "..")
+	for _, r := range v {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>[]:;@\,"`, r) {
+			atom = false
+		}
+	}
+	if atom {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// checkHost returns the result of check_host() for domain, and the reason
+// of temperror and permerror results.
+func (c *spfChecker) checkHost(domain string) (result, reason string) {
+	result, err := c.evaluate(domain)
+	var perm errSPFPerm
+	var temp errSPFTemp
+	switch {
+	case errors.As(err, &temp):
+		return "temperror", err.Error()
+	case errors.As(err, &perm):
+		return "permerror", err.Error()
+	}
+	return result, ""
+}
+
+// evaluate runs check_host() for domain (RFC 7208 section 4).
+func (c *spfChecker) evaluate(domain string) (string, error) {
+	if !validDomain(domain) {
+		return "none", nil
+	}
+	record, err := c.record(domain)
+	if record == "" || err != nil {
+		return "none", err
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if i := strings.IndexByte(term, '='); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			// Modifiers, only redirect is used, exp is not fetched.
+			name := strings.ToLower(term[:i])
+			if name == "redirect" {
+				if redirect != "" {
+					return "", errSPFPerm("duplicate redirect modifier")
+				}
+				redirect = term[i+1:]
+			}
+			continue
+		}
+		qualifier := "pass"
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = "fail", term[1:]
+		case '~':
+			qualifier, term = "softfail", term[1:]
+		case '?':
+			qualifier, term = "neutral", term[1:]
+		}
+		match, err := c.mechanism(term, domain)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect == "" {
+		return "neutral", nil
+	}
+	if err := c.countLookup(); err != nil {
+		return "", err
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return "", err
+	}
+	result, err := c.evaluate(target)
+	if err == nil && result == "none" {
+		return "", errSPFPerm("redirect to " + target + " without SPF record")
+	}
+	return result, err
+}
+
+// record returns the SPF record of domain, empty if it has none.
+func (c *spfChecker) record(domain string) (string, error) {
+	txts, err := spfResolver.LookupTXT(c.ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return "", errSPFTemp("TXT lookup of " + domain + " failed")
+	}
+	var record string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			if record != "" {
+				return "", errSPFPerm("multiple SPF records for " + domain)
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// countLookup accounts a term causing DNS lookups.
+func (c *spfChecker) countLookup() error {
+	if c.lookups++; c.lookups > 10 {
+		return errSPFPerm("more than 10 DNS lookups")
+	}
+	return nil
+}
+
+// countVoid accounts a lookup without answer.
+func (c *spfChecker) countVoid(err error) error {
+	if err != nil && !isNotFound(err) {
+		return errSPFTemp("DNS lookup failed")
+	}
+	if c.voids++; c.voids > 2 {
+		return errSPFPerm("more than 2 void DNS lookups")
+	}
+	return nil
+}
+
+// mechanism reports whether a mechanism of the record of domain matches.
+func (c *spfChecker) mechanism(term, domain string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		name, arg = term[:i], term[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		return arg == "", nil
+	case "ip4", "ip6":
+		return c.matchIP(strings.ToLower(name), strings.TrimPrefix(arg, ":"))
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.domainSpec(arg, "", domain)
+		if err != nil {
+			return false, err
+		}
+		result, err := c.evaluate(target)
+		switch {
+		case err != nil:
+			return false, err
+		case result == "none":
+			return false, errSPFPerm("include of " + target + " without SPF record")
+		}
+		return result == "pass", nil
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		spec, cidr4, cidr6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := c.domainSpec(spec, domain, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := spfResolver.LookupMX(c.ctx, target)
+			if len(mxs) == 0 {
+				return false, c.countVoid(err)
+			}
+			if len(mxs) > 10 {
+				return false, errSPFPerm("more than 10 MX records for " + target)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := spfResolver.LookupIPAddr(c.ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, errSPFTemp("address lookup of " + host + " failed")
+			}
+			if len(addrs) == 0 && len(hosts) == 1 {
+				if err := c.countVoid(nil); err != nil {
+					return false, err
+				}
+			}
+			for _, addr := range addrs {
+				if c.inCIDR(addr.IP, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.domainSpec(arg, domain, domain)
+		if err != nil {
+			return false, err
+		}
+		names, _ := spfResolver.LookupAddr(c.ctx, c.ip.String())
+		if len(names) > 10 {
+			names = names[:10]
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != strings.ToLower(target) && !strings.HasSuffix(name, "."+strings.ToLower(target)) {
+				continue
+			}
+			addrs, _ := spfResolver.LookupIPAddr(c.ctx, name)
+			for _, addr := range addrs {
+				if addr.IP.Equal(c.ip) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.domainSpec(arg, "", domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := spfResolver.LookupIP(c.ctx, "ip4", target)
+		if len(addrs) == 0 {
+			return false, c.countVoid(err)
+		}
+		return true, nil
+	}
+	return false, errSPFPerm("unknown mechanism " + name)
+}
+
+// matchIP reports whether the client belongs to the network of an ip4 or
+// ip6 mechanism.
+func (c *spfChecker) matchIP(family, network string) (bool, error) {
+	if !strings.Contains(network, "/") {
+		if family == "ip4" {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(network)
+	if err != nil || (n.IP.To4() != nil) != (family == "ip4") {
+		return false, errSPFPerm("invalid " + family + " network " + network)
+	}
+	return n.Contains(c.ip) && (c.ip.To4() != nil) == (family == "ip4"), nil
+}
+
+// inCIDR reports whether addr is the client IP, within the prefix lengths
+// of an a or mx mechanism.
+func (c *spfChecker) inCIDR(addr net.IP, cidr4, cidr6 int) bool {
+	if (addr.To4() != nil) != (c.ip.To4() != nil) {
+		return false
+	}
+	if addr.To4() != nil {
+		mask := net.CIDRMask(cidr4, 32)
+		return addr.To4().Mask(mask).Equal(c.ip.To4().Mask(mask))
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return addr.Mask(mask).Equal(c.ip.Mask(mask))
+}
+
+// splitCIDR splits the ":domain/cidr4//cidr6" argument of a or mx.
+func splitCIDR(arg string) (spec string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	if i := strings.Index(arg, "//"); i != -1 {
+		if cidr6, err = strconv.Atoi(arg[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFPerm("invalid IPv6 prefix length in " + arg)
+		}
+		arg = arg[:i]
+	}
+	if i := strings.IndexByte(arg, '/'); i != -1 {
+		if cidr4, err = strconv.Atoi(arg[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFPerm("invalid IPv4 prefix length in " + arg)
+		}
+		arg = arg[:i]
+	}
+	return arg, cidr4, cidr6, nil
+}
+
+// domainSpec expands the ":domain-spec" argument of a mechanism, def being
+// used when it is absent. An empty def makes the argument mandatory.
+func (c *spfChecker) domainSpec(arg, def, domain string) (string, error) {
+	if arg == "" {
+		if def == "" {
+			return "", errSPFPerm("missing domain-spec")
+		}
+		return def, nil
+	}
+	if arg[0] != ':' || len(arg) == 1 {
+		return "", errSPFPerm("invalid domain-spec " + arg)
+	}
+	return c.expand(arg[1:], domain)
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", errSPFPerm("truncated macro in " + spec)
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm("invalid macro in " + spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm("invalid macro in " + spec)
+		}
+		value, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i += end
+	}
+	return strings.TrimSuffix(b.String(), "."), nil
+}
+
+// macro expands the letter, digits, reversal and delimiters of a macro.
+func (c *spfChecker) macro(m, domain string) (string, error) {
+	local, senderDomain := c.sender, domainOf(c.sender)
+	if i := strings.LastIndexByte(c.sender, '@'); i != -1 {
+		local = c.sender[:i]
+	}
+	var value string
+	switch m[0] | 0x20 {
+	case 's', 'l', 'h':
+		c.private = true
+	}
+	switch m[0] | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'h':
+		value = c.helo
+	case 'i':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			var nibbles []string
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case 'v':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'p':
+		value = "unknown"
+	default:
+		return "", errSPFPerm("unknown macro letter " + m[:1])
+	}
+
+	rest := m[1:]
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits = digits*10 + int(rest[0]-'0')
+		rest = rest[1:]
+	}
+	reverse := false
+	if len(rest) > 0 && rest[0]|0x20 == 'r' {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errSPFPerm("invalid macro delimiters " + rest)
+		}
+		delims = rest
+	}
+	if digits == 0 && !reverse && delims == "." {
+		return value, nil
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// validDomain reports whether domain is a multi-label domain name usable
+// in DNS queries.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeDNS answers SPF lookups from maps, names being without trailing dot.
+type fakeDNS struct {
+	txt  map[string][]string
+	mx   map[string][]string
+	addr map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool // names whose lookups fail with a server error
+}
+
+func (r *fakeDNS) err(name string) error {
+	if r.fail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name = strings.TrimSuffix(name, ".")
+	var mxs []*net.MX
+	for _, host := range r.mx[name] {
+		mxs = append(mxs, &net.MX{Host: host + ".", Pref: 10})
+	}
+	if len(mxs) == 0 {
+		return nil, r.err(name)
+	}
+	return mxs, nil
+}
+
+func (r *fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.TrimSuffix(host, ".")
+	var addrs []net.IPAddr
+	for _, a := range r.addr[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	if len(addrs) == 0 {
+		return nil, r.err(host)
+	}
+	return addrs, nil
+}
+
+func (r *fakeDNS) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	var ips []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			ips = append(ips, a.IP)
+		}
+	}
+	return ips, err
+}
+
+func (r *fakeDNS) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	var names []string
+	for _, name := range r.ptr[addr] {
+		names = append(names, name+".")
+	}
+	if len(names) == 0 {
+		return nil, r.err(addr)
+	}
+	return names, nil
+}
+
+// rfc7208Zone is the DNS zone of the examples of RFC 7208 appendix A.
+func rfc7208Zone(record string) *fakeDNS {
+	return &fakeDNS{
+		txt: map[string][]string{"example.com": {record}},
+		mx: map[string][]string{
+			"example.com": {"mail-a.example.com", "mail-b.example.com"},
+			"example.org": {"mail-c.example.org"},
+		},
+		addr: map[string][]string{
+			"example.com":        {"192.0.2.10", "192.0.2.11"},
+			"amy.example.com":    {"192.0.2.65"},
+			"bob.example.com":    {"192.0.2.66"},
+			"mail-a.example.com": {"192.0.2.129"},
+			"mail-b.example.com": {"192.0.2.130"},
+			"www.example.com":    {"192.0.2.10", "192.0.2.11"},
+			"mail-c.example.org": {"192.0.2.140"},
+		},
+		ptr: map[string][]string{
+			"192.0.2.10":  {"example.com"},
+			"192.0.2.11":  {"example.com"},
+			"192.0.2.65":  {"amy.example.com"},
+			"192.0.2.66":  {"bob.example.com"},
+			"192.0.2.129": {"mail-a.example.com"},
+			"192.0.2.130": {"mail-b.example.com"},
+			"192.0.2.140": {"mail-c.example.org"},
+			"10.0.0.4":    {"bob.example.com"},
+		},
+	}
+}
+
+func checkSPFRecord(t *testing.T, r spfDNS, ip, sender string) (string, string) {
+	t.Helper()
+	defer func(saved spfDNS) { spfResolver = saved }(spfResolver)
+	spfResolver = r
+	c := &spfChecker{ctx: context.Background(), ip: net.ParseIP(ip), sender: sender, helo: "mx.example.net"}
+	return c.checkHost(domainOf(sender))
+}
+
+// TestSPFExamples checks the mechanism examples of RFC 7208 appendix A.1.
+func TestSPFExamples(t *testing.T) {
+	tests := []struct {
+		record string
+		pass   []string
+		fail   []string
+	}{
+		{"v=spf1 +all", []string{"192.0.2.10", "10.0.0.4", "2001:db8::1"}, nil},
+		{"v=spf1 a -all", []string{"192.0.2.10", "192.0.2.11"}, []string{"192.0.2.65", "192.0.2.129"}},
+		{"v=spf1 a:example.org -all", nil, []string{"192.0.2.10", "192.0.2.140"}},
+		{"v=spf1 mx -all", []string{"192.0.2.129", "192.0.2.130"}, []string{"192.0.2.10", "192.0.2.140"}},
+		{"v=spf1 mx:example.org -all", []string{"192.0.2.140"}, []string{"192.0.2.129"}},
+		{"v=spf1 mx mx:example.org -all", []string{"192.0.2.129", "192.0.2.130", "192.0.2.140"}, []string{"192.0.2.10"}},
+		{"v=spf1 mx/30 mx:example.org/30 -all", []string{"192.0.2.128", "192.0.2.131", "192.0.2.141"}, []string{"192.0.2.132", "192.0.2.10"}},
+		{"v=spf1 ptr -all", []string{"192.0.2.10", "192.0.2.65", "192.0.2.130"}, []string{"192.0.2.140", "10.0.0.4"}},
+		{"v=spf1 ip4:192.0.2.128/28 -all", []string{"192.0.2.129", "192.0.2.143"}, []string{"192.0.2.65", "192.0.2.144"}},
+	}
+	for _, tt := range tests {
+		for want, ips := range map[string][]string{"pass": tt.pass, "fail": tt.fail} {
+			for _, ip := range ips {
+				result, reason := checkSPFRecord(t, rfc7208Zone(tt.record), ip, "user@example.com")
+				if result != want {
+					t.Errorf("%q from %s: got %s (%s), want %s", tt.record, ip, result, reason, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSPFLookupErrors checks that a failing address lookup of one of the MX
+// hosts is a temperror rather than a mismatch.
+func TestSPFLookupErrors(t *testing.T) {
+	zone := rfc7208Zone("v=spf1 mx -all")
+	delete(zone.addr, "mail-a.example.com")
+	zone.fail = map[string]bool{"mail-a.example.com": true}
+	if result, _ := checkSPFRecord(t, zone, "192.0.2.130", "user@example.com"); result != "temperror" {
+		t.Errorf("got %s, want temperror", result)
+	}
+	zone.fail = nil
+	if result, _ := checkSPFRecord(t, zone, "192.0.2.130", "user@example.com"); result != "pass" {
+		t.Errorf("without the failure: got %s, want pass", result)
+	}
+	if result, _ := checkSPFRecord(t, zone, "192.0.2.1", "user@example.org"); result != "none" {
+		t.Errorf("domain without record: got %s, want none", result)
+	}
+}
+
+// TestSPFMacros checks the macro examples of RFC 7208 section 7.4.
+func TestSPFMacros(t *testing.T) {
+	tests := []struct {
+		ip, spec, want string
+	}{
+		{"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+		{"192.0.2.3", "%{o}", "email.example.com"},
+		{"192.0.2.3", "%{d}", "email.example.com"},
+		{"192.0.2.3", "%{d4}", "email.example.com"},
+		{"192.0.2.3", "%{d3}", "email.example.com"},
+		{"192.0.2.3", "%{d2}", "example.com"},
+		{"192.0.2.3", "%{d1}", "com"},
+		{"192.0.2.3", "%{dr}", "com.example.email"},
+		{"192.0.2.3", "%{d2r}", "example.email"},
+		{"192.0.2.3", "%{l}", "strong-bad"},
+		{"192.0.2.3", "%{l-}", "strong.bad"},
+		{"192.0.2.3", "%{lr}", "strong-bad"},
+		{"192.0.2.3", "%{lr-}", "bad.strong"},
+		{"192.0.2.3", "%{l1r-}", "strong"},
+		{"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+	}
+	for _, tt := range tests {
+		c := &spfChecker{ip: net.ParseIP(tt.ip), sender: "strong-bad@email.example.com"}
+		got, err := c.expand(tt.spec, "email.example.com")
+		if err != nil || got != tt.want {
+			t.Errorf("%s from %s: got %q, %v, want %q", tt.spec, tt.ip, got, err, tt.want)
+		}
+	}
+	c := &spfChecker{ip: net.ParseIP("192.0.2.3")}
+	var perm errSPFPerm
+	if _, err := c.expand("%{x}", "example.com"); !errors.As(err, &perm) {
+		t.Errorf("unknown macro letter: got %v, want permerror", err)
+	}
+}
+
+// TestSPFCache checks that results are reused for the same client and
+// domain, except when a macro depends on the local part.
+func TestSPFCache(t *testing.T) {
+	defer func(saved spfDNS) { spfResolver = saved }(spfResolver)
+	spfCache = make(map[string]spfVerdict)
+	zone := rfc7208Zone("v=spf1 a -all")
+	spfResolver = zone
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25}
+	if _, result, _ := spfCheck(addr, "a@example.com"); result != "pass" {
+		t.Fatalf("got %s, want pass", result)
+	}
+	zone.txt["example.com"] = []string{"v=spf1 -all"}
+	if _, result, _ := spfCheck(addr, "b@EXAMPLE.com"); result != "pass" {
+		t.Errorf("cached: got %s, want pass", result)
+	}
+
+	zone.txt["example.org"] = []string{"v=spf1 exists:%{l}.allow.example.org -all"}
+	zone.addr["a.allow.example.org"] = []string{"127.0.0.2"}
+	if _, result, _ := spfCheck(addr, "a@example.org"); result != "pass" {
+		t.Errorf("allowed local part: got %s, want pass", result)
+	}
+	if _, result, _ := spfCheck(addr, "b@example.org"); result != "fail" {
+		t.Errorf("other local part: got %s, want fail", result)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacket keeps batched metrics within a single unfragmented UDP
+// datagram on common networks.
+const statsdMaxPacket = 1432
+
+var (
+	statsdAddr   string // Address of the StatsD daemon.
+	statsdPrefix string // Prefix of the metric names.
+	statsd       *statsdClient
+)
+
+// statsdClient batches metrics in the StatsD line format and sends them
+// over UDP every second, or sooner when a datagram is full. Its methods do
+// nothing on a nil client.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	stop chan struct{}
+	done chan struct{}
+}
+
+// dialStatsd prepares the client sending metrics to addr.
+func dialStatsd(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	c := &statsdClient{
+		conn:   conn,
+		prefix: prefix,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.flushLoop()
+	return c, nil
+}
+
+// count adds n to a counter.
+func (c *statsdClient) count(name string, n int64) {
+	if c != nil {
+		c.add(fmt.Sprintf("%s%s:%d|c", c.prefix, name, n))
+	}
+}
+
+// gauge sets the current value of a gauge.
+func (c *statsdClient) gauge(name string, value int64) {
+	if c != nil {
+		c.add(fmt.Sprintf("%s%s:%d|g", c.prefix, name, value))
+	}
+}
+
+// timing records a duration in milliseconds.
+func (c *statsdClient) timing(name string, d time.Duration) {
+	if c != nil {
+		c.add(fmt.Sprintf("%s%s:%.3f|ms", c.prefix, name, float64(d)/float64(time.Millisecond)))
+	}
+}
+
+func (c *statsdClient) add(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf.Len() > 0 && c.buf.Len()+1+len(line) > statsdMaxPacket {
+		c.flushLocked()
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.WriteString(line)
+}
+
+func (c *statsdClient) flushLocked() {
+	if c.buf.Len() == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf.Bytes()); err != nil {
+		log.Printf("WARNING: statsd: %v", err)
+	}
+	c.buf.Reset()
+}
+
+func (c *statsdClient) flushLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		c.flushLocked()
+		c.mu.Unlock()
+	}
+}
+
+// close sends the pending metrics and releases the connection.
+func (c *statsdClient) close() error {
+	if c == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	return c.conn.Close()
+}
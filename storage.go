@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	fileSync         bool          // Sync mail data to disk before closing.
+	fileSyncDir      bool          // Sync the directory of new mail data files.
+	writeConcurrency int           // Maximum number of concurrent mail writes.
+	writeSlots       chan struct{} // Semaphore of -write-concurrency.
+	writesInFlight   int64         // atomic count of mail writes in progress
+	fileLimit        int           // Maximum number of concurrent file writes.
+	fileSlots        chan struct{} // Semaphore of -concurrent-file-limit.
+	fileWaitWarn     time.Duration // Debug log file slot waits above this.
+)
+
+var errWriteBusy = errors.New("451 4.3.0 Storage busy, try again later")
+
+// acquireWriteSlot waits for one of the -write-concurrency slots, for up
+// to the session timeout. Every successful call must be followed by
+// releaseWriteSlot.
+func acquireWriteSlot() error {
+	if writeSlots != nil {
+		timer := time.NewTimer(srv.Timeout)
+		defer timer.Stop()
+		select {
+		case writeSlots <- struct{}{}:
+		case <-timer.C:
+			return errWriteBusy
+		}
+	}
+	statsd.gauge("writes_in_flight", atomic.AddInt64(&writesInFlight, 1))
+	return nil
+}
+
+// releaseWriteSlot frees the slot taken by acquireWriteSlot.
+func releaseWriteSlot() {
+	statsd.gauge("writes_in_flight", atomic.AddInt64(&writesInFlight, -1))
+	if writeSlots != nil {
+		<-writeSlots
+	}
+}
+
+// acquireFileSlot waits for one of the -concurrent-file-limit slots, for up
+// to the session timeout as acquireWriteSlot. The slots only cover the file
+// writes of a mail, while -write-concurrency also covers the preparation of
+// the stored data (headers, DKIM signature). Waits above -file-wait-warn are
+// logged in debug mode. Every successful call must be followed by
+// releaseFileSlot.
+func acquireFileSlot(remoteAddr net.Addr, from string, to []string) error {
+	if fileSlots == nil {
+		return nil
+	}
+	start := time.Now()
+	timer := time.NewTimer(srv.Timeout)
+	defer timer.Stop()
+	select {
+	case fileSlots <- struct{}{}:
+	case <-timer.C:
+		return errWriteBusy
+	}
+	if waited := time.Since(start); waited > fileWaitWarn && smtpd.Debug {
+		log.Printf(logFormatHead+", file write slot wait: %v", remoteAddr, from, to, waited)
+	}
+	return nil
+}
+
+// releaseFileSlot frees the slot taken by acquireFileSlot.
+func releaseFileSlot() {
+	if fileSlots != nil {
+		<-fileSlots
+	}
+}
+
+// storeMail writes the mail data to filename.
+func storeMail(filename string, data []byte) error {
+	if shardBy != "" || casRoot != "" {
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return err
+		}
+	}
+	if casRoot != "" {
+		// Identical content was already stored at this path.
+		if _, err := os.Stat(filename); err == nil {
+			return nil
+		}
+		return writeFileAtomic(filename, data, 0666)
+	}
+	return writeFile(filename, data, 0666)
+}
+
+// writeFile is os.WriteFile, syncing the file and its directory as
+// requested by -file-sync and -file-sync-dir.
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && fileSync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fileSyncDir {
+		err = syncDir(filepath.Dir(filename))
+	}
+	return err
+}
+
+// syncDir flushes the entries of dir, making file creations and renames
+// in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file renamed to filename,
+// so filename never holds partial data. As with os.WriteFile, perm is
+// reduced by the umask.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && fileSync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm&^umask)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if fileSyncDir {
+		return syncDir(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// checkOutputDir verifies the directory receiving mail data is writable.
+func checkOutputDir() error {
+	if fileFormat == "" {
+		return nil
+	}
+	dir := fileFormat
+	if casRoot != "" {
+		dir = casRoot + string(filepath.Separator)
+	}
+	if i := strings.Index(dir, "%"); i != -1 {
+		dir = dir[:i]
+	}
+	if err := checkWritable(filepath.Dir(dir + "x")); err != nil {
+		return fmt.Errorf("output directory is not writable: %w", err)
+	}
+	return nil
+}
+
+// verifyBackends checks the configured storages can be written to, and
+// that the webhook accepts connections.
+func verifyBackends() error {
+	// Paths are relative to the chroot, checked once privileges are dropped.
+	if chrootDir == "" {
+		if err := checkOutputDir(); err != nil {
+			return err
+		}
+	}
+	if archiveDir != "" {
+		if err := checkWritable(archiveDir); err != nil {
+			return fmt.Errorf("JSONL archive directory is not writable: %w", err)
+		}
+	}
+	if indexPath != "" && chrootDir == "" {
+		if err := checkWritable(filepath.Dir(indexPath)); err != nil {
+			return fmt.Errorf("-index directory is not writable: %w", err)
+		}
+	}
+	if err := checkRoleDirs(); err != nil {
+		return err
+	}
+	if err := checkFIFO(); err != nil {
+		return err
+	}
+	if err := checkWebhook(); err != nil {
+		return err
+	}
+	log.Print("Backend verification succeeded.")
+	return nil
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".smtp_receiver-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkWriteConcurrency delivers mails from parallel sessions, without
+// and with -write-concurrency.
+func BenchmarkWriteConcurrency(b *testing.B) {
+	defer func(format string, slots chan struct{}, timeout time.Duration) {
+		fileFormat, writeSlots, srv.Timeout = format, slots, timeout
+	}(fileFormat, writeSlots, srv.Timeout)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	srv.Timeout = time.Minute
+
+	data := []byte("Received: from client.example.org\r\n\tby mx.example.com\r\n\tfor <user@example.com>\r\n" +
+		"Subject: benchmark\r\n\r\n" + strings.Repeat(strings.Repeat("x", 76)+"\r\n", 400))
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	for _, limit := range []int{0, 1, 4, 16} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			fileFormat = filepath.Join(b.TempDir(), "%N.eml")
+			writeSlots = nil
+			if limit > 0 {
+				writeSlots = make(chan struct{}, limit)
+			}
+			b.SetBytes(int64(len(data)))
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := mailProcessing(addr, "sender@example.org", []string{"user@example.com"}, data); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// syslogWriter sends mail events to a remote syslog daemon.
+//
+// log/syslog only produces RFC 3164 style headers, so messages are formatted
+// here following RFC 5424 to carry the envelope as structured data.
+type syslogWriter struct {
+	conn     net.Conn
+	stream   bool // stream transports need a message delimiter
+	hostname string
+	appname  string
+}
+
+const (
+	syslogPriority = 2*8 + 6 // facility mail, severity informational
+	syslogSDID     = "mail@32473"
+)
+
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// dialSyslog connects to the syslog daemon at addr.
+func dialSyslog(network, addr, hostname, appname string) (*syslogWriter, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{
+		conn:     conn,
+		stream:   !strings.HasPrefix(network, "udp") && network != "unixgram",
+		hostname: hostname,
+		appname:  appname,
+	}, nil
+}
+
+// mailEvent sends one event for a received mail.
+func (w *syslogWriter) mailEvent(from string, to []string, size int, hash, msg string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", syslogPriority,
+		time.Now().Format(time.RFC3339Nano), nilValue(w.hostname), nilValue(w.appname), os.Getpid(), "accepted")
+	fmt.Fprintf(&b, `[%s from="%s" to="%s" size="%d" hash="%s"] %s`, syslogSDID,
+		syslogEscaper.Replace(from), syslogEscaper.Replace(strings.Join(to, ",")), size, hash, msg)
+	if w.stream {
+		b.WriteByte('\n')
+	}
+	_, err := w.conn.Write([]byte(b.String()))
+	return err
+}
+
+// logLine sends a log line, at the warning severity for WARNING and
+// SECURITY lines.
+func (w *syslogWriter) logLine(line string) error {
+	priority := syslogPriority
+	if strings.HasPrefix(line, "WARNING: ") || strings.HasPrefix(line, "SECURITY: ") {
+		priority = 2*8 + 4
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s - %s", priority,
+		time.Now().Format(time.RFC3339Nano), nilValue(w.hostname), nilValue(w.appname), os.Getpid(), "log", line)
+	if w.stream {
+		b.WriteByte('\n')
+	}
+	_, err := w.conn.Write([]byte(b.String()))
+	return err
+}
+
+// nilValue replaces an empty header field by the RFC 5424 NILVALUE.
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "_")
+}
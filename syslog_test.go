@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rfc5424 matches a RFC 5424 message: PRI, VERSION, TIMESTAMP, HOSTNAME,
+// APP-NAME, PROCID, MSGID, STRUCTURED-DATA and MSG.
+var rfc5424 = regexp.MustCompile(`^<(\d{1,3})>1 (\S+) ([!-~]{1,255}) ([!-~]{1,48}) ([!-~]{1,128}) ([!-~]{1,32}) (-|(?:\[[^ =\]"]+(?: [^ =\]"]+="(?:[^"\\\]]|\\.)*")*\])+)(?: (.*))?$`)
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w, err := dialSyslog("udp", pc.LocalAddr().String(), "mx.example.com", "smtp receiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.conn.Close()
+
+	read := func() []string {
+		t.Helper()
+		buf := make([]byte, 2048)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := rfc5424.FindStringSubmatch(string(buf[:n]))
+		if m == nil {
+			t.Fatalf("not a RFC 5424 message: %q", buf[:n])
+		}
+		if _, err := time.Parse(time.RFC3339Nano, m[2]); err != nil {
+			t.Errorf("timestamp: %v", err)
+		}
+		return m
+	}
+	for _, tt := range []struct {
+		line     string
+		priority int
+	}{
+		{"remote: 192.0.2.1, mail accepted", 22},
+		{"WARNING: unable to set read buffer", 20},
+		{"SECURITY: remote: 192.0.2.1, PROXY header ignored", 20},
+	} {
+		if err := w.logLine(tt.line); err != nil {
+			t.Fatal(err)
+		}
+		m := read()
+		if m[1] != strconv.Itoa(tt.priority) || m[3] != "mx.example.com" || m[4] != "smtp_receiver" || m[6] != "log" || m[7] != "-" || m[8] != tt.line {
+			t.Errorf("%s: got %q", tt.line, m[1:])
+		}
+	}
+
+	if err := w.mailEvent(`"odd]\name"@example.org`, []string{"a@example.com", "b@example.com"}, 42, "abc123", "stored"); err != nil {
+		t.Fatal(err)
+	}
+	m := read()
+	want := `[mail@32473 from="\"odd\]\\name\"@example.org" to="a@example.com,b@example.com" size="42" hash="abc123"]`
+	if m[6] != "accepted" || m[7] != want || m[8] != "stored" {
+		t.Errorf("mail event: got %q", m[1:])
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+var (
+	tarpitNets  netList       // Networks whose connections are tarpitted.
+	tarpitDelay time.Duration // Delay per KB written to tarpitted connections.
+	tarpitMax   time.Duration // Maximum total delay of a tarpitted connection.
+	tarpitSleep = time.Sleep  // Replaced by the tests.
+)
+
+// tarpitConn slows down the responses sent to a client.
+type tarpitConn struct {
+	net.Conn
+	delayed time.Duration
+}
+
+// Write writes b then waits in proportion of the bytes written,
+// until the connection was delayed for tarpitMax.
+func (c *tarpitConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	d := tarpitDelay * time.Duration(n) / 1000
+	if c.delayed+d > tarpitMax {
+		d = tarpitMax - c.delayed
+	}
+	if d > 0 {
+		c.delayed += d
+		tarpitSleep(d)
+	}
+	return n, err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	defer func(delay, max time.Duration, sleep func(time.Duration)) {
+		tarpitDelay, tarpitMax, tarpitSleep = delay, max, sleep
+	}(tarpitDelay, tarpitMax, tarpitSleep)
+	var slept []time.Duration
+	tarpitSleep = func(d time.Duration) { slept = append(slept, d) }
+	tarpitDelay, tarpitMax = time.Second, 2500*time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	c := &tarpitConn{Conn: server}
+	for _, size := range []int{1000, 500, 1000, 1000, 1000} {
+		if n, err := c.Write(make([]byte, size)); n != size || err != nil {
+			t.Fatalf("Write: %d, %v", n, err)
+		}
+	}
+	want := []time.Duration{time.Second, 500 * time.Millisecond, time.Second}
+	if len(slept) != len(want) {
+		t.Fatalf("delays: got %v, want %v", slept, want)
+	}
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Errorf("delays: got %v, want %v", slept, want)
+		}
+	}
+}
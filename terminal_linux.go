@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// isatty reports whether f is a terminal, the ioctl reading the terminal
+// attributes failing on other files.
+func isatty(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	errno := syscall.ENOTTY
+	rc.Control(func(fd uintptr) {
+		var termios syscall.Termios
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	})
+	return errno == 0
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd
+// +build !linux,!darwin,!dragonfly,!freebsd
+
+package main
+
+import "os"
+
+// isatty reports whether f is a character device, terminals not being told
+// apart from other devices on this platform.
+func isatty(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
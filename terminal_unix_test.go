@@ -0,0 +1,28 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestIsatty checks a character device which is not a terminal is told
+// apart from terminals.
+func TestIsatty(t *testing.T) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	if isatty(f) {
+		t.Errorf("%s is a terminal", os.DevNull)
+	}
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		if !isatty(tty) {
+			t.Error("/dev/tty is not a terminal")
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"smtp_receiver/smtpd"
+)
+
+var (
+	sniCerts     certList // Additional certificates selected by SNI.
+	sniRequired  bool     // Refuse TLS handshakes without SNI.
+	clientCAFile string   // PEM bundle of the CAs verifying client certificates.
+	logClientFP  bool     // Log the fingerprint of client certificates.
+
+	tlsRequiredExceptLoopback bool // Enforce STARTTLS for non loopback clients only.
+)
+
+// certList is a repeatable flag of "certfile,keyfile" pairs.
+type certList []tls.Certificate
+
+func (l *certList) String() string {
+	if l == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d certificates", len(*l))
+}
+
+func (l *certList) Set(value string) error {
+	files := strings.SplitN(value, ",", 2)
+	if len(files) != 2 {
+		return errors.New("expected certfile,keyfile")
+	}
+	cert, err := tls.LoadX509KeyPair(files[0], files[1])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, cert)
+	return nil
+}
+
+// configureSNI adds the -sni-cert certificates to the TLS configuration and
+// installs the -sni-required check.
+func configureSNI() {
+	if len(sniCerts) > 0 {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.Certificates = append(srv.TLSConfig.Certificates, sniCerts...)
+	}
+	if !sniRequired {
+		return
+	}
+	if srv.TLSConfig == nil {
+		log.Fatal("-sni-required needs TLS to be configured")
+	}
+	if len(srv.TLSConfig.Certificates) < 2 {
+		log.Print("WARNING: -sni-required is meant to be used with multiple certificates, see -sni-cert")
+	}
+	// GetCertificate is not called without SNI when Certificates is set.
+	srv.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName == "" {
+			log.Printf("WARNING: remote: %v, TLS handshake without SNI refused", hello.Conn.RemoteAddr())
+			return nil, errors.New("SNI required")
+		}
+		// Keep the server configuration.
+		return nil, nil
+	}
+}
+
+// configureClientCA verifies the certificates presented by clients against
+// the CAs of the -client-ca bundle. Clients without certificate are still
+// accepted.
+func configureClientCA() error {
+	if clientCAFile == "" {
+		return nil
+	}
+	if srv.TLSConfig == nil {
+		return errors.New("-client-ca needs TLS to be configured")
+	}
+	content, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return fmt.Errorf("%s: no CA certificate found", clientCAFile)
+	}
+	srv.TLSConfig.ClientCAs = pool
+	srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// configureFingerprintLog asks clients for their certificate, without
+// verifying it unless -client-ca is set, so that tlsEstablished can log it.
+func configureFingerprintLog() error {
+	if !logClientFP {
+		return nil
+	}
+	if srv.TLSConfig == nil {
+		return errors.New("-tls-fingerprint-log needs TLS to be configured")
+	}
+	if srv.TLSConfig.ClientAuth == tls.NoClientCert {
+		srv.TLSConfig.ClientAuth = tls.RequestClientCert
+	}
+	srv.HandlerTLS = tlsEstablished
+	return nil
+}
+
+// tlsEstablished logs the fingerprint of the certificate presented by the
+// client, if any.
+func tlsEstablished(remoteAddr net.Addr) {
+	if logQuiet && !smtpd.Debug {
+		return
+	}
+	peer := remoteAddr.(*smtpd.Peer)
+	if len(peer.TLS.PeerCertificates) == 0 {
+		log.Printf("remote: %v, TLS established", remoteAddr)
+		return
+	}
+	log.Printf("remote: %v, TLS established, client_cert_fingerprint: %s",
+		remoteAddr, certFingerprint(peer.TLS.PeerCertificates[0].Raw))
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a DER certificate as
+// colon separated hexadecimal bytes.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
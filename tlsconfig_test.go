@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp_receiver/smtpd"
+)
+
+// testCert is a certificate with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate named cn, a CA if isCA, signed by
+// parent or self-signed when parent is nil.
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer := &testCert{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// TestClientCABundle verifies client certificates against a bundle of two
+// CAs: clients signed by either are accepted, others refused.
+func TestClientCABundle(t *testing.T) {
+	defer func(config *tls.Config, file string) { srv.TLSConfig, clientCAFile = config, file }(srv.TLSConfig, clientCAFile)
+
+	ca1, ca2, other := newTestCert(t, "CA 1", true, nil), newTestCert(t, "CA 2", true, nil), newTestCert(t, "Other CA", true, nil)
+	server := newTestCert(t, "mx.example.com", false, nil)
+	var bundle []byte
+	for _, ca := range []*testCert{ca1, ca2} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	clientCAFile = filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(clientCAFile, bundle, 0600)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}}
+	if err := configureClientCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tests := []struct {
+		name   string
+		issuer *testCert // nil for a client without certificate
+		ok     bool
+	}{
+		{"signed by CA 1", ca1, true},
+		{"signed by CA 2", ca2, true},
+		{"signed by another CA", other, false},
+		{"without certificate", nil, true},
+	}
+	for _, tt := range tests {
+		config := &tls.Config{ServerName: "mx.example.com", InsecureSkipVerify: true}
+		if tt.issuer != nil {
+			// Sent even when not issued by a CA the server asks for.
+			cert := newTestCert(t, "client.example.org", false, tt.issuer).tlsCertificate()
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+		}
+		// Buffered, TCP lets both ends send their alerts on failure.
+		clientConn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			tls.Client(clientConn, config).Handshake()
+			clientConn.Close()
+		}()
+		err = tls.Server(serverConn, srv.TLSConfig).Handshake()
+		serverConn.Close()
+		if tt.ok && err != nil {
+			t.Errorf("%s: refused: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	os.WriteFile(clientCAFile, []byte("no certificate here\n"), 0600)
+	if err := configureClientCA(); err == nil {
+		t.Error("bundle without certificate accepted")
+	}
+}
+
+func TestTLSEstablishedQuiet(t *testing.T) {
+	defer func(quiet bool) { logQuiet = quiet }(logQuiet)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	client := newTestCert(t, "client.example.org", false, nil)
+	peer := &smtpd.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		TLS:  &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}},
+	}
+	logQuiet = false
+	tlsEstablished(peer)
+	if want := "client_cert_fingerprint: " + certFingerprint(client.cert.Raw); !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q in %q", want, logs.String())
+	}
+	logs.Reset()
+	logQuiet = true
+	tlsEstablished(peer)
+	if logs.String() != "" {
+		t.Errorf("logged with -quiet: %s", logs.String())
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+
+	"smtp_receiver/smtpd"
+)
+
+// maxTranscriptBytes bounds the dialog kept in memory for each session.
+const maxTranscriptBytes = 64 << 10
+
+var transcript bool // Save the SMTP dialog next to each mail.
+
+// writeTranscript saves the dialog of the session up to its first MAIL and
+// the dialog of the transaction, up to the end of the message data, to
+// filename.transcript.
+func writeTranscript(remoteAddr net.Addr, filename string) error {
+	peer, ok := remoteAddr.(*smtpd.Peer)
+	if !ok || peer.Transcript == nil {
+		return nil
+	}
+	return writeFile(filename+".transcript", peer.Transcript.Bytes(), 0666)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	webhookURL         string        // URL mails are posted to.
+	webhookTimeout     time.Duration // Timeout of each post.
+	webhookAsync       bool          // Accept mails once queued instead of posted.
+	webhookQueueSize   int           // Maximum number of mails waiting to be posted.
+	webhookMaxAttempts int           // Maximum number of posts of a mail.
+	webhookBackoff     time.Duration // Wait before the first retry, doubled for each next one.
+
+	webhookClient  *http.Client
+	webhookQueue   chan *webhookPost
+	webhookFlush   = make(chan struct{}) // closed on shutdown to retry at once
+	webhookPending int64                 // atomic count of queued or retrying posts
+)
+
+var errWebhook = errors.New("451 4.3.0 Delivery failed, try again later")
+
+// webhookPost is a mail to post to -webhook-url.
+type webhookPost struct {
+	from     string
+	to       []string
+	data     []byte
+	attempts int
+	flushed  bool // A backoff was cut short by flushWebhook
+}
+
+// startWebhook starts the worker posting the queued mails of -webhook-async.
+func startWebhook() error {
+	if webhookURL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(webhookURL, "http://") && !strings.HasPrefix(webhookURL, "https://") {
+		return errors.New("-webhook-url must be an http or https URL")
+	}
+	if webhookMaxAttempts < 1 {
+		return errors.New("-webhook-max-attempts must be at least 1")
+	}
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	if webhookAsync {
+		webhookQueue = make(chan *webhookPost, webhookQueueSize)
+		go webhookWorker()
+	}
+	return nil
+}
+
+// checkWebhook verifies that the -webhook-url server accepts connections,
+// without posting anything.
+func checkWebhook() error {
+	if webhookURL == "" {
+		return nil
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), webhookTimeout)
+	if err != nil {
+		return fmt.Errorf("-webhook-url is not reachable: %w", err)
+	}
+	return conn.Close()
+}
+
+// send posts the mail once. Its error tells whether a retry may succeed.
+func (p *webhookPost) send() (retry bool, err error) {
+	p.attempts++
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(p.data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Envelope-From", p.from)
+	req.Header.Set("X-Envelope-To", strings.Join(p.to, ", "))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook replied %s", resp.Status)
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// backoff returns the wait before the next attempt of p.
+func (p *webhookPost) backoff() time.Duration {
+	return webhookBackoff << uint(p.attempts-1)
+}
+
+// postWebhook delivers a mail to -webhook-url. With -webhook-async it is
+// only queued, else it is posted with retries before replying.
+func postWebhook(from string, to []string, data []byte) error {
+	p := &webhookPost{from: from, to: to, data: data}
+	if webhookAsync {
+		atomic.AddInt64(&webhookPending, 1)
+		select {
+		case webhookQueue <- p:
+			return nil
+		default:
+			atomic.AddInt64(&webhookPending, -1)
+			return errors.New("queue full")
+		}
+	}
+	for {
+		retry, err := p.send()
+		if err == nil {
+			return nil
+		}
+		if !retry || p.attempts >= webhookMaxAttempts {
+			return fmt.Errorf("%d attempts: %w", p.attempts, err)
+		}
+		time.Sleep(p.backoff())
+	}
+}
+
+// webhookWorker posts the queued mails, retrying with exponential backoff.
+// Mails that cannot be posted or requeued are dropped.
+func webhookWorker() {
+	for p := range webhookQueue {
+		retry, err := p.send()
+		if err == nil {
+			atomic.AddInt64(&webhookPending, -1)
+			continue
+		}
+		if !retry || p.attempts >= webhookMaxAttempts {
+			log.Printf("WARNING: webhook post dropped after %d attempts, MAIL From: <%s>, RCPT To: %v: %v", p.attempts, p.from, p.to, err)
+			atomic.AddInt64(&webhookPending, -1)
+			continue
+		}
+		go func(p *webhookPost) {
+			timer := time.NewTimer(p.backoff())
+			defer timer.Stop()
+			// The flush retries a waiting mail at once, its later retries
+			// back off as usual.
+			flush := webhookFlush
+			if p.flushed {
+				flush = nil
+			}
+			select {
+			case <-timer.C:
+			case <-flush:
+				p.flushed = true
+			}
+			select {
+			case webhookQueue <- p:
+			default:
+				log.Printf("WARNING: webhook post dropped, queue full, MAIL From: <%s>, RCPT To: %v", p.from, p.to)
+				atomic.AddInt64(&webhookPending, -1)
+			}
+		}(p)
+	}
+}
+
+// flushWebhook retries the queued mails at once, then with their usual
+// backoff, and waits for them to be posted, for up to timeout.
+func flushWebhook(timeout time.Duration) {
+	if webhookQueue == nil {
+		return
+	}
+	close(webhookFlush)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&webhookPending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pending := atomic.LoadInt64(&webhookPending); pending > 0 {
+		log.Printf("WARNING: webhook queue flush timed out, mails not posted: %d.", pending)
+	} else {
+		log.Println("webhook queue drained.")
+	}
+}
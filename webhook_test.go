@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testWebhook points -webhook-url at a server replying with the given
+// statuses in turn, then 200, and returns the count of posts it received.
+func testWebhook(t *testing.T, statuses ...int) *int32 {
+	t.Helper()
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&posts, 1))
+		if r.Header.Get("X-Envelope-From") != "sender@example.org" || r.Header.Get("Content-Type") != "message/rfc822" {
+			t.Errorf("post %d headers: %v", n, r.Header)
+		}
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	url, async, attempts, backoff, client, queue := webhookURL, webhookAsync, webhookMaxAttempts, webhookBackoff, webhookClient, webhookQueue
+	t.Cleanup(func() {
+		webhookURL, webhookAsync, webhookMaxAttempts, webhookBackoff, webhookClient, webhookQueue = url, async, attempts, backoff, client, queue
+	})
+	webhookURL, webhookMaxAttempts, webhookBackoff = server.URL, 3, time.Millisecond
+	webhookClient = server.Client()
+	return &posts
+}
+
+func TestWebhookRetry(t *testing.T) {
+	posts := testWebhook(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	if err := postWebhook("sender@example.org", []string{"user@example.com"}, []byte("Subject: test\r\n\r\n")); err != nil {
+		t.Errorf("5xx then 200: %v", err)
+	}
+	if n := atomic.LoadInt32(posts); n != 3 {
+		t.Errorf("5xx then 200: got %d posts, want 3", n)
+	}
+
+	posts = testWebhook(t, http.StatusBadRequest)
+	if err := postWebhook("sender@example.org", []string{"user@example.com"}, nil); err == nil {
+		t.Error("4xx: accepted")
+	}
+	if n := atomic.LoadInt32(posts); n != 1 {
+		t.Errorf("4xx: got %d posts, want 1", n)
+	}
+
+	posts = testWebhook(t, 500, 500, 500)
+	if err := postWebhook("sender@example.org", []string{"user@example.com"}, nil); err == nil {
+		t.Error("5xx past -webhook-max-attempts: accepted")
+	}
+	if n := atomic.LoadInt32(posts); n != 3 {
+		t.Errorf("5xx past -webhook-max-attempts: got %d posts, want 3", n)
+	}
+}
+
+func TestWebhookAsync(t *testing.T) {
+	posts := testWebhook(t, http.StatusBadGateway)
+	webhookAsync = true
+
+	// Without worker, the queue of one mail saturates at once.
+	webhookQueue = make(chan *webhookPost, 1)
+	if err := postWebhook("sender@example.org", []string{"user@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := postWebhook("sender@example.org", []string{"user@example.com"}, nil); err == nil || err.Error() != "queue full" {
+		t.Errorf("saturated queue: got %v", err)
+	}
+
+	// The queued mail is retried by the worker until posted.
+	go webhookWorker()
+	defer close(webhookQueue)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&webhookPending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := atomic.LoadInt64(&webhookPending); pending != 0 {
+		t.Errorf("pending posts: got %d", pending)
+	}
+	if n := atomic.LoadInt32(posts); n != 2 {
+		t.Errorf("got %d posts, want 2", n)
+	}
+}